@@ -0,0 +1,508 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/ipc/client"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
+	"github.com/oomol-lab/ovm/pkg/ipc/restful"
+)
+
+// subcommands talk to the restful socket of a running ovm. Each binds its own flags to the FlagSet
+// of the invocation and returns the function running it.
+var subcommands = map[string]func(fs *flag.FlagSet) subcommand{
+	"status":       noFlags(status),
+	"info":         noFlags(info),
+	"stop":         noFlags(call((*client.Client).Stop)),
+	"request-stop": noFlags(call((*client.Client).RequestStop)),
+	"pause":        noFlags(call((*client.Client).Pause)),
+	"resume":       noFlags(call((*client.Client).Resume)),
+	"exec":         execSubcommand,
+	"cp":           cpSubcommand,
+	"events":       eventsSubcommand,
+}
+
+type subcommand func(ctx context.Context, c *cmdClient, args []string) error
+
+func noFlags(run subcommand) func(*flag.FlagSet) subcommand {
+	return func(*flag.FlagSet) subcommand {
+		return run
+	}
+}
+
+type cmdClient struct {
+	*client.Client
+	json bool
+}
+
+// runSubcommand runs the client subcommand and returns the exit code of the process.
+func runSubcommand(name string, args []string) int {
+	fs := flag.NewFlagSet("ovm "+name, flag.ContinueOnError)
+	vmName := fs.String("name", "", "Name of the virtual machine")
+	socketPath := fs.String("socket-path", "", "Socket directory of the virtual machine")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	run := subcommands[name](fs)
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	if *vmName == "" || *socketPath == "" {
+		fmt.Fprintln(os.Stderr, "name and socket-path are required")
+		return 2
+	}
+
+	p, err := filepath.Abs(client.SocketPath(*socketPath, *vmName))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	c := &cmdClient{
+		Client: client.New(p),
+		json:   *asJSON,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, c, fs.Args()); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			return exitErr.code
+		}
+
+		if c.json {
+			_ = json.NewEncoder(os.Stdout).Encode(map[string]string{"error": err.Error()})
+		} else {
+			fmt.Fprintf(os.Stderr, "%s error: %v\n", name, err)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// exitError ends the subcommand with the exit code, the reason has already been printed.
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func (c *cmdClient) print(v any, human func()) {
+	if c.json {
+		_ = json.NewEncoder(os.Stdout).Encode(v)
+		return
+	}
+
+	human()
+}
+
+func status(ctx context.Context, c *cmdClient, _ []string) error {
+	s, err := c.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.print(s, func() {
+		fmt.Printf("State:            %s\n", strings.TrimPrefix(s.State, "VirtualMachineState"))
+		fmt.Printf("Can start:        %v\n", s.CanStart)
+		fmt.Printf("Can request stop: %v\n", s.CanRequestStop)
+		fmt.Printf("Can stop:         %v\n", s.CanStop)
+		fmt.Printf("Can pause:        %v\n", s.CanPause)
+		fmt.Printf("Can resume:       %v\n", s.CanResume)
+		if s.SSH != nil {
+			fmt.Printf("SSH connected:    %v (%d/%d sessions)\n", s.SSH.Connected, s.SSH.ActiveSessions, s.SSH.MaxSessions)
+			if s.SSH.LastError != "" {
+				fmt.Printf("SSH last error:   %s\n", s.SSH.LastError)
+			}
+		}
+	})
+
+	return nil
+}
+
+func info(ctx context.Context, c *cmdClient, _ []string) error {
+	i, err := c.Info(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.print(i, func() {
+		fmt.Printf("Podman socket:    %s\n", i.PodmanSocketPath)
+		fmt.Printf("SSH:              %s@127.0.0.1:%d\n", i.SSHUser, i.SSHPort)
+		fmt.Printf("SSH private key:  %s\n", i.SSHPrivateKeyPath)
+		fmt.Printf("SSH public key:   %s\n", i.SSHPublicKeyPath)
+		fmt.Printf("SSH host key:     %s\n", i.SSHHostKeyFingerprint)
+		fmt.Printf("Known hosts:      %s\n", i.KnownHostsPath)
+	})
+
+	return nil
+}
+
+func call(fn func(c *client.Client, ctx context.Context) (*restful.StateResponse, error)) func(ctx context.Context, c *cmdClient, _ []string) error {
+	return func(ctx context.Context, c *cmdClient, _ []string) error {
+		s, err := fn(c.Client, ctx)
+		if err != nil {
+			return err
+		}
+
+		c.print(s, func() {
+			fmt.Printf("OK, state: %s\n", strings.TrimPrefix(s.State, "VirtualMachineState"))
+		})
+
+		return nil
+	}
+}
+
+// execOptions are the flags of the exec subcommand.
+type execOptions struct {
+	env     envFlag
+	cwd     string
+	user    string
+	timeout time.Duration
+	stdin   bool
+}
+
+func execSubcommand(fs *flag.FlagSet) subcommand {
+	var o execOptions
+	o.bind(fs)
+
+	return func(ctx context.Context, c *cmdClient, args []string) error {
+		return execCommand(ctx, c, &o, args)
+	}
+}
+
+func (o *execOptions) bind(fs *flag.FlagSet) {
+	fs.Var(&o.env, "env", "Set an environment variable of the command, e.g. -env KEY=VALUE. Can be repeated")
+	fs.StringVar(&o.cwd, "cwd", "", "Working directory of the command")
+	fs.StringVar(&o.user, "user", "", "Run the command as this guest user instead of root")
+	fs.DurationVar(&o.timeout, "timeout", 0, "Kill the command when it runs longer, e.g. 30s")
+	fs.BoolVar(&o.stdin, "stdin", false, "Pass the standard input to the command")
+}
+
+type envFlag map[string]string
+
+func (e *envFlag) String() string {
+	return ""
+}
+
+func (e *envFlag) Set(s string) error {
+	key, val, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid env %q, expected KEY=VALUE", s)
+	}
+
+	if *e == nil {
+		*e = make(envFlag)
+	}
+	(*e)[key] = val
+
+	return nil
+}
+
+// execCommand runs the command in the guest, its stdout and stderr are written to stdout and stderr.
+// The exit code is the exit code of the command, 124 when it timed out, or 1 when it did not report one.
+func execCommand(ctx context.Context, c *cmdClient, o *execOptions, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing command, e.g. ovm exec -name NAME -socket-path DIR -- uname -a")
+	}
+
+	body := &restful.ExecBody{
+		Command:        quoteArgs(args),
+		Env:            o.env,
+		Cwd:            o.cwd,
+		User:           o.user,
+		TimeoutSeconds: int(math.Ceil(o.timeout.Seconds())),
+	}
+
+	if o.stdin {
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("read stdin error: %w", err)
+		}
+		body.Stdin = stdin
+	}
+
+	events, err := c.Exec(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	for e := range events {
+		if e.Err != nil {
+			return e.Err
+		}
+
+		if c.json {
+			data := any(e.Output)
+			if e.Exit != nil {
+				data = e.Exit
+			}
+			_ = json.NewEncoder(os.Stdout).Encode(map[string]any{"event": e.Name, "data": data})
+		}
+
+		if e.Exit != nil {
+			if !c.json && e.Exit.Code < 0 && e.Exit.Error != "" {
+				fmt.Fprintln(os.Stderr, e.Exit.Error)
+			}
+
+			return exitCode(e.Exit)
+		}
+
+		if c.json {
+			continue
+		}
+
+		out, err := e.Output.Bytes()
+		if err != nil {
+			return err
+		}
+
+		if e.Name == restful.ExecEventStderr {
+			_, _ = os.Stderr.Write(out)
+		} else {
+			_, _ = os.Stdout.Write(out)
+		}
+	}
+
+	return errors.New("stream closed before the command finished")
+}
+
+// quoteArgs joins args into a shell command that runs them as they are, e.g. sh -c 'echo a b'.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func exitCode(exit *restful.ExecExit) error {
+	switch {
+	case exit.TimedOut:
+		return &exitError{code: 124}
+	case exit.Code < 0:
+		return &exitError{code: 1}
+	case exit.Code > 0:
+		return &exitError{code: exit.Code}
+	default:
+		return nil
+	}
+}
+
+func eventsSubcommand(fs *flag.FlagSet) subcommand {
+	after := fs.Uint64("after", 0, "Start after the event with this ID instead of with all kept events")
+	stats := fs.Bool("stats", false, "Print the delivery statistics of the event destinations instead")
+
+	return func(ctx context.Context, c *cmdClient, _ []string) error {
+		if *stats {
+			return eventStats(ctx, c)
+		}
+
+		return events(ctx, c, *after)
+	}
+}
+
+// events prints the events of ovm until it exits. A stream that ends early is resumed after the last printed event.
+func events(ctx context.Context, c *cmdClient, after uint64) error {
+	for {
+		ch, err := c.Events(ctx, after)
+		if err != nil {
+			return err
+		}
+
+		for m := range ch {
+			if m.Err != nil {
+				err = m.Err
+				break
+			}
+
+			e := m.Event
+			after = e.Seq
+			c.print(e, func() {
+				fmt.Printf("%d\t%s\t%s\t%s\n", e.Seq, e.Timestamp.Local().Format(time.RFC3339), e.Type, e.Message)
+			})
+
+			if e.Type == event.TypeExit {
+				return nil
+			}
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		fmt.Fprintf(os.Stderr, "%v, resuming after event %d\n", err, after)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func eventStats(ctx context.Context, c *cmdClient) error {
+	stats, err := c.EventStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.print(stats, func() {
+		if len(stats.Sinks) == 0 {
+			fmt.Println("no event destinations")
+		}
+
+		for _, s := range stats.Sinks {
+			fmt.Printf("%s\tqueued %d, delivered %d, retries %d, failed %d, dropped %d\n", s.Sink, s.Queued, s.Delivered, s.Retries, s.Failed, s.Dropped)
+			if s.LastErrorAt != nil {
+				fmt.Printf("\tlast error at %s: %s\n", s.LastErrorAt.Local().Format(time.RFC3339), s.LastError)
+			}
+		}
+	})
+
+	return nil
+}
+
+// guestPrefix marks the guest side of cp.
+const guestPrefix = "guest:"
+
+func cpSubcommand(fs *flag.FlagSet) subcommand {
+	parents := fs.Bool("parents", false, "Create the missing parent directories in the guest")
+
+	return func(ctx context.Context, c *cmdClient, args []string) error {
+		return cp(ctx, c, *parents, args)
+	}
+}
+
+// cp copies a file between the host and the guest, keeping its mode. A directory is copied as a tar archive
+// through stdin or stdout, given as -, e.g. ovm cp guest:/var/lib/containers - | tar -x.
+func cp(ctx context.Context, c *cmdClient, parents bool, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected SRC and DST, one of them prefixed with " + guestPrefix + ", e.g. ovm cp -name NAME -socket-path DIR ./file guest:/root/file")
+	}
+
+	src, dst := args[0], args[1]
+	guestSrc, srcIsGuest := strings.CutPrefix(src, guestPrefix)
+	guestDst, dstIsGuest := strings.CutPrefix(dst, guestPrefix)
+	if srcIsGuest == dstIsGuest {
+		return errors.New("exactly one of SRC and DST must be prefixed with " + guestPrefix)
+	}
+
+	if srcIsGuest {
+		return cpFromGuest(ctx, c, guestSrc, dst)
+	}
+
+	return cpToGuest(ctx, c, src, guestDst, parents)
+}
+
+func cpFromGuest(ctx context.Context, c *cmdClient, src, dst string) error {
+	f, err := c.Download(ctx, src, dst == "-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if dst == "-" {
+		_, err := io.Copy(os.Stdout, f)
+		return err
+	}
+
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, f); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// OpenFile applied the umask, and only to a new file
+	if err := os.Chmod(dst, f.Mode); err != nil {
+		return err
+	}
+
+	if !f.ModTime.IsZero() {
+		return os.Chtimes(dst, f.ModTime, f.ModTime)
+	}
+
+	return nil
+}
+
+func cpToGuest(ctx context.Context, c *cmdClient, src, dst string, parents bool) error {
+	opts := &client.UploadOptions{
+		Parents: parents,
+		Archive: src == "-",
+	}
+
+	var r io.Reader = os.Stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory, copy it as a tar archive, e.g. tar -C %s -c . | ovm cp ... - %s%s", src, src, guestPrefix, dst)
+		}
+
+		if strings.HasSuffix(dst, "/") {
+			dst += filepath.Base(src)
+		}
+
+		r, opts.Mode = f, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	}
+
+	resp, err := c.Upload(ctx, dst, r, opts)
+	if err != nil {
+		return err
+	}
+
+	c.print(resp, func() {
+		if resp.Entries > 0 {
+			fmt.Printf("%s: %d entries, %d bytes\n", resp.Path, resp.Entries, resp.Size)
+		} else {
+			fmt.Printf("%s: %d bytes, mode %s\n", resp.Path, resp.Size, resp.Mode)
+		}
+	})
+
+	return nil
+}
@@ -5,48 +5,58 @@ package channel
 
 import "github.com/Code-Hex/go-infinity-channel"
 
-type _context struct {
+// Context carries the notifications between the components of one ovm instance.
+type Context struct {
 	gvproxyReady chan bool
 	vmReady      chan bool
+	dataMigrate  chan bool
 	syncTime     *infinity.Channel[bool]
 }
 
-var c *_context
-
-func init() {
-	c = &_context{
+func New() *Context {
+	return &Context{
 		gvproxyReady: make(chan bool, 1),
 		vmReady:      make(chan bool, 1),
+		dataMigrate:  make(chan bool, 1),
 		syncTime:     infinity.NewChannel[bool](),
 	}
 }
 
-func Close() {
+func (c *Context) Close() {
 	close(c.gvproxyReady)
 	close(c.vmReady)
+	close(c.dataMigrate)
 	c.syncTime.Close()
 }
 
-func NotifyGVProxyReady() {
+func (c *Context) NotifyGVProxyReady() {
 	c.gvproxyReady <- true
 }
 
-func ReceiveGVProxyReady() <-chan bool {
+func (c *Context) ReceiveGVProxyReady() <-chan bool {
 	return c.gvproxyReady
 }
 
-func NotifyVMReady() {
+func (c *Context) NotifyVMReady() {
 	c.vmReady <- true
 }
 
-func ReceiveVMReady() <-chan bool {
+func (c *Context) ReceiveVMReady() <-chan bool {
 	return c.vmReady
 }
 
-func NotifySyncTime() {
+func (c *Context) NotifyDataMigrate() {
+	c.dataMigrate <- true
+}
+
+func (c *Context) ReceiveDataMigrate() <-chan bool {
+	return c.dataMigrate
+}
+
+func (c *Context) NotifySyncTime() {
 	c.syncTime.In() <- true
 }
 
-func ReceiveSyncTime() <-chan bool {
+func (c *Context) ReceiveSyncTime() <-chan bool {
 	return c.syncTime.Out()
 }
@@ -0,0 +1,149 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checksumKeys are the artifacts copied from a source, they may have a checksum.
+var checksumKeys = []string{"kernel", "initrd", "rootfs"}
+
+// fileChecksum is a verified target file in versions.json. As long as its size and mtime
+// do not change, the file is not hashed again.
+type fileChecksum struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func (f *fileChecksum) matches(sum string, info os.FileInfo) bool {
+	return f != nil && f.SHA256 == sum && f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+func validChecksum(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// hashBufferSize is the size of the reads of sha256File, ctx is checked between them.
+const hashBufferSize = 1024 * 1024
+
+// sha256File hashes p. When ctx is done, it stops with the cause of ctx.
+func sha256File(ctx context.Context, p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := make([]byte, hashBufferSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", context.Cause(ctx)
+		}
+
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newFileChecksum hashes p and returns its checksum. When sum is not empty and differs,
+// the error is errChecksumMismatch.
+func newFileChecksum(ctx context.Context, p, sum string) (*fileChecksum, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	got, err := sha256File(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("hash %s error: %w", p, err)
+	}
+	if sum != "" && got != sum {
+		return nil, fmt.Errorf("%w, sha256 of %s is %s, expected %s", errChecksumMismatch, p, got, sum)
+	}
+
+	return &fileChecksum{SHA256: got, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// readChecksumFile reads a file in the format of sha256sum, "HEX  NAME" per line,
+// and returns the checksums by the base name of NAME.
+func readChecksumFile(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("open checksum file error: %w", err)
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sum, name, ok := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		if !ok || name == "" || !validChecksum(sum) {
+			return nil, fmt.Errorf("invalid line %d in checksum file %s", n, p)
+		}
+
+		sums[filepath.Base(name)] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read checksum file error: %w", err)
+	}
+
+	return sums, nil
+}
+
+// checksums returns the expected checksums of the artifacts by key, from -checksum-file
+// (matched by the base name of the source file) and -checksums, which takes precedence.
+func (c *Context) checksums() (map[string]string, error) {
+	sums := make(map[string]string)
+
+	if c.opts.ChecksumFile != "" {
+		listed, err := readChecksumFile(c.opts.ChecksumFile)
+		if err != nil {
+			return nil, err
+		}
+
+		sources := map[string]string{"kernel": c.opts.KernelPath, "initrd": c.opts.InitrdPath, "rootfs": c.opts.RootfsPath}
+		for _, key := range checksumKeys {
+			if sum, ok := listed[filepath.Base(sources[key])]; ok {
+				sums[key] = sum
+			}
+		}
+	}
+
+	for key, sum := range c.opts.Checksums {
+		sums[key] = strings.ToLower(sum)
+	}
+
+	return sums, nil
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/errcode"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// rootfsArtifact returns the rootfs of the plan of target.
+func rootfsArtifact(t *testing.T, target *targetContext) Artifact {
+	t.Helper()
+
+	for _, a := range target.plan(context.Background()) {
+		if a.Name == "rootfs" {
+			return a
+		}
+	}
+
+	t.Fatal("no rootfs in the plan")
+	return Artifact{}
+}
+
+func TestChecksumRepair(t *testing.T) {
+	tt := newTestTarget(t)
+	checksums := map[string]string{"rootfs": sha256Hex("rootfs")}
+	policy := newDataPolicy("", 3, false)
+	rootfs := filepath.Join(tt.target, "rootfs")
+
+	if _, err := tt.new("1", checksums, policy).handle(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := newVersionsJSON(tt.versionsPath).checksum("rootfs"); c == nil || c.SHA256 != checksums["rootfs"] {
+		t.Fatalf("checksum = %+v, want the verified copy", c)
+	}
+
+	// a matching target is kept
+	if a := rootfsArtifact(t, tt.new("1", checksums, policy)); a.Action != ActionKeep || a.Repair {
+		t.Errorf("rootfs = %+v, want it kept", a)
+	}
+
+	// a target that was touched is hashed again, and kept while it matches
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(rootfs, later, later); err != nil {
+		t.Fatal(err)
+	}
+	target := tt.new("1", checksums, policy)
+	if a := rootfsArtifact(t, target); a.Action != ActionKeep || a.Repair {
+		t.Errorf("touched rootfs = %+v, want it kept", a)
+	}
+	if c := target.versionsJSON.checksum("rootfs"); c == nil || !c.ModTime.Equal(later) {
+		t.Errorf("checksum = %+v, want the new mtime", c)
+	}
+
+	// a corrupted target is detected and copied again
+	if err := os.WriteFile(rootfs, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target = tt.new("1", checksums, policy)
+	if a := rootfsArtifact(t, target); a.Action != ActionCopy || !a.Repair {
+		t.Errorf("corrupted rootfs = %+v, want it repaired", a)
+	}
+
+	artifacts, err := tt.new("1", checksums, policy).handle(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	for _, a := range artifacts {
+		if want := a.Name == "rootfs"; (a.Action == ActionCopy) != want {
+			t.Errorf("%s = %+v, want only the rootfs copied", a.Name, a)
+		}
+	}
+	if b, err := os.ReadFile(rootfs); err != nil || string(b) != "rootfs" {
+		t.Errorf("rootfs = %q, %v, want it repaired", b, err)
+	}
+	if a := rootfsArtifact(t, tt.new("1", checksums, policy)); a.Action != ActionKeep {
+		t.Errorf("repaired rootfs = %+v, want it kept", a)
+	}
+}
+
+func TestChecksumMismatchingSource(t *testing.T) {
+	tt := newTestTarget(t)
+	checksums := map[string]string{"rootfs": sha256Hex("other")}
+
+	_, err := tt.new("1", checksums, newDataPolicy("", 3, false)).handle(context.Background(), nil)
+	if !errors.Is(err, errChecksumMismatch) || errcode.Of(err) != errcode.ChecksumMismatch {
+		t.Errorf("handle = %v, want a checksum mismatch", err)
+	}
+
+	// nothing is recorded, the next start copies again
+	if _, err := os.Stat(tt.versionsPath); !os.IsNotExist(err) {
+		t.Errorf("versions.json: %v, want it not written", err)
+	}
+}
+
+func TestReadChecksumFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "SHA256SUMS")
+	content := "# checksums\n" + sha256Hex("rootfs") + "  images/rootfs.erofs\n\n" + sha256Hex("kernel") + " *bzImage\n"
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sums, err := readChecksumFile(p)
+	if err != nil {
+		t.Fatalf("readChecksumFile: %v", err)
+	}
+	if len(sums) != 2 || sums["rootfs.erofs"] != sha256Hex("rootfs") || sums["bzImage"] != sha256Hex("kernel") {
+		t.Errorf("sums = %v, want rootfs.erofs and bzImage", sums)
+	}
+
+	if err := os.WriteFile(p, []byte("not-a-sum  rootfs\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readChecksumFile(p); err == nil {
+		t.Error("readChecksumFile accepted an invalid line")
+	}
+}
@@ -4,86 +4,278 @@
 package cli
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
 )
 
-var (
-	name            string
-	logPath         string
-	socketPath      string
-	sshKeyPath      string
-	cpus            uint
-	memory          uint64
-	kernelPath      string
-	initrdPath      string
-	rootfsPath      string
-	targetPath      string
-	versions        string
-	eventSocketPath string
-	cliMode         bool
-	bindPID         int
-	powerSaveMode   bool
-	kernelDebug     bool
-	extendShareDir  string
-)
+// Options holds every user supplied setting of the virtual machine.
+// It is filled from a config file (see LoadFile), from command line flags, or both.
+type Options struct {
+	Name            string            `json:"name" yaml:"name"`
+	LogPath         string            `json:"logPath" yaml:"logPath"`
+	SocketPath      string            `json:"socketPath" yaml:"socketPath"`
+	SSHKeyPath      string            `json:"sshKeyPath" yaml:"sshKeyPath"`
+	KnownHostsPath  string            `json:"knownHostsPath" yaml:"knownHostsPath"`
+	CPUS            uint              `json:"cpus" yaml:"cpus"`
+	Memory          uint64            `json:"memory" yaml:"memory"`
+	KernelPath      string            `json:"kernelPath" yaml:"kernelPath"`
+	InitrdPath      string            `json:"initrdPath" yaml:"initrdPath"`
+	RootfsPath      string            `json:"rootfsPath" yaml:"rootfsPath"`
+	TargetPath      string            `json:"targetPath" yaml:"targetPath"`
+	Versions        map[string]string `json:"versions" yaml:"versions"`
+	Checksums       map[string]string `json:"checksums" yaml:"checksums"`
+	ChecksumFile    string            `json:"checksumFile" yaml:"checksumFile"`
+	DataPolicy      string            `json:"dataPolicy" yaml:"dataPolicy"`
+	DataBackups     int               `json:"dataBackups" yaml:"dataBackups"`
+	DataMigrate     string            `json:"dataMigrate" yaml:"dataMigrate"`
+	EventSocketPath string            `json:"eventSocketPath" yaml:"eventSocketPath"`
+	EventFormat     string            `json:"eventFormat" yaml:"eventFormat"`
+	EventSinks      []string          `json:"eventSinks" yaml:"eventSinks"`
+	CliMode         bool              `json:"cli" yaml:"cli"`
+	BindPID         int               `json:"bindPID" yaml:"bindPID"`
+	PowerSaveMode   bool              `json:"powerSaveMode" yaml:"powerSaveMode"`
+	KernelDebug     bool              `json:"kernelDebug" yaml:"kernelDebug"`
+	ExtendShareDir  map[string]string `json:"extendShareDir" yaml:"extendShareDir"`
+	DryRun          bool              `json:"dryRun" yaml:"dryRun"`
+}
+
+// flagSet binds the flags to o. The current values of o are used as the flag defaults,
+// so parsing only overrides the fields whose flags are actually set.
+func (o *Options) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("ovm", flag.ContinueOnError)
+
+	fs.String("config", "", "Path to a YAML or JSON config file. Flags override values from the file")
+	fs.StringVar(&o.Name, "name", o.Name, "Name of the virtual machine")
+	fs.StringVar(&o.LogPath, "log-path", o.LogPath, "Directory to store logs")
+	fs.StringVar(&o.SocketPath, "socket-path", o.SocketPath, "Store all socket files")
+	fs.StringVar(&o.SSHKeyPath, "ssh-key-path", o.SSHKeyPath, "Store SSH public and private keys")
+	fs.StringVar(&o.KnownHostsPath, "known-hosts-path", o.KnownHostsPath, "Also pin the host key of the guest in this known_hosts file, e.g. ~/.ssh/known_hosts")
+	fs.UintVar(&o.CPUS, "cpus", o.CPUS, "Number of CPUs")
+	fs.Uint64Var(&o.Memory, "memory", o.Memory, "Amount of memory in megabytes")
+	fs.StringVar(&o.KernelPath, "kernel-path", o.KernelPath, "Path to kernel image")
+	fs.StringVar(&o.InitrdPath, "initrd-path", o.InitrdPath, "Path to initrd image")
+	fs.StringVar(&o.RootfsPath, "rootfs-path", o.RootfsPath, "Path to rootfs image")
+	fs.StringVar(&o.TargetPath, "target-path", o.TargetPath, "Store disk images and kernel/initrd/rootfs files")
+	fs.Var(&mapValue{m: &o.Versions, sep: "="}, "versions", "Set version. e.g. --versions=kernel=v1,initrd=v1,rootfs=v1,data=v1")
+	fs.Var(&mapValue{m: &o.Checksums, sep: "="}, "checksums", "Expected SHA-256 of kernel/initrd/rootfs, verified in the target path. e.g. --checksums=rootfs=HEX")
+	fs.StringVar(&o.ChecksumFile, "checksum-file", o.ChecksumFile, "File with the expected SHA-256 of kernel/initrd/rootfs, in the format of sha256sum")
+	fs.StringVar(&o.DataPolicy, "data-policy", o.DataPolicy, "What to do with data.img when the data version changes: recreate (default), backup or keep")
+	fs.IntVar(&o.DataBackups, "data-backups", o.DataBackups, "Number of data.img backups kept by the backup data policy, at least 1")
+	fs.StringVar(&o.DataMigrate, "data-migrate", o.DataMigrate, "Command run in the guest once it is ready after the backup data policy replaced data.img, the old disk is /dev/vdd")
+	fs.StringVar(&o.EventSocketPath, "event-socket-path", o.EventSocketPath, "Send event to this socket")
+	fs.StringVar(&o.EventFormat, "event-format", o.EventFormat, "Format of the events sent to the event socket and URLs: query (default) or json")
+	fs.Var(&sliceValue{s: &o.EventSinks}, "event-sink", "Also send events to this sink, repeatable. e.g. --event-sink=unix:/tmp/event.sock --event-sink=https://example.com/events --event-sink=file --event-sink=stdout")
+	fs.BoolVar(&o.CliMode, "cli", o.CliMode, "Run in CLI mode")
+	fs.IntVar(&o.BindPID, "bind-pid", o.BindPID, "OVM will exit when the bound pid exited")
+	fs.BoolVar(&o.PowerSaveMode, "power-save-mode", o.PowerSaveMode, "Enable power save mode")
+	fs.BoolVar(&o.KernelDebug, "kernel-debug", o.KernelDebug, "Enable kernel debug")
+	fs.Var(&mapValue{m: &o.ExtendShareDir, sep: ":"}, "extend-share-dir", "Extends share directory with the guest. e.g. --extend-share-dir=host-tmp:/tmp,host-var:/var")
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "Print the resolved VM plan as JSON and exit, without starting the VM")
+
+	return fs
+}
+
+// Parse parses the command line arguments (without the program name).
+// When -config is given, the file is loaded first and the flags set on the command line take precedence over it.
+func Parse(args []string) (*Options, error) {
+	o := &Options{DataBackups: defaultDataBackups}
+	fs := o.flagSet()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
 
-func Parse() {
-	flag.StringVar(&name, "name", "", "Name of the virtual machine")
-	flag.StringVar(&logPath, "log-path", "", "Directory to store logs")
-	flag.StringVar(&socketPath, "socket-path", "", "Store all socket files")
-	flag.StringVar(&sshKeyPath, "ssh-key-path", "", "Store SSH public and private keys")
-	flag.UintVar(&cpus, "cpus", 0, "Number of CPUs")
-	flag.Uint64Var(&memory, "memory", 0, "Amount of memory in megabytes")
-	flag.StringVar(&kernelPath, "kernel-path", "", "Path to kernel image")
-	flag.StringVar(&initrdPath, "initrd-path", "", "Path to initrd image")
-	flag.StringVar(&rootfsPath, "rootfs-path", "", "Path to rootfs image")
-	flag.StringVar(&targetPath, "target-path", "", "Store disk images and kernel/initrd/rootfs files")
-	flag.StringVar(&versions, "versions", "", "Set version")
-	flag.StringVar(&eventSocketPath, "event-socket-path", "", "Send event to this socket")
-	flag.BoolVar(&cliMode, "cli", false, "Run in CLI mode")
-	flag.IntVar(&bindPID, "bind-pid", 0, "OVM will exit when the bound pid exited")
-	flag.BoolVar(&powerSaveMode, "power-save-mode", false, "Enable power save mode")
-	flag.BoolVar(&kernelDebug, "kernel-debug", false, "Enable kernel debug")
-	flag.StringVar(&extendShareDir, "extend-share-dir", "", "Extends share directory with the guest. e.g. --extend-share-dir=host-tmp:/tmp,host-var:/var")
-
-	flag.Parse()
+	configPath := fs.Lookup("config").Value.String()
+	if configPath == "" {
+		return o, nil
+	}
+
+	o, err := LoadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.flagSet().Parse(args); err != nil {
+		return nil, err
+	}
 
+	return o, nil
 }
 
-func Validate() error {
-	if name == "" {
-		return fmt.Errorf("name is required")
+// Validate checks the options and reports all problems at once.
+func (o *Options) Validate() error {
+	var errs []error
+
+	if o.Name == "" {
+		errs = append(errs, fmt.Errorf("name is required"))
 	}
-	if logPath == "" {
-		return fmt.Errorf("log-path is required")
+	if o.LogPath == "" {
+		errs = append(errs, fmt.Errorf("log-path is required"))
 	}
-	if socketPath == "" {
-		return fmt.Errorf("socket-path is required")
+	if o.SocketPath == "" {
+		errs = append(errs, fmt.Errorf("socket-path is required"))
 	}
-	if sshKeyPath == "" {
-		return fmt.Errorf("ssh-key-path is required")
+	if o.SSHKeyPath == "" {
+		errs = append(errs, fmt.Errorf("ssh-key-path is required"))
 	}
-	if cpus == 0 {
-		return fmt.Errorf("vcpu is required")
+	if o.CPUS == 0 {
+		errs = append(errs, fmt.Errorf("vcpu is required"))
 	}
-	if memory == 0 {
-		return fmt.Errorf("memory is required")
+	if o.Memory == 0 {
+		errs = append(errs, fmt.Errorf("memory is required"))
 	}
-	if kernelPath == "" {
-		return fmt.Errorf("kernel-path is required")
+	if o.KernelPath == "" {
+		errs = append(errs, fmt.Errorf("kernel-path is required"))
 	}
-	if initrdPath == "" {
-		return fmt.Errorf("initrd-path is required")
+	if o.InitrdPath == "" {
+		errs = append(errs, fmt.Errorf("initrd-path is required"))
 	}
-	if rootfsPath == "" {
-		return fmt.Errorf("rootfs-path is required")
+	if o.RootfsPath == "" {
+		errs = append(errs, fmt.Errorf("rootfs-path is required"))
 	}
-	if targetPath == "" {
-		return fmt.Errorf("disk-path is required")
+	if o.TargetPath == "" {
+		errs = append(errs, fmt.Errorf("disk-path is required"))
 	}
-	if versions == "" {
-		return fmt.Errorf("versions is required")
+	if len(o.Versions) == 0 {
+		errs = append(errs, fmt.Errorf("versions is required"))
+	} else {
+		for _, key := range versionKeys {
+			if o.Versions[key] == "" {
+				errs = append(errs, fmt.Errorf("need %s in versions", key))
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(o.Checksums) {
+		switch {
+		case !slices.Contains(checksumKeys, key):
+			errs = append(errs, fmt.Errorf("invalid checksum key %q, expected kernel, initrd or rootfs", key))
+		case !validChecksum(o.Checksums[key]):
+			errs = append(errs, fmt.Errorf("invalid checksum of %s, expected 64 hex digits", key))
+		}
 	}
+
+	switch o.DataPolicy {
+	case "", DataPolicyRecreate, DataPolicyBackup, DataPolicyKeep:
+	default:
+		errs = append(errs, fmt.Errorf("invalid data policy %q, expected recreate, backup or keep", o.DataPolicy))
+	}
+	if o.DataBackups < 0 {
+		errs = append(errs, fmt.Errorf("data-backups must not be negative"))
+	}
+	if o.DataMigrate != "" && o.DataPolicy != DataPolicyBackup {
+		errs = append(errs, fmt.Errorf("data-migrate needs the backup data policy"))
+	}
+	if o.DataPolicy == DataPolicyBackup && o.DataBackups == 0 {
+		errs = append(errs, fmt.Errorf("the backup data policy needs data-backups of at least 1"))
+	}
+
+	switch o.EventFormat {
+	case "", "query", "json":
+	default:
+		errs = append(errs, fmt.Errorf("invalid event format %q, expected query or json", o.EventFormat))
+	}
+
+	for _, s := range o.EventSinks {
+		if _, err := ParseEventSink(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, tag := range sortedKeys(o.ExtendShareDir) {
+		dir := o.ExtendShareDir[tag]
+		if tag == "" || dir == "" {
+			errs = append(errs, fmt.Errorf("invalid extend share dir: %s:%s", tag, dir))
+			continue
+		}
+
+		if info, err := os.Stat(dir); err != nil {
+			errs = append(errs, fmt.Errorf("extend share dir %s not exists: %w", dir, err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("extend share dir %s is not a directory", dir))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// mapValue is a flag.Value for comma separated key/value pairs, e.g. "a=1,b=2".
+// Setting the flag replaces the whole map.
+type mapValue struct {
+	m   *map[string]string
+	sep string
+}
+
+func (v *mapValue) String() string {
+	if v.m == nil {
+		return ""
+	}
+
+	var items []string
+	for _, key := range sortedKeys(*v.m) {
+		items = append(items, key+v.sep+(*v.m)[key])
+	}
+
+	return strings.Join(items, ",")
+}
+
+func (v *mapValue) Set(s string) error {
+	m := make(map[string]string)
+
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		key, val, ok := strings.Cut(item, v.sep)
+		if !ok {
+			return fmt.Errorf("invalid item %q, expected key%svalue", item, v.sep)
+		}
+
+		m[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+
+	*v.m = m
+
+	return nil
+}
+
+// sliceValue is a flag.Value for a repeatable flag. The first time the flag is set it replaces
+// the values from the config file, every further time it appends.
+type sliceValue struct {
+	s   *[]string
+	set bool
+}
+
+func (v *sliceValue) String() string {
+	if v.s == nil {
+		return ""
+	}
+
+	return strings.Join(*v.s, ",")
+}
+
+func (v *sliceValue) Set(s string) error {
+	if !v.set {
+		*v.s = nil
+		v.set = true
+	}
+
+	*v.s = append(*v.s, s)
+
 	return nil
 }
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
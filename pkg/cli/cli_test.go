@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfigYAML = `name: from-file
+logPath: logs
+socketPath: /tmp/sockets
+cpus: 2
+memory: 2048
+kernelPath: images/kernel
+versions:
+  kernel: v1
+  data: v1
+eventSinks:
+  - unix:event.sock
+  - stdout
+extendShareDir:
+  home: share
+powerSaveMode: true
+`
+
+const testConfigJSON = `{
+  "name": "from-file",
+  "logPath": "logs",
+  "socketPath": "/tmp/sockets",
+  "cpus": 2,
+  "memory": 2048,
+  "kernelPath": "images/kernel",
+  "versions": {"kernel": "v1", "data": "v1"},
+  "eventSinks": ["unix:event.sock", "stdout"],
+  "extendShareDir": {"home": "share"},
+  "powerSaveMode": true
+}`
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestLoadFile(t *testing.T) {
+	for _, name := range []string{"ovm.yaml", "ovm.json"} {
+		t.Run(name, func(t *testing.T) {
+			content := testConfigYAML
+			if strings.HasSuffix(name, ".json") {
+				content = testConfigJSON
+			}
+			p := writeConfig(t, name, content)
+			dir := filepath.Dir(p)
+
+			o, err := LoadFile(p)
+			if err != nil {
+				t.Fatalf("LoadFile: %v", err)
+			}
+
+			want := &Options{
+				Name:           "from-file",
+				LogPath:        filepath.Join(dir, "logs"),
+				SocketPath:     "/tmp/sockets",
+				CPUS:           2,
+				Memory:         2048,
+				KernelPath:     filepath.Join(dir, "images", "kernel"),
+				Versions:       map[string]string{"kernel": "v1", "data": "v1"},
+				EventSinks:     []string{"unix:" + filepath.Join(dir, "event.sock"), "stdout"},
+				ExtendShareDir: map[string]string{"home": filepath.Join(dir, "share")},
+				PowerSaveMode:  true,
+				DataBackups:    defaultDataBackups,
+			}
+			if !reflect.DeepEqual(o, want) {
+				t.Errorf("LoadFile =\n%+v\nwant\n%+v", o, want)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "ovm.yaml", content: "name: a\nunknown: 1\n", wantErr: "field unknown not found"},
+		{name: "ovm.json", content: `{"name": "a", "unknown": 1}`, wantErr: `unknown field "unknown"`},
+		{name: "ovm.json", content: `{"cpus": "two"}`, wantErr: "parse config file"},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadFile(writeConfig(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s %q: LoadFile = %v, want %q", tt.name, tt.content, err, tt.wantErr)
+		}
+	}
+
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil || !strings.Contains(err.Error(), "read config file") {
+		t.Errorf("LoadFile of a missing file = %v, want a read error", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	p := writeConfig(t, "ovm.yaml", testConfigYAML)
+	dir := filepath.Dir(p)
+
+	tests := []struct {
+		name  string
+		args  []string
+		check func(t *testing.T, o *Options)
+	}{
+		{
+			name: "defaults",
+			args: []string{"-name", "flags"},
+			check: func(t *testing.T, o *Options) {
+				want := &Options{Name: "flags", DataBackups: defaultDataBackups}
+				if !reflect.DeepEqual(o, want) {
+					t.Errorf("options = %+v, want %+v", o, want)
+				}
+			},
+		},
+		{
+			name: "config file",
+			args: []string{"-config", p},
+			check: func(t *testing.T, o *Options) {
+				if o.Name != "from-file" || o.CPUS != 2 || o.LogPath != filepath.Join(dir, "logs") || o.DataBackups != defaultDataBackups {
+					t.Errorf("options = %+v, want the values of the file", o)
+				}
+			},
+		},
+		{
+			name: "flags override the file",
+			args: []string{"-name", "flags", "-config", p, "-cpus", "4", "-log-path", "relative", "-versions", "rootfs=v2", "-power-save-mode=false", "-data-backups", "1"},
+			check: func(t *testing.T, o *Options) {
+				if o.Name != "flags" || o.CPUS != 4 || o.DataBackups != 1 || o.PowerSaveMode {
+					t.Errorf("options = %+v, want the flags", o)
+				}
+				// a relative path of a flag is relative to the working directory, not to the file
+				if o.LogPath != "relative" {
+					t.Errorf("log path = %s, want relative", o.LogPath)
+				}
+				if !reflect.DeepEqual(o.Versions, map[string]string{"rootfs": "v2"}) {
+					t.Errorf("versions = %v, want the map of the flag", o.Versions)
+				}
+				// the fields without a flag keep the values of the file
+				if o.Memory != 2048 || o.KernelPath != filepath.Join(dir, "images", "kernel") {
+					t.Errorf("options = %+v, want the other values of the file", o)
+				}
+			},
+		},
+		{
+			name: "repeated sink flags replace the sinks of the file",
+			args: []string{"-config", p, "-event-sink", "file", "-event-sink", "stdout"},
+			check: func(t *testing.T, o *Options) {
+				if !reflect.DeepEqual(o.EventSinks, []string{"file", "stdout"}) {
+					t.Errorf("event sinks = %v, want the flags", o.EventSinks)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := Parse(tt.args)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			tt.check(t, o)
+		})
+	}
+
+	for _, args := range [][]string{
+		{"-config", filepath.Join(dir, "missing.yaml")},
+		{"-unknown"},
+		{"-versions", "kernel"},
+	} {
+		if _, err := Parse(args); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadFile reads the options from a YAML or JSON file. Files ending with .json are parsed as JSON, everything else as YAML.
+// Unknown keys are rejected. Relative paths in the file are resolved against the directory of the file.
+func LoadFile(p string) (*Options, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("read config file error: %w", err)
+	}
+
+	o := &Options{DataBackups: defaultDataBackups}
+
+	if strings.EqualFold(filepath.Ext(p), ".json") {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		err = d.Decode(o)
+	} else {
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		err = d.Decode(o)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s error: %w", p, err)
+	}
+
+	base, err := filepath.Abs(filepath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range []*string{&o.LogPath, &o.SocketPath, &o.SSHKeyPath, &o.KnownHostsPath, &o.KernelPath, &o.InitrdPath, &o.RootfsPath, &o.TargetPath, &o.ChecksumFile, &o.EventSocketPath} {
+		*field = resolvePath(base, *field)
+	}
+	for i, s := range o.EventSinks {
+		if p, ok := strings.CutPrefix(s, EventSinkUnix+":"); ok {
+			o.EventSinks[i] = EventSinkUnix + ":" + resolvePath(base, p)
+		}
+	}
+	for tag, dir := range o.ExtendShareDir {
+		o.ExtendShareDir[tag] = resolvePath(base, dir)
+	}
+
+	return o, nil
+}
+
+func resolvePath(base, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(base, p)
+}
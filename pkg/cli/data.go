@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/utils"
+)
+
+// The data policies, what happens to data.img when the data version changes.
+const (
+	// DataPolicyRecreate replaces data.img with an empty disk.
+	DataPolicyRecreate = "recreate"
+	// DataPolicyBackup renames data.img to a timestamped backup before an empty disk is created, see backupPath.
+	DataPolicyBackup = "backup"
+	// DataPolicyKeep refuses to start, data.img is left untouched.
+	DataPolicyKeep = "keep"
+)
+
+// defaultDataBackups is the number of backups kept when -data-backups is not set. Parse and LoadFile
+// start with it, the zero Options have to set DataBackups for the backup data policy.
+const defaultDataBackups = 3
+
+// DataMigration is the migration to run in the guest after the backup data policy replaced data.img.
+type DataMigration struct {
+	// Command is run in the guest, with the old disk attached read-only as OldDataDevice.
+	Command     string
+	OldDataPath string
+	FromVersion string
+	ToVersion   string
+}
+
+// OldDataDevice is the device of the old data disk in the guest.
+const OldDataDevice = "/dev/vdd"
+
+// pendingMigration is a -data-migrate that has not succeeded yet. It is kept in versions.json, so that
+// it is retried on every start, with Backup attached again, until the command exits with 0.
+type pendingMigration struct {
+	Backup string `json:"backup"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// dataPolicy is the data policy of a targetContext. migrate is set when -data-migrate is given.
+type dataPolicy struct {
+	policy  string
+	backups int
+	migrate bool
+}
+
+func newDataPolicy(policy string, backups int, migrate bool) dataPolicy {
+	if policy == "" {
+		policy = DataPolicyRecreate
+	}
+
+	return dataPolicy{policy: policy, backups: backups, migrate: migrate}
+}
+
+// migration returns the migration pending after artifacts were handled, nil if there is none. from is the
+// data version before. A migration still pending keeps its backup, which has the data, and only gets the
+// new version to migrate to. A pending migration whose backup was removed is dropped.
+func (t *targetContext) migration(artifacts []Artifact, from string) *pendingMigration {
+	var m *pendingMigration
+	if old := t.versionsJSON.Migration; old != nil {
+		if exists, _ := utils.PathExists(old.Backup); exists {
+			m = &pendingMigration{Backup: old.Backup, From: old.From, To: old.To}
+		}
+	}
+
+	for _, a := range artifacts {
+		if a.Name != "data" || a.Backup == "" {
+			continue
+		}
+
+		if m == nil {
+			m = &pendingMigration{Backup: a.Backup, From: from}
+		}
+		m.To = t.versions["data"]
+	}
+
+	return m
+}
+
+// pendingBackup is the backup of the pending migration, which pruneBackups keeps.
+func (t *targetContext) pendingBackup() string {
+	if t.versionsJSON.Migration == nil {
+		return ""
+	}
+
+	return t.versionsJSON.Migration.Backup
+}
+
+// DataMigrated clears the pending migration in versions.json, once DataMigration succeeded.
+func (c *Context) DataMigrated() error {
+	v := newVersionsJSON(c.VersionsPath)
+	if v.Migration == nil {
+		return nil
+	}
+
+	v.setMigration(nil)
+
+	return v.saveToDisk()
+}
+
+// backupPath returns the path data.img is renamed to at t, e.g. data.img.20240501-100000.bak.
+func backupPath(dataPath string, t time.Time) string {
+	return fmt.Sprintf("%s.%s.bak", dataPath, t.Format("20060102-150405"))
+}
+
+// pruneBackups removes the oldest backups of dataPath, so that keep of them are left. pending, the backup
+// of a pending migration, is never removed and not counted.
+func pruneBackups(dataPath string, keep int, pending string) error {
+	matches, err := filepath.Glob(dataPath + ".*.bak")
+	if err != nil {
+		return err
+	}
+
+	backups := make([]string, 0, len(matches))
+	for _, p := range matches {
+		if p != pending {
+			backups = append(backups, p)
+		}
+	}
+
+	// the timestamps sort by name
+	sort.Strings(backups)
+
+	var errs []error
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		backups = backups[1:]
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,324 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTarget struct {
+	src, target, versionsPath string
+}
+
+// newTestTarget creates the sources of kernel, initrd and rootfs, and an empty target directory.
+func newTestTarget(t *testing.T) *testTarget {
+	t.Helper()
+
+	dir := t.TempDir()
+	tt := &testTarget{
+		src:          filepath.Join(dir, "src"),
+		target:       filepath.Join(dir, "target"),
+		versionsPath: filepath.Join(dir, "target", "versions.json"),
+	}
+
+	for _, p := range []string{tt.src, tt.target} {
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range checksumKeys {
+		tt.writeSource(t, key, key)
+	}
+
+	return tt
+}
+
+func (tt *testTarget) writeSource(t *testing.T, key, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(tt.src, key), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// new returns a targetContext of the data version, every other artifact is at version 1.
+func (tt *testTarget) new(data string, checksums map[string]string, policy dataPolicy) *targetContext {
+	versions := map[string]string{"kernel": "1", "initrd": "1", "rootfs": "1", "data": data}
+
+	return newTarget(tt.target,
+		filepath.Join(tt.src, "kernel"), filepath.Join(tt.src, "initrd"), filepath.Join(tt.src, "rootfs"),
+		filepath.Join(tt.target, "data.img"), tt.versionsPath, versions, checksums, policy)
+}
+
+func (tt *testTarget) dataPath() string {
+	return filepath.Join(tt.target, "data.img")
+}
+
+func (tt *testTarget) writeData(t *testing.T, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(tt.dataPath(), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tt *testTarget) backups(t *testing.T) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(tt.dataPath() + ".*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return matches
+}
+
+func TestPlanDataPolicy(t *testing.T) {
+	tests := []struct {
+		policy     dataPolicy
+		version    string
+		wantAction string
+		wantBackup bool
+	}{
+		{policy: newDataPolicy("", 3, false), version: "1", wantAction: ActionKeep},
+		{policy: newDataPolicy("", 3, false), version: "2", wantAction: ActionCreate},
+		{policy: newDataPolicy(DataPolicyRecreate, 3, false), version: "2", wantAction: ActionCreate},
+		{policy: newDataPolicy(DataPolicyBackup, 3, false), version: "1", wantAction: ActionKeep},
+		{policy: newDataPolicy(DataPolicyBackup, 3, false), version: "2", wantAction: ActionCreate, wantBackup: true},
+		{policy: newDataPolicy(DataPolicyKeep, 3, false), version: "1", wantAction: ActionKeep},
+		{policy: newDataPolicy(DataPolicyKeep, 3, false), version: "2", wantAction: ActionRefuse},
+	}
+
+	tt := newTestTarget(t)
+	if _, err := tt.new("1", nil, newDataPolicy("", 3, false)).handle(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		artifacts := tt.new(test.version, nil, test.policy).plan(context.Background())
+		data := artifacts[len(artifacts)-1]
+
+		if data.Name != "data" || data.Action != test.wantAction || (data.Backup != "") != test.wantBackup {
+			t.Errorf("%s, data version %s: data = %+v, want %s with backup %v", test.policy.policy, test.version, data, test.wantAction, test.wantBackup)
+		}
+		if test.wantBackup && !strings.HasPrefix(data.Backup, tt.dataPath()+".") {
+			t.Errorf("%s: backup = %s, want it next to %s", test.policy.policy, data.Backup, tt.dataPath())
+		}
+	}
+
+	// a missing data disk is created under every policy
+	if err := os.Remove(tt.dataPath()); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []string{DataPolicyRecreate, DataPolicyBackup, DataPolicyKeep} {
+		artifacts := tt.new("2", nil, newDataPolicy(policy, 3, false)).plan(context.Background())
+		if data := artifacts[len(artifacts)-1]; data.Action != ActionCreate || data.Backup != "" || data.Reason != "missing" {
+			t.Errorf("%s: missing data = %+v, want it created", policy, data)
+		}
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "data.img")
+
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var all []string
+	for i := 0; i < 5; i++ {
+		p := backupPath(dataPath, start.Add(time.Duration(i)*time.Hour))
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, p)
+	}
+
+	// the oldest backup is pending, it is neither removed nor counted
+	if err := pruneBackups(dataPath, 2, all[0]); err != nil {
+		t.Fatalf("pruneBackups: %v", err)
+	}
+
+	matches, _ := filepath.Glob(dataPath + ".*.bak")
+	if want := []string{all[0], all[3], all[4]}; strings.Join(matches, ",") != strings.Join(want, ",") {
+		t.Errorf("backups = %v, want %v", matches, want)
+	}
+
+	if err := pruneBackups(dataPath, 0, ""); err != nil {
+		t.Fatalf("pruneBackups: %v", err)
+	}
+	if matches, _ := filepath.Glob(dataPath + ".*.bak"); len(matches) != 0 {
+		t.Errorf("backups = %v, want none", matches)
+	}
+}
+
+func TestPendingMigrationRoundTrip(t *testing.T) {
+	tt := newTestTarget(t)
+	policy := newDataPolicy(DataPolicyBackup, 1, true)
+	ctx := context.Background()
+
+	if _, err := tt.new("1", nil, policy).handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m := newVersionsJSON(tt.versionsPath).Migration; m != nil {
+		t.Fatalf("migration = %+v after the first start, want none", m)
+	}
+	tt.writeData(t, "data of 1")
+
+	if _, err := tt.new("2", nil, policy).handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	m := newVersionsJSON(tt.versionsPath).Migration
+	if m == nil || m.From != "1" || m.To != "2" {
+		t.Fatalf("migration = %+v, want 1 to 2", m)
+	}
+	if b, err := os.ReadFile(m.Backup); err != nil || string(b) != "data of 1" {
+		t.Errorf("backup = %q, %v, want the old data", b, err)
+	}
+
+	// the migration failed and the data version changed again, the backup with the data is kept
+	if _, err := tt.new("3", nil, policy).handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	again := newVersionsJSON(tt.versionsPath).Migration
+	if again == nil || again.Backup != m.Backup || again.From != "1" || again.To != "3" {
+		t.Errorf("migration = %+v, want %s from 1 to 3", again, m.Backup)
+	}
+	if _, err := os.Stat(m.Backup); err != nil {
+		t.Errorf("pending backup: %v", err)
+	}
+
+	c := &Context{VersionsPath: tt.versionsPath}
+	if err := c.DataMigrated(); err != nil {
+		t.Fatalf("DataMigrated: %v", err)
+	}
+
+	v := newVersionsJSON(tt.versionsPath)
+	if v.Migration != nil || v.Data != "3" {
+		t.Errorf("versions = %+v, want data 3 without a migration", v)
+	}
+}
+
+func TestFailedCopyKeepsDataBackup(t *testing.T) {
+	tt := newTestTarget(t)
+	policy := newDataPolicy(DataPolicyBackup, 1, true)
+	ctx := context.Background()
+
+	if _, err := tt.new("1", nil, policy).handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	tt.writeData(t, "data of 1")
+
+	// the kernel changes with the data version, but can not be copied
+	if err := os.Remove(filepath.Join(tt.src, "kernel")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		target := tt.new("2", nil, policy)
+		target.versions["kernel"] = "2"
+		if _, err := target.handle(ctx, nil); err == nil {
+			t.Fatal("handle succeeded without the kernel")
+		}
+
+		if b, err := os.ReadFile(tt.dataPath()); err != nil || string(b) != "data of 1" {
+			t.Errorf("attempt %d: data = %q, %v, want it untouched", i, b, err)
+		}
+		if backups := tt.backups(t); len(backups) != 0 {
+			t.Errorf("attempt %d: backups = %v, want none", i, backups)
+		}
+		if v := newVersionsJSON(tt.versionsPath); v.Data != "1" || v.Migration != nil {
+			t.Errorf("attempt %d: versions = %+v, want data 1 without a migration", i, v)
+		}
+	}
+
+	tt.writeSource(t, "kernel", "kernel 2")
+	target := tt.new("2", nil, policy)
+	target.versions["kernel"] = "2"
+	if _, err := target.handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newVersionsJSON(tt.versionsPath).Migration
+	if m == nil {
+		t.Fatal("no pending migration")
+	}
+	if b, err := os.ReadFile(m.Backup); err != nil || string(b) != "data of 1" {
+		t.Errorf("backup = %q, %v, want the old data", b, err)
+	}
+	if info, err := os.Stat(tt.dataPath()); err != nil || info.Size() == int64(len("data of 1")) {
+		t.Errorf("data = %v, %v, want a new empty disk", info, err)
+	}
+}
+
+func TestPendingMigrationSavedBeforeCreate(t *testing.T) {
+	tt := newTestTarget(t)
+	policy := newDataPolicy(DataPolicyBackup, 1, true)
+	ctx := context.Background()
+
+	if _, err := tt.new("1", nil, policy).handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	tt.writeData(t, "data of 1")
+
+	target := tt.new("2", nil, policy)
+	artifacts := target.plan(ctx)
+	data := &artifacts[len(artifacts)-1]
+	if err := target.createData(data, artifacts, "1"); err != nil {
+		t.Fatalf("createData: %v", err)
+	}
+
+	m := newVersionsJSON(tt.versionsPath).Migration
+	if m == nil || m.Backup != data.Backup {
+		t.Fatalf("migration = %+v, want it saved with %s", m, data.Backup)
+	}
+
+	// ovm was killed before the empty disk was created, the next start creates it and keeps the backup
+	if err := os.Remove(tt.dataPath()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt.new("2", nil, policy).handle(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if again := newVersionsJSON(tt.versionsPath).Migration; again == nil || *again != *m {
+		t.Errorf("migration = %+v, want %+v", again, m)
+	}
+	if b, err := os.ReadFile(m.Backup); err != nil || string(b) != "data of 1" {
+		t.Errorf("backup = %q, %v, want the old data", b, err)
+	}
+}
+
+func TestValidateDataBackups(t *testing.T) {
+	tests := []struct {
+		policy  string
+		backups int
+		migrate string
+		wantErr string
+	}{
+		{policy: DataPolicyBackup, backups: 1},
+		{policy: DataPolicyBackup, backups: 0, wantErr: "the backup data policy needs data-backups of at least 1"},
+		{policy: DataPolicyRecreate, backups: 0},
+		{policy: DataPolicyBackup, backups: -1, wantErr: "data-backups must not be negative"},
+		{policy: DataPolicyBackup, backups: 1, migrate: "true"},
+		{policy: DataPolicyRecreate, backups: 1, migrate: "true", wantErr: "data-migrate needs the backup data policy"},
+	}
+
+	for _, tt := range tests {
+		o := &Options{DataPolicy: tt.policy, DataBackups: tt.backups, DataMigrate: tt.migrate}
+		err := o.Validate()
+		if tt.wantErr == "" {
+			if err != nil && strings.Contains(err.Error(), "data") {
+				t.Errorf("%+v: Validate = %v, want no data error", tt, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%+v: Validate = %v, want %q", tt, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// The kinds of EventSink.
+const (
+	EventSinkUnix   = "unix"
+	EventSinkHTTP   = "http"
+	EventSinkFile   = "file"
+	EventSinkStdout = "stdout"
+)
+
+// EventSink is a destination of the events, parsed from an -event-sink value:
+//
+//	unix:/tmp/ovm-event.sock   HTTP requests to a unix socket, like -event-socket-path
+//	https://example.com/events HTTP requests to the URL
+//	file                       append JSON lines to <log-path>/<name>-events.jsonl
+//	file:events.jsonl          append JSON lines to the file, relative to the log path
+//	stdout                     write JSON lines to stdout
+type EventSink struct {
+	Kind string
+	// Target is the socket path, the URL or the file path. Empty for stdout and the default file.
+	Target string
+}
+
+// ParseEventSink parses an -event-sink value.
+func ParseEventSink(s string) (EventSink, error) {
+	kind, target, _ := strings.Cut(s, ":")
+
+	switch kind {
+	case EventSinkStdout:
+		if s != EventSinkStdout {
+			return EventSink{}, fmt.Errorf("invalid event sink %q, stdout takes no target", s)
+		}
+		return EventSink{Kind: EventSinkStdout}, nil
+	case EventSinkFile:
+		return EventSink{Kind: EventSinkFile, Target: target}, nil
+	case EventSinkUnix:
+		if target == "" {
+			return EventSink{}, fmt.Errorf("invalid event sink %q, expected unix:PATH", s)
+		}
+		return EventSink{Kind: EventSinkUnix, Target: target}, nil
+	case "http", "https":
+		u, err := url.Parse(s)
+		if err != nil {
+			return EventSink{}, fmt.Errorf("invalid event sink %q: %w", s, err)
+		}
+		if u.Host == "" {
+			return EventSink{}, fmt.Errorf("invalid event sink %q, the URL has no host", s)
+		}
+		return EventSink{Kind: EventSinkHTTP, Target: s}, nil
+	}
+
+	return EventSink{}, fmt.Errorf("invalid event sink %q, expected unix:PATH, an http(s) URL, file[:PATH] or stdout", s)
+}
+
+func (s EventSink) String() string {
+	switch s.Kind {
+	case EventSinkStdout:
+		return EventSinkStdout
+	case EventSinkHTTP:
+		if u, err := url.Parse(s.Target); err == nil {
+			return u.Redacted()
+		}
+		return s.Target
+	}
+
+	return s.Kind + ":" + s.Target
+}
+
+// eventSinks resolves -event-socket-path and -event-sink. The log path must already be resolved.
+func (c *Context) eventSinks() error {
+	c.EventSinks = nil
+
+	if c.opts.EventSocketPath != "" {
+		c.EventSinks = append(c.EventSinks, EventSink{Kind: EventSinkUnix, Target: c.opts.EventSocketPath})
+	}
+
+	for _, s := range c.opts.EventSinks {
+		sink, err := ParseEventSink(s)
+		if err != nil {
+			return err
+		}
+
+		switch sink.Kind {
+		case EventSinkFile:
+			if sink.Target == "" {
+				sink.Target = c.Name + "-events.jsonl"
+			}
+			if !filepath.IsAbs(sink.Target) {
+				sink.Target = filepath.Join(c.LogPath, sink.Target)
+			}
+		case EventSinkUnix:
+			p, err := filepath.Abs(sink.Target)
+			if err != nil {
+				return err
+			}
+			sink.Target = p
+		}
+
+		c.EventSinks = append(c.EventSinks, sink)
+	}
+
+	return nil
+}
@@ -4,15 +4,16 @@
 package cli
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/oomol-lab/ovm/pkg/logger"
 	"github.com/oomol-lab/ovm/pkg/utils"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
@@ -28,6 +29,8 @@ type Context struct {
 	ExecutablePath  string
 	BindPID         int
 	EventSocketPath string
+	EventFormat     string
+	EventSinks      []EventSink
 	PowerSaveMode   bool
 	KernelDebug     bool
 	ExtendShareDir  map[string]string
@@ -41,6 +44,13 @@ type Context struct {
 	SSHPublicKey      string
 	SSHSigner         ssh.Signer
 
+	// SSHHostKeyPath is the private host key installed into the guest, SSHHostKey is its public key.
+	// Every SSH connection to the guest is verified against SSHHostKey.
+	SSHHostKeyPath string
+	SSHHostKey     ssh.PublicKey
+	// KnownHostsPath is the private known_hosts file of this instance, next to the SSH keys.
+	KnownHostsPath string
+
 	ForwardSocketPath     string
 	SocketNetworkPath     string
 	SocketInitrdVSockPath string
@@ -57,48 +67,97 @@ type Context struct {
 	TargetPath   string
 	DiskDataPath string
 	DiskTmpPath  string
+
+	// Artifacts is what Setup did (or would do, see Plan) with the files in the target directory.
+	Artifacts []Artifact
+	// DataMigration is set when -data-migrate is to be run, after the backup data policy replaced the data disk.
+	DataMigration *DataMigration
+	// Timeouts bound the boot and the shutdown, with the defaults filled in.
+	Timeouts Timeouts
+
+	// Loggers owns the log files of this instance, they are closed together when the instance exits.
+	Loggers *logger.Group
+
+	opts   *Options
+	dryRun bool
 }
 
-func Init() *Context {
-	return &Context{}
+func Init(opts *Options) *Context {
+	return &Context{
+		Loggers: &logger.Group{},
+		opts:    opts,
+	}
 }
 
+// PreSetup resolves what is needed before the instance is locked, including the event sinks,
+// so that Setup can already send events.
 func (c *Context) PreSetup() error {
 	g := errgroup.Group{}
 
 	g.Go(c.basic)
 	g.Go(c.logPath)
 
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	return c.eventSinks()
 }
 
-func (c *Context) Setup() error {
+// Setup prepares the sockets, the SSH keys and the files in the target directory. The copies of the
+// artifacts report to progress, which may be nil, and stop when ctx is done.
+func (c *Context) Setup(ctx context.Context, progress Progress) error {
 	g := errgroup.Group{}
 
 	g.Go(c.socketPath)
 	g.Go(c.ssh)
 	g.Go(c.sshPort)
-	g.Go(c.target)
+	g.Go(func() error {
+		return c.target(ctx, progress)
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
 
-	return g.Wait()
+	if c.dryRun {
+		return nil
+	}
+
+	return c.knownHosts()
+}
+
+// Plan resolves the options the same way as PreSetup and Setup, but without side effects:
+// nothing is locked, created, deleted or copied. The SSH keys are read if they already exist.
+func (c *Context) Plan() error {
+	c.dryRun = true
+
+	if err := c.PreSetup(); err != nil {
+		return err
+	}
+
+	return c.Setup(context.Background(), nil)
 }
 
 func (c *Context) basic() error {
-	c.Name = name
-	c.CPUS = cpus
-	c.MemoryBytes = memory * 1024 * 1024
-	c.IsCliMode = cliMode
-	c.BindPID = bindPID
-	c.EventSocketPath = eventSocketPath
-	c.PowerSaveMode = powerSaveMode
-	c.KernelDebug = kernelDebug
+	c.Name = c.opts.Name
+	c.CPUS = c.opts.CPUS
+	c.MemoryBytes = c.opts.Memory * 1024 * 1024
+	c.IsCliMode = c.opts.CliMode
+	c.BindPID = c.opts.BindPID
+	c.EventSocketPath = c.opts.EventSocketPath
+	c.EventFormat = c.opts.EventFormat
+	c.PowerSaveMode = c.opts.PowerSaveMode
+	c.KernelDebug = c.opts.KernelDebug
 
 	// Avoid folder names being taken by files
 	// 1118 is my wife's birthday :)
 	lockPrefixPath := "/tmp/oomol-lab.ovm.lock.1118"
 
-	if err := os.MkdirAll(lockPrefixPath, 0755); err != nil {
-		return err
+	if !c.dryRun {
+		if err := os.MkdirAll(lockPrefixPath, 0755); err != nil {
+			return err
+		}
 	}
 
 	if p, err := os.Executable(); err != nil {
@@ -113,47 +172,38 @@ func (c *Context) basic() error {
 
 		sum := md5.Sum([]byte(c.ExecutablePath))
 		hash := hex.EncodeToString(sum[:])
-		c.LockFile = lockPrefixPath + "/" + hash + "-" + name + ".pid"
+		c.LockFile = lockPrefixPath + "/" + hash + "-" + c.Name + ".pid"
 	}
 
-	c.ExtendShareDir = make(map[string]string)
-	if extendShareDir != "" {
-		for _, item := range strings.Split(extendShareDir, ",") {
-			parts := strings.Split(item, ":")
-			if len(parts) != 2 {
-				return fmt.Errorf("invalid extend share dir: %s", item)
-			}
-
-			if info, err := os.Stat(parts[1]); err != nil {
-				return fmt.Errorf("extend share dir %s not exists: %w", parts[1], err)
-			} else if !info.IsDir() {
-				return fmt.Errorf("extend share dir %s is not a directory", parts[1])
-			}
-
-			c.ExtendShareDir[parts[0]] = parts[1]
-		}
+	c.ExtendShareDir = make(map[string]string, len(c.opts.ExtendShareDir))
+	for tag, dir := range c.opts.ExtendShareDir {
+		c.ExtendShareDir[tag] = dir
 	}
 
 	return nil
 }
 
 func (c *Context) socketPath() error {
-	p, err := filepath.Abs(socketPath)
+	p, err := filepath.Abs(c.opts.SocketPath)
 	if err != nil {
 		return err
 	}
 
 	c.SocketPath = p
-	c.ForwardSocketPath = path.Join(p, name+"-podman.sock")
-	c.SocketNetworkPath = path.Join(p, name+"-vfkit-network.sock")
-	c.SocketInitrdVSockPath = path.Join(p, name+"-initrd-vsock.sock")
-	c.SocketReadyPath = path.Join(p, name+"-ready.sock")
-	c.RestfulSocketPath = path.Join(p, name+"-restful.sock")
-	c.TimeSyncSocketPath = path.Join(p, name+"-sync-time.sock")
-	c.SSHAuthSocketPath = path.Join(p, name+"-ssh-auth.sock")
+	c.ForwardSocketPath = path.Join(p, c.Name+"-podman.sock")
+	c.SocketNetworkPath = path.Join(p, c.Name+"-vfkit-network.sock")
+	c.SocketInitrdVSockPath = path.Join(p, c.Name+"-initrd-vsock.sock")
+	c.SocketReadyPath = path.Join(p, c.Name+"-ready.sock")
+	c.RestfulSocketPath = path.Join(p, c.Name+"-restful.sock")
+	c.TimeSyncSocketPath = path.Join(p, c.Name+"-sync-time.sock")
+	c.SSHAuthSocketPath = path.Join(p, c.Name+"-ssh-auth.sock")
 
 	c.Endpoint = "unix://" + c.SocketNetworkPath
 
+	if c.dryRun {
+		return nil
+	}
+
 	if err := os.RemoveAll(c.SocketPath); err != nil {
 		return err
 	}
@@ -166,68 +216,108 @@ func (c *Context) socketPath() error {
 }
 
 func (c *Context) ssh() error {
-	p, err := filepath.Abs(sshKeyPath)
+	p, err := filepath.Abs(c.opts.SSHKeyPath)
 	if err != nil {
 		return err
 	}
 
 	c.SSHKeyPath = p
-	c.SSHPrivateKeyPath = path.Join(p, name)
-	c.SSHPublicKeyPath = path.Join(p, name+".pub")
+	c.SSHPrivateKeyPath = path.Join(p, c.Name)
+	c.SSHPublicKeyPath = path.Join(p, c.Name+".pub")
+	c.SSHHostKeyPath = path.Join(p, c.Name+"-host")
+	c.KnownHostsPath = path.Join(p, c.Name+"-known_hosts")
+
+	if c.dryRun {
+		if b, err := os.ReadFile(c.SSHPublicKeyPath); err == nil {
+			c.SSHPublicKey = strings.TrimSpace(string(b))
+		}
+		if b, err := os.ReadFile(c.SSHHostKeyPath + ".pub"); err == nil {
+			c.SSHHostKey, _, _, _, _ = ssh.ParseAuthorizedKey(b)
+		}
+		return nil
+	}
 
 	if err := os.MkdirAll(p, 0700); err != nil {
 		return err
 	}
 
 	{
-		g := errgroup.Group{}
-		g.Go(func() error {
-			_, err := os.Stat(c.SSHPrivateKeyPath)
-			return err
-		})
-		g.Go(func() error {
-			_, err := os.Stat(c.SSHPublicKeyPath)
+		private, public, err := keyPair(p, c.Name)
+		if err != nil {
 			return err
-		})
-		if err := g.Wait(); err != nil {
-			_ = os.RemoveAll(c.SSHPrivateKeyPath)
-			_ = os.RemoveAll(c.SSHPublicKeyPath)
-			if err := utils.GenerateSSHKey(c.SSHKeyPath, name); err != nil {
-				return err
-			}
+		}
+
+		c.SSHPublicKey = strings.TrimSpace(string(public))
+		c.SSHPrivateKey = strings.TrimSpace(string(private))
+		if c.SSHSigner, err = ssh.ParsePrivateKey(private); err != nil {
+			return fmt.Errorf("parse private key error: %w", err)
 		}
 	}
 
 	{
-		f, err := os.Open(c.SSHPublicKeyPath)
+		private, _, err := keyPair(p, c.Name+"-host")
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		b, err := io.ReadAll(f)
+		signer, err := ssh.ParsePrivateKey(private)
 		if err != nil {
-			return err
+			return fmt.Errorf("parse host key error: %w", err)
 		}
-
-		c.SSHPublicKey = strings.TrimSpace(string(b))
+		c.SSHHostKey = signer.PublicKey()
 	}
 
+	return nil
+}
+
+// keyPair reads the key pair name and name.pub in dir, generating it first if either file is missing.
+func keyPair(dir, name string) (private, public []byte, err error) {
+	privatePath := path.Join(dir, name)
+	publicPath := privatePath + ".pub"
+
 	{
-		f, err := os.Open(c.SSHPrivateKeyPath)
-		if err != nil {
+		g := errgroup.Group{}
+		g.Go(func() error {
+			_, err := os.Stat(privatePath)
+			return err
+		})
+		g.Go(func() error {
+			_, err := os.Stat(publicPath)
 			return err
+		})
+		if err := g.Wait(); err != nil {
+			_ = os.RemoveAll(privatePath)
+			_ = os.RemoveAll(publicPath)
+			if err := utils.GenerateSSHKey(dir, name); err != nil {
+				return nil, nil, err
+			}
 		}
-		defer f.Close()
+	}
 
-		b, err := io.ReadAll(f)
-		if err != nil {
-			return err
+	if private, err = os.ReadFile(privatePath); err != nil {
+		return nil, nil, err
+	}
+
+	if public, err = os.ReadFile(publicPath); err != nil {
+		return nil, nil, err
+	}
+
+	return private, public, nil
+}
+
+// knownHosts pins the host key of the guest for the SSH port in the private known_hosts file, so that
+// ssh -o UserKnownHostsFile=... connects without asking to trust the key. The known_hosts file of
+// the user is only changed when it is passed as -known-hosts-path.
+func (c *Context) knownHosts() error {
+	addr := fmt.Sprintf("127.0.0.1:%d", c.SSHPort)
+
+	for _, p := range []string{c.KnownHostsPath, c.opts.KnownHostsPath} {
+		if p == "" {
+			continue
 		}
 
-		c.SSHPrivateKey = strings.TrimSpace(string(b))
-		if c.SSHSigner, err = ssh.ParsePrivateKey(b); err != nil {
-			return fmt.Errorf("parse private key error: %w", err)
+		if err := utils.UpdateKnownHosts(p, addr, c.SSHHostKey); err != nil {
+			return fmt.Errorf("update known_hosts %s error: %w", p, err)
 		}
 	}
 
@@ -246,48 +336,87 @@ func (c *Context) sshPort() error {
 }
 
 func (c *Context) logPath() error {
-	p, err := filepath.Abs(logPath)
+	p, err := filepath.Abs(c.opts.LogPath)
 	if err != nil {
 		return err
 	}
 
 	c.LogPath = p
 
+	if c.dryRun {
+		return nil
+	}
+
 	return os.MkdirAll(c.LogPath, 0755)
 }
 
-func (c *Context) target() error {
-	p, err := filepath.Abs(targetPath)
+func (c *Context) target(ctx context.Context, progress Progress) error {
+	p, err := filepath.Abs(c.opts.TargetPath)
 	if err != nil {
 		return err
 	}
 
 	c.TargetPath = p
-	if err := os.MkdirAll(c.TargetPath, 0755); err != nil {
-		return err
+	if !c.dryRun {
+		if err := os.MkdirAll(c.TargetPath, 0755); err != nil {
+			return err
+		}
+
+		if err := utils.RemoveTempFiles(c.TargetPath); err != nil {
+			return fmt.Errorf("remove temporary files in %s error: %w", c.TargetPath, err)
+		}
 	}
 
 	c.VersionsPath = path.Join(c.TargetPath, "versions.json")
-	c.KernelPath = path.Join(c.TargetPath, filepath.Base(kernelPath))
-	c.InitrdPath = path.Join(c.TargetPath, filepath.Base(initrdPath))
-	c.RootfsPath = path.Join(c.TargetPath, filepath.Base(rootfsPath))
+	c.KernelPath = path.Join(c.TargetPath, filepath.Base(c.opts.KernelPath))
+	c.InitrdPath = path.Join(c.TargetPath, filepath.Base(c.opts.InitrdPath))
+	c.RootfsPath = path.Join(c.TargetPath, filepath.Base(c.opts.RootfsPath))
 	c.DiskDataPath = path.Join(c.TargetPath, "data.img")
 	c.DiskTmpPath = path.Join(c.TargetPath, "tmp.img")
 
-	target, err := newTarget(c.TargetPath, kernelPath, initrdPath, rootfsPath, c.DiskDataPath, c.VersionsPath)
+	checksums, err := c.checksums()
 	if err != nil {
 		return err
 	}
 
-	if err := target.handle(); err != nil {
-		return err
+	target := newTarget(c.TargetPath, c.opts.KernelPath, c.opts.InitrdPath, c.opts.RootfsPath, c.DiskDataPath, c.VersionsPath, c.opts.Versions, checksums, newDataPolicy(c.opts.DataPolicy, c.opts.DataBackups, c.opts.DataMigrate != ""))
+	fromVersion := target.versionsJSON.get("data")
+
+	if c.dryRun {
+		c.Artifacts = target.plan(ctx)
+	} else {
+		artifacts, err := target.handle(ctx, progress)
+		if err != nil {
+			return err
+		}
+		c.Artifacts = artifacts
 	}
 
+	// handle recorded the pending migration, Plan only shows it
+	m := target.versionsJSON.Migration
+	if c.dryRun {
+		m = target.migration(c.Artifacts, fromVersion)
+	}
+	if m != nil && c.opts.DataMigrate != "" {
+		c.DataMigration = &DataMigration{
+			Command:     c.opts.DataMigrate,
+			OldDataPath: m.Backup,
+			FromVersion: m.From,
+			ToVersion:   m.To,
+		}
+	}
+
+	tmp := Artifact{Name: "tmp", Target: c.DiskTmpPath, Action: ActionKeep}
 	if _, err := os.Stat(c.DiskTmpPath); err != nil {
-		if err := utils.CreateSparseFile(c.DiskTmpPath, 1*1024*1024*1024*1024); err != nil {
-			return err
+		tmp.Action, tmp.Reason = ActionCreate, "missing"
+
+		if !c.dryRun {
+			if err := utils.CreateSparseFile(c.DiskTmpPath, 1*1024*1024*1024*1024); err != nil {
+				return err
+			}
 		}
 	}
+	c.Artifacts = append(c.Artifacts, tmp)
 
 	return nil
 }
@@ -4,13 +4,16 @@
 package cli
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
+	"time"
 
+	"github.com/oomol-lab/ovm/pkg/errcode"
 	"github.com/oomol-lab/ovm/pkg/utils"
 	"golang.org/x/sync/errgroup"
 )
@@ -20,42 +23,37 @@ type versionsJSON struct {
 	Initrd string `json:"initrd"`
 	Rootfs string `json:"rootfs"`
 	Data   string `json:"data"`
+	// Checksums are the verified target files of the artifacts with a checksum.
+	Checksums map[string]*fileChecksum `json:"checksums,omitempty"`
+	// Migration is the pending -data-migrate, see pendingMigration.
+	Migration *pendingMigration `json:"migration,omitempty"`
 
 	path           string
 	needUpdateJSON bool
 }
 
-func newVersionsJSON(path string) (*versionsJSON, error) {
+func newVersionsJSON(path string) *versionsJSON {
 	v := &versionsJSON{
 		path: path,
 	}
 
-	if err := parseVersions(); err != nil {
-		return nil, err
-	}
-
-	if err := v.read(); err != nil {
-		return nil, err
-	}
+	v.read()
 
-	return v, nil
+	return v
 }
 
 // read reads the versions file.
-// If parsing fails, the file will be deleted.
-func (v *versionsJSON) read() error {
+// If the file is missing or can not be parsed, all versions are unknown and every artifact will be refreshed.
+func (v *versionsJSON) read() {
 	data, err := os.ReadFile(v.path)
 	if err != nil {
-		return os.RemoveAll(v.path)
+		return
 	}
 
-	if err := json.Unmarshal(data, &v); err != nil {
-		return os.RemoveAll(v.path)
-	}
-
-	return nil
+	_ = json.Unmarshal(data, &v)
 }
 
+// saveToDisk writes the versions file atomically, see utils.WriteFileAtomic.
 func (v *versionsJSON) saveToDisk() error {
 	if !v.needUpdateJSON {
 		return nil
@@ -66,7 +64,7 @@ func (v *versionsJSON) saveToDisk() error {
 		return err
 	}
 
-	return os.WriteFile(v.path, data, 0644)
+	return utils.WriteFileAtomic(v.path, data, 0644)
 }
 
 func (v *versionsJSON) get(key string) string {
@@ -84,6 +82,39 @@ func (v *versionsJSON) get(key string) string {
 	}
 }
 
+func (v *versionsJSON) checksum(key string) *fileChecksum {
+	return v.Checksums[key]
+}
+
+// setChecksum records the verified target file of key, nil removes it.
+func (v *versionsJSON) setChecksum(key string, c *fileChecksum) {
+	old := v.Checksums[key]
+	if old == nil && c == nil || old != nil && c != nil && *old == *c {
+		return
+	}
+
+	if c == nil {
+		delete(v.Checksums, key)
+	} else {
+		if v.Checksums == nil {
+			v.Checksums = make(map[string]*fileChecksum)
+		}
+		v.Checksums[key] = c
+	}
+	v.needUpdateJSON = true
+}
+
+// setMigration records the pending migration, nil clears it.
+func (v *versionsJSON) setMigration(m *pendingMigration) {
+	old := v.Migration
+	if old == nil && m == nil || old != nil && m != nil && *old == *m {
+		return
+	}
+
+	v.Migration = m
+	v.needUpdateJSON = true
+}
+
 func (v *versionsJSON) set(key, val string) {
 	var vK *string
 	switch key {
@@ -103,27 +134,57 @@ func (v *versionsJSON) set(key, val string) {
 	}
 }
 
+// Progress is called while an artifact is copied, with the bytes of the source that are done.
+type Progress func(artifact string, done, total int64)
+
 type srcPath struct {
 	key string
 	p   string
 }
 
+const (
+	ActionKeep   = "keep"
+	ActionCopy   = "copy"
+	ActionCreate = "create"
+	// ActionRefuse is the data disk of a changed data version under the keep data policy.
+	ActionRefuse = "refuse"
+)
+
+// Artifact describes what happens to one file in the target directory.
+type Artifact struct {
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	// Repair is set when the target did not match its checksum and is copied again.
+	Repair bool `json:"repair,omitempty"`
+	// Backup is where the backup data policy moves the old data disk to.
+	Backup string `json:"backup,omitempty"`
+	// Copy is how the file was copied, nil unless it was.
+	Copy *utils.CopyStats `json:"-"`
+
+	// checksum is the verified copy, nil unless the artifact has a checksum.
+	checksum *fileChecksum
+}
+
 type targetContext struct {
 	targetPath string
+	versions   map[string]string
+	checksums  map[string]string
+	data       dataPolicy
 
 	srcPaths []srcPath
 
 	versionsJSON *versionsJSON
 }
 
-func newTarget(targetPath, kernelPath, initrdPath, rootfsPath, dataPath, versionsPath string) (*targetContext, error) {
-	versionsJSON, err := newVersionsJSON(versionsPath)
-	if err != nil {
-		return nil, err
-	}
-
+func newTarget(targetPath, kernelPath, initrdPath, rootfsPath, dataPath, versionsPath string, versions, checksums map[string]string, data dataPolicy) *targetContext {
 	return &targetContext{
 		targetPath: targetPath,
+		versions:   versions,
+		checksums:  checksums,
+		data:       data,
 		srcPaths: []srcPath{
 			{"kernel", kernelPath},
 			{"initrd", initrdPath},
@@ -131,81 +192,204 @@ func newTarget(targetPath, kernelPath, initrdPath, rootfsPath, dataPath, version
 			{"data", dataPath},
 		},
 
-		versionsJSON: versionsJSON,
-	}, nil
+		versionsJSON: newVersionsJSON(versionsPath),
+	}
 }
 
-func (t *targetContext) handle() error {
-	g := errgroup.Group{}
+// plan decides which files need to be copied or created, without touching them.
+// A kept file with a checksum is verified, see verify, until ctx is done.
+func (t *targetContext) plan(ctx context.Context) []Artifact {
+	artifacts := make([]Artifact, 0, len(t.srcPaths))
 
 	for _, src := range t.srcPaths {
-		distPath := path.Join(t.targetPath, filepath.Base(src.p))
+		a := Artifact{
+			Name:   src.key,
+			Source: src.p,
+			Target: path.Join(t.targetPath, filepath.Base(src.p)),
+			Action: ActionKeep,
+		}
 
-		if exists, _ := utils.PathExists(distPath); !exists {
-			t.copyOrCreate(src, &g)
-			continue
+		if src.key == "data" {
+			a.Source = ""
 		}
 
-		if v := t.versionsJSON.get(src.key); v != versionsParams[src.key] {
-			t.copyOrCreate(src, &g)
-			continue
+		exists, _ := utils.PathExists(a.Target)
+		if !exists {
+			a.Reason = "missing"
+		} else if v := t.versionsJSON.get(src.key); v != t.versions[src.key] {
+			a.Reason = fmt.Sprintf("version changed from %q to %q", v, t.versions[src.key])
+		} else if reason := t.verify(ctx, src.key, a.Target); reason != "" {
+			a.Reason, a.Repair = reason, true
 		}
-	}
 
-	if err := g.Wait(); err != nil {
-		return err
+		if a.Reason != "" {
+			switch {
+			case src.key != "data":
+				a.Action = ActionCopy
+			case exists && t.data.policy == DataPolicyKeep:
+				a.Action = ActionRefuse
+			default:
+				a.Action = ActionCreate
+				if exists && t.data.policy == DataPolicyBackup && t.data.backups > 0 {
+					a.Backup = backupPath(a.Target, time.Now())
+				}
+			}
+		}
+
+		artifacts = append(artifacts, a)
 	}
 
-	return t.versionsJSON.saveToDisk()
+	return artifacts
 }
 
-func (t *targetContext) copyOrCreate(src srcPath, g *errgroup.Group) {
-	t.versionsJSON.set(src.key, versionsParams[src.key])
-	distPath := path.Join(t.targetPath, filepath.Base(src.p))
+// handle copies and creates the files of plan. The versions file is only written after all of them succeeded,
+// so a failed, canceled or killed copy is retried on the next start. The data disk is only replaced once the
+// other copies succeeded, see createData.
+func (t *targetContext) handle(ctx context.Context, progress Progress) ([]Artifact, error) {
+	g, gctx := errgroup.WithContext(ctx)
 
-	g.Go(func() error {
-		if src.key == "data" {
-			if err := os.RemoveAll(distPath); err != nil {
-				return err
-			}
+	from := t.versionsJSON.get("data")
+	artifacts := t.plan(ctx)
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
 
-			return utils.CreateSparseFile(distPath, 8*1024*1024*1024*1024)
+	for _, a := range artifacts {
+		if a.Action == ActionRefuse {
+			return nil, errcode.New(errcode.DataVersionChanged, "refuse to replace %s, %s and the data policy is keep", a.Target, a.Reason)
 		}
+	}
 
-		return utils.Copy(src.p, distPath)
-	})
+	var data *Artifact
+	for i := range artifacts {
+		switch {
+		case artifacts[i].Action == ActionKeep:
+		case artifacts[i].Name == "data":
+			data = &artifacts[i]
+		default:
+			t.copyArtifact(gctx, t.srcPaths[i], &artifacts[i], progress, g)
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, errcode.Wrap(errcode.ArtifactCopyFailed, err)
+	}
+
+	for _, a := range artifacts {
+		if a.Action == ActionCopy {
+			t.versionsJSON.setChecksum(a.Name, a.checksum)
+		}
+	}
+
+	if data != nil {
+		if err := t.createData(data, artifacts, from); err != nil {
+			return nil, errcode.Wrap(errcode.ArtifactCopyFailed, err)
+		}
+		t.versionsJSON.setChecksum(data.Name, nil)
+	}
+
+	if t.data.migrate {
+		t.versionsJSON.setMigration(t.migration(artifacts, from))
+	}
+
+	return artifacts, t.versionsJSON.saveToDisk()
 }
 
-var versionsParams = map[string]string{
-	"kernel": "",
-	"initrd": "",
-	"rootfs": "",
-	"data":   "",
+// verify checks the target file of key against its checksum and returns why it has to be copied again,
+// or "" if it is fine. The file is only hashed when its size or mtime changed since the last verification.
+func (t *targetContext) verify(ctx context.Context, key, target string) string {
+	sum := t.checksums[key]
+	if sum == "" {
+		t.versionsJSON.setChecksum(key, nil)
+		return ""
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return fmt.Sprintf("stat failed: %v", err)
+	}
+
+	if t.versionsJSON.checksum(key).matches(sum, info) {
+		return ""
+	}
+
+	c, err := newFileChecksum(ctx, target, sum)
+	if err != nil {
+		return err.Error()
+	}
+
+	t.versionsJSON.setChecksum(key, c)
+
+	return ""
 }
 
-func parseVersions() error {
-	s := strings.Split(versions, ",")
+// createData backs up or removes the data disk of a and creates an empty one. Under the backup data policy
+// the pending migration is saved before the old backups are pruned, so that a failure later on can not lose
+// the backup with the data: the next start keeps it and only creates the empty disk again.
+func (t *targetContext) createData(a *Artifact, artifacts []Artifact, from string) error {
+	t.versionsJSON.set(a.Name, t.versions[a.Name])
 
-	for _, val := range s {
-		item := strings.Split(strings.TrimSpace(val), "=")
-		if len(item) != 2 {
-			continue
+	if a.Backup == "" {
+		if err := os.RemoveAll(a.Target); err != nil {
+			return err
 		}
 
-		key := strings.TrimSpace(item[0])
+		return utils.CreateSparseFile(a.Target, 8*1024*1024*1024*1024)
+	}
+
+	if err := os.Rename(a.Target, a.Backup); err != nil {
+		return fmt.Errorf("back up data disk error: %w", err)
+	}
 
-		if _, ok := versionsParams[key]; !ok {
-			continue
+	if t.data.migrate {
+		t.versionsJSON.setMigration(t.migration(artifacts, from))
+		if err := t.versionsJSON.saveToDisk(); err != nil {
+			return fmt.Errorf("save pending data migration error: %w", err)
 		}
+	}
 
-		versionsParams[key] = strings.TrimSpace(item[1])
+	if err := pruneBackups(a.Target, t.data.backups, t.pendingBackup()); err != nil {
+		return fmt.Errorf("remove old data disk backups error: %w", err)
 	}
 
-	for name, v := range versionsParams {
-		if v == "" {
-			return fmt.Errorf("need %s in versions", name)
+	return utils.CreateSparseFile(a.Target, 8*1024*1024*1024*1024)
+}
+
+// copyArtifact copies the artifact and records the copy in a.
+func (t *targetContext) copyArtifact(ctx context.Context, src srcPath, a *Artifact, progress Progress, g *errgroup.Group) {
+	t.versionsJSON.set(src.key, t.versions[src.key])
+	distPath := path.Join(t.targetPath, filepath.Base(src.p))
+	sum := t.checksums[src.key]
+
+	g.Go(func() error {
+		var p utils.Progress
+		if progress != nil {
+			p = func(done, total int64) {
+				progress(src.key, done, total)
+			}
+		}
+
+		stats, err := utils.Copy(ctx, src.p, distPath, p)
+		if err != nil {
+			return err
 		}
-	}
+		a.Copy = stats
 
-	return nil
+		if sum == "" {
+			return nil
+		}
+
+		c, err := newFileChecksum(ctx, distPath, sum)
+		if errors.Is(err, errChecksumMismatch) {
+			return errcode.Wrap(errcode.ChecksumMismatch, fmt.Errorf("verify copy of %s failed: %w", src.p, err))
+		}
+		if err != nil {
+			return err
+		}
+		a.checksum = c
+
+		return nil
+	})
 }
+
+var versionKeys = []string{"kernel", "initrd", "rootfs", "data"}
@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package cli
+
+import "time"
+
+// Timeouts bound the boot and the shutdown of the virtual machine. A zero field uses its default.
+type Timeouts struct {
+	// Ignition is how long the initrd has to fetch the ignition command once the virtual machine started, default 15s.
+	Ignition time.Duration
+	// Ready is how long the guest has to report ready, counted from the end of the setup, default 30s.
+	Ready time.Duration
+	// RequestStop is how long the guest has to power off when ovm exits, before it is stopped by force, default 10s.
+	RequestStop time.Duration
+}
+
+// WithDefaults returns t with the zero fields set to their defaults.
+func (t Timeouts) WithDefaults() Timeouts {
+	if t.Ignition == 0 {
+		t.Ignition = 15 * time.Second
+	}
+	if t.Ready == 0 {
+		t.Ready = 30 * time.Second
+	}
+	if t.RequestStop == 0 {
+		t.RequestStop = 10 * time.Second
+	}
+
+	return t
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package errcode classifies the errors that end ovm. Every Code has a name, which is the code
+// of the error event, and the exit code of the ovm process.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Code is a kind of error that ends ovm.
+type Code struct {
+	Name string
+	Exit int
+}
+
+// Exit codes 2-9 are configuration and setup errors, 10-19 are errors while the virtual machine starts
+// or runs, 20-29 are the shutdowns that were asked for or caused by the guest.
+var (
+	Unknown = Code{"unknown", 1}
+
+	InvalidConfig      = Code{"invalid_config", 2}
+	InstanceLocked     = Code{"instance_locked", 3}
+	SetupFailed        = Code{"setup_failed", 4}
+	ArtifactCopyFailed = Code{"artifact_copy_failed", 5}
+	DiskFull           = Code{"disk_full", 6}
+	ChecksumMismatch   = Code{"checksum_mismatch", 7}
+	DataVersionChanged = Code{"data_version_changed", 8}
+
+	GVProxyFailed   = Code{"gvproxy_failed", 10}
+	GVProxyTimeout  = Code{"gvproxy_timeout", 11}
+	VMCreateFailed  = Code{"vm_create_failed", 12}
+	VMStartFailed   = Code{"vm_start_failed", 13}
+	VMStartTimeout  = Code{"vm_start_timeout", 14}
+	IgnitionFailed  = Code{"ignition_failed", 15}
+	IgnitionTimeout = Code{"ignition_timeout", 16}
+	ReadyTimeout    = Code{"ready_timeout", 17}
+	HostKeyMismatch = Code{"host_key_mismatch", 18}
+
+	Signal        = Code{"signal", 20}
+	BindPIDExited = Code{"bind_pid_exited", 21}
+	VMStopped     = Code{"vm_stopped", 22}
+	APIStop       = Code{"api_stop", 23}
+	Canceled      = Code{"canceled", 24}
+)
+
+// Codes are all codes, in the order of their exit codes.
+var Codes = []Code{
+	Unknown,
+	InvalidConfig, InstanceLocked, SetupFailed, ArtifactCopyFailed, DiskFull, ChecksumMismatch, DataVersionChanged,
+	GVProxyFailed, GVProxyTimeout, VMCreateFailed, VMStartFailed, VMStartTimeout, IgnitionFailed, IgnitionTimeout, ReadyTimeout, HostKeyMismatch,
+	Signal, BindPIDExited, VMStopped, APIStop, Canceled,
+}
+
+// Error is an error of a known kind.
+type Error struct {
+	Code Code
+	Err  error
+}
+
+// New returns an *Error with the formatted error.
+func New(code Code, format string, args ...any) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Wrap gives err the code, unless it already has one. A nil err stays nil.
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &Error{Code: code, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Of returns the code of err: DiskFull when it was caused by a full disk, otherwise the code of the
+// first *Error in its chain, Unknown if there is none.
+func Of(err error) Code {
+	if errors.Is(err, syscall.ENOSPC) {
+		return DiskFull
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	return Unknown
+}
+
+// ExitCode is the exit code of the process for err, 0 for nil.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	return Of(err).Exit
+}
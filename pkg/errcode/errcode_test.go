@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestExitCodes pins the exit codes, they are part of the interface of ovm.
+func TestExitCodes(t *testing.T) {
+	want := map[string]int{
+		"unknown":              1,
+		"invalid_config":       2,
+		"instance_locked":      3,
+		"setup_failed":         4,
+		"artifact_copy_failed": 5,
+		"disk_full":            6,
+		"checksum_mismatch":    7,
+		"data_version_changed": 8,
+		"gvproxy_failed":       10,
+		"gvproxy_timeout":      11,
+		"vm_create_failed":     12,
+		"vm_start_failed":      13,
+		"vm_start_timeout":     14,
+		"ignition_failed":      15,
+		"ignition_timeout":     16,
+		"ready_timeout":        17,
+		"host_key_mismatch":    18,
+		"signal":               20,
+		"bind_pid_exited":      21,
+		"vm_stopped":           22,
+		"api_stop":             23,
+		"canceled":             24,
+	}
+
+	if len(Codes) != len(want) {
+		t.Errorf("%d codes, want %d", len(Codes), len(want))
+	}
+
+	for i, code := range Codes {
+		if exit, ok := want[code.Name]; !ok || code.Exit != exit {
+			t.Errorf("code %s exits with %d, want %d", code.Name, code.Exit, exit)
+		}
+		if i > 0 && Codes[i-1].Exit >= code.Exit {
+			t.Errorf("code %s is not in the order of the exit codes", code.Name)
+		}
+	}
+}
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Code
+	}{
+		{name: "nil", err: nil, want: Unknown},
+		{name: "plain", err: errors.New("failed"), want: Unknown},
+		{name: "new", err: New(ReadyTimeout, "no ready in %s", "30s"), want: ReadyTimeout},
+		{name: "wrapped", err: fmt.Errorf("start: %w", New(VMStartFailed, "failed")), want: VMStartFailed},
+		{name: "twice wrapped", err: fmt.Errorf("a: %w", fmt.Errorf("b: %w", Wrap(IgnitionFailed, errors.New("c")))), want: IgnitionFailed},
+		{name: "joined", err: errors.Join(errors.New("a"), Wrap(GVProxyFailed, errors.New("b"))), want: GVProxyFailed},
+		{name: "wrap keeps the first code", err: Wrap(SetupFailed, fmt.Errorf("a: %w", New(ChecksumMismatch, "b"))), want: ChecksumMismatch},
+		{name: "disk full", err: Wrap(ArtifactCopyFailed, &os.PathError{Op: "write", Path: "data.img", Err: syscall.ENOSPC}), want: DiskFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Of(tt.err); got != tt.want {
+				t.Errorf("Of = %v, want %v", got, tt.want)
+			}
+
+			wantExit := tt.want.Exit
+			if tt.err == nil {
+				wantExit = 0
+			}
+			if got := ExitCode(tt.err); got != wantExit {
+				t.Errorf("ExitCode = %d, want %d", got, wantExit)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if Wrap(SetupFailed, nil) != nil {
+		t.Error("Wrap of nil is not nil")
+	}
+
+	cause := errors.New("cause")
+	err := Wrap(SetupFailed, cause)
+	if !errors.Is(err, cause) || err.Error() != "cause" {
+		t.Errorf("Wrap = %v, want it to wrap the cause with its message", err)
+	}
+}
@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package gvproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containers/gvisor-tap-vsock/pkg/fs"
+	"github.com/containers/gvisor-tap-vsock/pkg/virtualnetwork"
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
+	"github.com/oomol-lab/ovm/pkg/logger"
+	"github.com/oomol-lab/ovm/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshTimeout = 5 * time.Second
+
+// sshForward forwards the connections to a unix socket on the host to a unix socket in the guest over SSH.
+// It replaces sshclient.SSHForward of gvisor-tap-vsock, which does not verify the host key.
+type sshForward struct {
+	listener net.Listener
+	local    string
+	remote   string
+	conf     *ssh.ClientConfig
+	vn       *virtualnetwork.VirtualNetwork
+	ev       *event.Context
+	log      *logger.Context
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// up is the state last sent with the forward event.
+	up bool
+}
+
+// newSSHForward listens on local and connects to the guest, waiting for sshd to come up.
+// The forward event is sent when the forward goes up or down.
+func newSSHForward(ctx context.Context, local, remote string, opt *cli.Context, vn *virtualnetwork.VirtualNetwork, ev *event.Context, log *logger.Context) (*sshForward, error) {
+	if err := os.Remove(local); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	oldMask := fs.Umask(0177)
+	listener, err := net.Listen("unix", local)
+	fs.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s error: %w", local, err)
+	}
+
+	f := &sshForward{
+		listener: listener,
+		local:    local,
+		remote:   remote,
+		conf: &ssh.ClientConfig{
+			User:              "root",
+			Auth:              []ssh.AuthMethod{ssh.PublicKeys(opt.SSHSigner)},
+			HostKeyCallback:   utils.HostKeyCallback(opt.SSHHostKey),
+			HostKeyAlgorithms: []string{opt.SSHHostKey.Type()},
+			Timeout:           sshTimeout,
+		},
+		vn:  vn,
+		ev:  ev,
+		log: log,
+	}
+
+	backoff := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		err = f.connect(ctx)
+		if err == nil {
+			f.setUp(true, nil)
+			return f, nil
+		}
+
+		// a wrong host key will not become right by trying again
+		if i >= 60 || errors.Is(err, utils.ErrHostKeyMismatch) {
+			_ = listener.Close()
+			ev.NotifyForward(local, false, err)
+			if errors.Is(err, utils.ErrHostKeyMismatch) {
+				err = errcode.Wrap(errcode.HostKeyMismatch, err)
+			}
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = listener.Close()
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, time.Second)
+	}
+}
+
+// connect replaces the SSH connection to the guest.
+func (f *sshForward) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, sshTimeout)
+	defer cancel()
+
+	conn, err := f.vn.DialContextTCP(ctx, sshHostPort)
+	if err != nil {
+		return fmt.Errorf("dial guest ssh error: %w", err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, sshHostPort, f.conf)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("ssh handshake error: %w", err)
+	}
+
+	f.mu.Lock()
+	old := f.client
+	f.client = ssh.NewClient(c, chans, reqs)
+	f.mu.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+
+	return nil
+}
+
+// tunnel opens a connection to the remote socket, connecting to the guest again if the connection broke.
+func (f *sshForward) tunnel(ctx context.Context) (net.Conn, error) {
+	for retries := 1; ; retries++ {
+		f.mu.Lock()
+		client := f.client
+		f.mu.Unlock()
+
+		conn, err := client.Dial("unix", f.remote)
+		if err == nil {
+			return conn, nil
+		}
+
+		if retries > 2 {
+			return nil, fmt.Errorf("dial %s in guest error: %w", f.remote, err)
+		}
+
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			f.log.Warnf("SSH connection of the podman forward broke, connecting again: %v", err)
+			f.setUp(false, err)
+			if err := f.connect(ctx); err != nil {
+				return nil, err
+			}
+			f.setUp(true, nil)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// acceptAndTunnel accepts one connection and pipes it to the remote socket in the background.
+func (f *sshForward) acceptAndTunnel(ctx context.Context) error {
+	local, err := f.listener.Accept()
+	if err != nil {
+		return fmt.Errorf("accept %s error: %w", f.listener.Addr(), err)
+	}
+
+	remote, err := f.tunnel(ctx)
+	if err != nil {
+		_ = local.Close()
+		f.log.Warnf("%v", err)
+		return nil
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go pipe(local, remote, &wg)
+		go pipe(remote, local, &wg)
+		wg.Wait()
+
+		_ = local.Close()
+		_ = remote.Close()
+	}()
+
+	return nil
+}
+
+func (f *sshForward) close() {
+	_ = f.listener.Close()
+	f.setUp(false, nil)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.client != nil {
+		_ = f.client.Close()
+	}
+}
+
+// setUp sends the forward event if the state changed.
+func (f *sshForward) setUp(up bool, err error) {
+	f.mu.Lock()
+	changed := f.up != up
+	f.up = up
+	f.mu.Unlock()
+
+	if changed {
+		f.ev.NotifyForward(f.local, up, err)
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies src to dst, then closes the write side of dst so the other end sees EOF.
+func pipe(dst, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	_, _ = io.Copy(dst, src)
+
+	if cw, ok := dst.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+}
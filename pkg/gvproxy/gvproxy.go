@@ -9,20 +9,19 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/containers/gvisor-tap-vsock/pkg/sshclient"
 	"github.com/containers/gvisor-tap-vsock/pkg/transport"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/containers/gvisor-tap-vsock/pkg/virtualnetwork"
 	"github.com/oomol-lab/ovm/pkg/channel"
 	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
 	"github.com/oomol-lab/ovm/pkg/ipc/event"
-	"github.com/oomol-lab/ovm/pkg/logger"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -34,80 +33,37 @@ const (
 	gateway     = "gateway"
 )
 
-func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
-	log, err := logger.New(opt.LogPath, opt.Name+"-gvproxy")
+func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context, ch *channel.Context, ev *event.Context) error {
+	log, err := opt.Loggers.New(opt.LogPath, opt.Name+"-gvproxy")
 	if err != nil {
 		return fmt.Errorf("create gvproxy logger error: %v", err)
 	}
 
-	config := types.Configuration{
-		Debug:             false,
-		CaptureFile:       "",
-		MTU:               5000,
-		Subnet:            "192.168.127.0/24",
-		GatewayIP:         gatewayIP,
-		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-		DHCPStaticLeases: map[string]string{
-			"192.168.127.2": "5a:94:ef:e4:0c:ee",
-		},
-		DNS: []types.Zone{
-			{
-				Name: "containers.internal.",
-				Records: []types.Record{
-					{
-						Name: gateway,
-						IP:   net.ParseIP(gatewayIP),
-					},
-					{
-						Name: host,
-						IP:   net.ParseIP(hostIP),
-					},
-				},
-			},
-			{
-				Name: "docker.internal.",
-				Records: []types.Record{
-					{
-						Name: gateway,
-						IP:   net.ParseIP(gatewayIP),
-					},
-					{
-						Name: host,
-						IP:   net.ParseIP(hostIP),
-					},
-				},
-			},
-		},
-		DNSSearchDomains: searchDomains(log),
-		Forwards: map[string]string{
-			fmt.Sprintf("127.0.0.1:%d", opt.SSHPort): sshHostPort,
-		},
-		NAT: map[string]string{
-			hostIP: "127.0.0.1",
-		},
-		GatewayVirtualIPs: []string{hostIP},
-		VpnKitUUIDMacAddresses: map[string]string{
-			"c3d68012-0208-11ea-9fd7-f2189899ab08": "5a:94:ef:e4:0c:ee",
-		},
-		Protocol: types.HyperKitProtocol,
+	domains, err := SearchDomains()
+	if err != nil {
+		log.Warnf("%v", err)
+	} else if len(domains) != 0 {
+		log.Warnf("Using search domains: %v", domains)
 	}
-	vn, err := virtualnetwork.New(&config)
+
+	config := Configuration(opt, domains)
+	vn, err := virtualnetwork.New(config)
 	if err != nil {
-		return err
+		return errcode.Wrap(errcode.GVProxyFailed, err)
 	}
 
 	{
 		log.Infof("listening %s", opt.Endpoint)
 		ln, err := transport.Listen(opt.Endpoint)
 		if err != nil {
-			return errors.Wrap(err, "cannot listen")
+			return errcode.Wrap(errcode.GVProxyFailed, errors.Wrap(err, "cannot listen"))
 		}
 		httpServe(ctx, g, ln, vn.Mux())
 	}
 
 	ln, err := vn.Listen("tcp", fmt.Sprintf("%s:80", gatewayIP))
 	if err != nil {
-		return err
+		return errcode.Wrap(errcode.GVProxyFailed, err)
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/services/forwarder/all", vn.Mux())
@@ -115,40 +71,29 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 	mux.Handle("/services/forwarder/unexpose", vn.Mux())
 	httpServe(ctx, g, ln, mux)
 
-	channel.NotifyGVProxyReady()
-	event.NotifyApp(event.GVProxyReady)
+	ch.NotifyGVProxyReady()
+	ev.NotifyApp(event.GVProxyReady)
 
 	g.Go(func() error {
 		select {
 		case <-ctx.Done():
 			log.Info("skip create ssh forward, because context done")
 			return nil
-		case <-channel.ReceiveVMReady():
+		case <-ch.ReceiveVMReady():
 			log.Info("VM is ready, creating podman socket forward")
 			break
 		}
 
-		src := &url.URL{
-			Scheme: "unix",
-			Path:   opt.ForwardSocketPath,
-		}
-
-		dest := &url.URL{
-			Scheme: "ssh",
-			User:   url.User("root"),
-			Host:   sshHostPort,
-			Path:   "/run/podman/podman.sock",
-		}
 		defer os.RemoveAll(opt.ForwardSocketPath)
 
-		log.Infof("ssh private key path: %s", opt.SSHPrivateKeyPath)
-		forward, err := sshclient.CreateSSHForward(ctx, src, dest, opt.SSHPrivateKeyPath, vn)
+		log.Infof("ssh host key: %s", ssh.FingerprintSHA256(opt.SSHHostKey))
+		forward, err := newSSHForward(ctx, opt.ForwardSocketPath, "/run/podman/podman.sock", opt, vn, ev, log)
 		if err != nil {
 			return err
 		}
 		go func() {
 			<-ctx.Done()
-			forward.Close()
+			forward.close()
 		}()
 
 	loop:
@@ -159,7 +104,7 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 			default:
 				// proceed
 			}
-			err := forward.AcceptAndTunnel(ctx)
+			err := forward.acceptAndTunnel(ctx)
 			if err != nil {
 				log.Infof("Error occurred handling ssh forwarded connection: %q", err)
 			}
@@ -170,11 +115,66 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 	return nil
 }
 
-func searchDomains(log *logger.Context) []string {
+// Configuration returns the virtual network served to the guest.
+func Configuration(opt *cli.Context, searchDomains []string) *types.Configuration {
+	return &types.Configuration{
+		Debug:             false,
+		CaptureFile:       "",
+		MTU:               5000,
+		Subnet:            "192.168.127.0/24",
+		GatewayIP:         gatewayIP,
+		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
+		DHCPStaticLeases: map[string]string{
+			"192.168.127.2": "5a:94:ef:e4:0c:ee",
+		},
+		DNS: []types.Zone{
+			{
+				Name: "containers.internal.",
+				Records: []types.Record{
+					{
+						Name: gateway,
+						IP:   net.ParseIP(gatewayIP),
+					},
+					{
+						Name: host,
+						IP:   net.ParseIP(hostIP),
+					},
+				},
+			},
+			{
+				Name: "docker.internal.",
+				Records: []types.Record{
+					{
+						Name: gateway,
+						IP:   net.ParseIP(gatewayIP),
+					},
+					{
+						Name: host,
+						IP:   net.ParseIP(hostIP),
+					},
+				},
+			},
+		},
+		DNSSearchDomains: searchDomains,
+		Forwards: map[string]string{
+			fmt.Sprintf("127.0.0.1:%d", opt.SSHPort): sshHostPort,
+		},
+		NAT: map[string]string{
+			hostIP: "127.0.0.1",
+		},
+		GatewayVirtualIPs: []string{hostIP},
+		VpnKitUUIDMacAddresses: map[string]string{
+			"c3d68012-0208-11ea-9fd7-f2189899ab08": "5a:94:ef:e4:0c:ee",
+		},
+		Protocol: types.HyperKitProtocol,
+	}
+}
+
+// SearchDomains returns the search domains of the host, they are passed to the guest by DHCP.
+func SearchDomains() ([]string, error) {
 	f, err := os.Open("/etc/resolv.conf")
 	if err != nil {
-		log.Warnf("open /etc/resolv.conf file error: %v", err)
-		return nil
+		return nil, fmt.Errorf("open /etc/resolv.conf file error: %w", err)
 	}
 	defer f.Close()
 
@@ -182,16 +182,13 @@ func searchDomains(log *logger.Context) []string {
 	searchPrefix := "search "
 	for sc.Scan() {
 		if strings.HasPrefix(sc.Text(), searchPrefix) {
-			searchDomains := strings.Split(strings.TrimPrefix(sc.Text(), searchPrefix), " ")
-			log.Warnf("Using search domains: %v", searchDomains)
-			return searchDomains
+			return strings.Split(strings.TrimPrefix(sc.Text(), searchPrefix), " "), nil
 		}
 	}
 	if err := sc.Err(); err != nil {
-		log.Warnf("scan /etc/resolv.conf file error: %v", err)
-		return nil
+		return nil, fmt.Errorf("scan /etc/resolv.conf file error: %w", err)
 	}
-	return nil
+	return nil, nil
 }
 
 func httpServe(ctx context.Context, g *errgroup.Group, ln net.Listener, mux http.Handler) {
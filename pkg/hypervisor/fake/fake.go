@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package fake is an in-process hypervisor backend for tests. It does not run a guest,
+// it drives the state machine the same way vz does and exposes every vsock port as a unix socket,
+// so a fake guest can connect to the host as if it was running inside the virtual machine.
+package fake
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Code-Hex/go-infinity-channel"
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+)
+
+type Backend struct {
+	dir string
+
+	mu  sync.Mutex
+	vms []*VirtualMachine
+}
+
+// New creates a backend whose vsock sockets are stored in dir.
+func New(dir string) *Backend {
+	return &Backend{
+		dir: dir,
+	}
+}
+
+func (b *Backend) NewVirtualMachine(vmC *config.VirtualMachine) (hypervisor.VirtualMachine, error) {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	vm := &VirtualMachine{
+		dir:         b.dir,
+		config:      vmC,
+		stateNotify: infinity.NewChannel[hypervisor.State](),
+	}
+
+	b.mu.Lock()
+	b.vms = append(b.vms, vm)
+	b.mu.Unlock()
+
+	return vm, nil
+}
+
+// VsockPath returns the unix socket that stands for the vsock port. Connecting to it is the same as
+// the guest connecting to the host on that port.
+func (b *Backend) VsockPath(port uint32) string {
+	return vsockPath(b.dir, port)
+}
+
+func vsockPath(dir string, port uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("vsock-%d.sock", port))
+}
+
+// VirtualMachines returns the virtual machines created by the backend, in creation order.
+func (b *Backend) VirtualMachines() []*VirtualMachine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]*VirtualMachine(nil), b.vms...)
+}
+
+// VirtualMachine is a virtual machine without a guest.
+type VirtualMachine struct {
+	dir    string
+	config *config.VirtualMachine
+
+	mu          sync.Mutex
+	state       hypervisor.State
+	stateNotify *infinity.Channel[hypervisor.State]
+
+	// IgnoreRequestStop makes RequestStop succeed without stopping the virtual machine,
+	// like a guest that does not react to the ACPI power button.
+	IgnoreRequestStop bool
+}
+
+// Config returns the configuration the virtual machine was created with.
+func (v *VirtualMachine) Config() *config.VirtualMachine {
+	return v.config
+}
+
+// SetState forces the virtual machine into state, e.g. to simulate a guest crash with hypervisor.StateError.
+func (v *VirtualMachine) SetState(state hypervisor.State) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.setState(state)
+}
+
+func (v *VirtualMachine) setState(states ...hypervisor.State) {
+	for _, state := range states {
+		v.state = state
+		v.stateNotify.In() <- state
+	}
+}
+
+func (v *VirtualMachine) transit(action string, can func(hypervisor.State) bool, states ...hypervisor.State) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !can(v.state) {
+		return fmt.Errorf("can not %s virtual machine in state %s", action, v.state)
+	}
+
+	v.setState(states...)
+
+	return nil
+}
+
+func (v *VirtualMachine) Start() error {
+	return v.transit("start", canStart, hypervisor.StateStarting, hypervisor.StateRunning)
+}
+
+func (v *VirtualMachine) Pause() error {
+	return v.transit("pause", canPause, hypervisor.StatePausing, hypervisor.StatePaused)
+}
+
+func (v *VirtualMachine) Resume() error {
+	return v.transit("resume", canResume, hypervisor.StateResuming, hypervisor.StateRunning)
+}
+
+func (v *VirtualMachine) Stop() error {
+	return v.transit("stop", canStop, hypervisor.StateStopped)
+}
+
+func (v *VirtualMachine) RequestStop() (bool, error) {
+	states := []hypervisor.State{hypervisor.StateStopping, hypervisor.StateStopped}
+	if v.IgnoreRequestStop {
+		states = nil
+	}
+
+	if err := v.transit("request stop", canRequestStop, states...); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (v *VirtualMachine) State() hypervisor.State {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.state
+}
+
+func (v *VirtualMachine) StateChangedNotify() <-chan hypervisor.State {
+	return v.stateNotify.Out()
+}
+
+func (v *VirtualMachine) CanStart() bool {
+	return canStart(v.State())
+}
+
+func (v *VirtualMachine) CanPause() bool {
+	return canPause(v.State())
+}
+
+func (v *VirtualMachine) CanResume() bool {
+	return canResume(v.State())
+}
+
+func (v *VirtualMachine) CanStop() bool {
+	return canStop(v.State())
+}
+
+func (v *VirtualMachine) CanRequestStop() bool {
+	return canRequestStop(v.State())
+}
+
+func canStart(state hypervisor.State) bool {
+	return state == hypervisor.StateStopped || state == hypervisor.StateError
+}
+
+func canPause(state hypervisor.State) bool {
+	return state == hypervisor.StateRunning
+}
+
+func canResume(state hypervisor.State) bool {
+	return state == hypervisor.StatePaused
+}
+
+func canStop(state hypervisor.State) bool {
+	return state == hypervisor.StateRunning || state == hypervisor.StatePaused || state == hypervisor.StateError
+}
+
+func canRequestStop(state hypervisor.State) bool {
+	return state == hypervisor.StateRunning
+}
+
+func (v *VirtualMachine) ListenVsock(port uint32) (net.Listener, error) {
+	p := vsockPath(v.dir, port)
+	if err := os.RemoveAll(p); err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", p)
+}
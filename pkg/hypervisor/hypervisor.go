@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package hypervisor hides the virtual machine implementation behind an interface,
+// so that the orchestration around it does not depend on the Virtualization framework.
+package hypervisor
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/crc-org/vfkit/pkg/config"
+)
+
+// State is the execution state of a virtual machine. The values are the same as vz.VirtualMachineState.
+type State int
+
+const (
+	StateStopped State = iota
+	StateRunning
+	StatePaused
+	StateError
+	StateStarting
+	StatePausing
+	StateResuming
+	StateStopping
+	StateSaving
+	StateRestoring
+)
+
+var stateNames = []string{
+	"VirtualMachineStateStopped",
+	"VirtualMachineStateRunning",
+	"VirtualMachineStatePaused",
+	"VirtualMachineStateError",
+	"VirtualMachineStateStarting",
+	"VirtualMachineStatePausing",
+	"VirtualMachineStateResuming",
+	"VirtualMachineStateStopping",
+	"VirtualMachineStateSaving",
+	"VirtualMachineStateRestoring",
+}
+
+// String returns the same names as vz.VirtualMachineState, they are part of the restful API.
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "VirtualMachineState(" + strconv.Itoa(int(s)) + ")"
+	}
+
+	return stateNames[s]
+}
+
+// VirtualMachine is a virtual machine created by a Backend.
+type VirtualMachine interface {
+	Start() error
+	Pause() error
+	Resume() error
+	Stop() error
+	RequestStop() (bool, error)
+
+	State() State
+	// StateChangedNotify returns the channel that receives every state change. Every call returns the same channel.
+	StateChangedNotify() <-chan State
+
+	CanStart() bool
+	CanPause() bool
+	CanResume() bool
+	CanStop() bool
+	CanRequestStop() bool
+
+	// ListenVsock listens on the vsock port of the virtual machine, accepting the connections started by the guest.
+	ListenVsock(port uint32) (net.Listener, error)
+}
+
+// Backend creates virtual machines from a vfkit configuration.
+type Backend interface {
+	NewVirtualMachine(vmC *config.VirtualMachine) (VirtualMachine, error)
+}
@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin
+
+// Package vzbackend runs virtual machines on the Apple Virtualization framework.
+package vzbackend
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Code-Hex/go-infinity-channel"
+	"github.com/Code-Hex/vz/v3"
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/crc-org/vfkit/pkg/vf"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+)
+
+type Backend struct{}
+
+func New() *Backend {
+	return &Backend{}
+}
+
+func (b *Backend) NewVirtualMachine(vmC *config.VirtualMachine) (hypervisor.VirtualMachine, error) {
+	vzVMConfig, err := vf.ToVzVirtualMachineConfig(vmC)
+	if err != nil {
+		return nil, fmt.Errorf("converting virtual machine config to vz failed: %w", err)
+	}
+
+	vm, err := vz.NewVirtualMachine(vzVMConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating vz virtual machine failed: %w", err)
+	}
+
+	v := &virtualMachine{
+		VirtualMachine: vm,
+		stateNotify:    infinity.NewChannel[hypervisor.State](),
+	}
+
+	go func() {
+		for state := range vm.StateChangedNotify() {
+			v.stateNotify.In() <- hypervisor.State(state)
+		}
+	}()
+
+	return v, nil
+}
+
+type virtualMachine struct {
+	*vz.VirtualMachine
+	stateNotify *infinity.Channel[hypervisor.State]
+}
+
+func (v *virtualMachine) Start() error {
+	return v.VirtualMachine.Start()
+}
+
+func (v *virtualMachine) State() hypervisor.State {
+	return hypervisor.State(v.VirtualMachine.State())
+}
+
+func (v *virtualMachine) StateChangedNotify() <-chan hypervisor.State {
+	return v.stateNotify.Out()
+}
+
+func (v *virtualMachine) ListenVsock(port uint32) (net.Listener, error) {
+	socketDevices := v.SocketDevices()
+	if len(socketDevices) != 1 {
+		return nil, fmt.Errorf("VM has too many/not enough virtio-vsock devices (%d)", len(socketDevices))
+	}
+
+	return socketDevices[0].Listen(port)
+}
@@ -0,0 +1,479 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package client talks to the restful API of a running ovm over its unix socket.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
+	"github.com/oomol-lab/ovm/pkg/ipc/restful"
+)
+
+// apiPrefix is the API version the client speaks.
+const apiPrefix = "/v1"
+
+type Client struct {
+	http     *http.Client
+	endpoint string
+}
+
+// New creates a client for the restful socket at socketPath.
+func New(socketPath string) *Client {
+	return NewWithHTTPClient(&http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}, "http://ovm")
+}
+
+// NewWithHTTPClient creates a client that sends the requests to endpoint with hc,
+// e.g. the client and URL of an httptest.Server.
+func NewWithHTTPClient(hc *http.Client, endpoint string) *Client {
+	return &Client{
+		http:     hc,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+	}
+}
+
+// SocketPath returns the restful socket of the virtual machine name in the socket directory dir.
+func SocketPath(dir, name string) string {
+	return filepath.Join(dir, name+"-restful.sock")
+}
+
+// StatusError is returned when the server answers with a status other than 2xx.
+type StatusError struct {
+	StatusCode int
+	// Code is one of the restful.Code* constants.
+	Code    string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (c *Client) Info(ctx context.Context) (*restful.InfoResponse, error) {
+	var info restful.InfoResponse
+	if err := c.call(ctx, http.MethodGet, "/info", nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (c *Client) State(ctx context.Context) (*restful.StateResponse, error) {
+	return c.state(ctx, http.MethodGet, "/state")
+}
+
+// Pause pauses the virtual machine and returns its resulting state.
+func (c *Client) Pause(ctx context.Context) (*restful.StateResponse, error) {
+	return c.state(ctx, http.MethodPost, "/pause")
+}
+
+// Resume resumes the virtual machine and returns its resulting state.
+func (c *Client) Resume(ctx context.Context) (*restful.StateResponse, error) {
+	return c.state(ctx, http.MethodPost, "/resume")
+}
+
+// RequestStop asks the guest to power off and returns the state of the virtual machine right after asking.
+func (c *Client) RequestStop(ctx context.Context) (*restful.StateResponse, error) {
+	return c.state(ctx, http.MethodPost, "/request-stop")
+}
+
+// Stop stops the virtual machine and returns its resulting state.
+func (c *Client) Stop(ctx context.Context) (*restful.StateResponse, error) {
+	return c.state(ctx, http.MethodPost, "/stop")
+}
+
+func (c *Client) PowerSaveMode(ctx context.Context, enable bool) error {
+	return c.call(ctx, http.MethodPut, "/power-save-mode", &restful.PowerSaveModeBody{Enable: enable}, nil)
+}
+
+// StartJob runs the command in the guest detached from the connection, see Job for its output.
+func (c *Client) StartJob(ctx context.Context, body *restful.ExecBody) (*restful.JobResponse, error) {
+	var job restful.JobResponse
+	if err := c.call(ctx, http.MethodPost, "/jobs", body, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// Jobs returns the running and the retained finished jobs, without their output.
+func (c *Client) Jobs(ctx context.Context) ([]restful.JobResponse, error) {
+	var jobs []restful.JobResponse
+	if err := c.call(ctx, http.MethodGet, "/jobs", nil, &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// Job returns the job with its buffered output after offset.
+func (c *Client) Job(ctx context.Context, id string, offset int64) (*restful.JobResponse, error) {
+	var job restful.JobResponse
+	uri := fmt.Sprintf("/jobs/%s?offset=%d", url.PathEscape(id), offset)
+	if err := c.call(ctx, http.MethodGet, uri, nil, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// DeleteJob sends signal (e.g. "TERM", empty for the default) to a running job, or removes a finished job.
+func (c *Client) DeleteJob(ctx context.Context, id, signal string) (*restful.JobResponse, error) {
+	var job restful.JobResponse
+	uri := fmt.Sprintf("/jobs/%s?signal=%s", url.PathEscape(id), url.QueryEscape(signal))
+	if err := c.call(ctx, http.MethodDelete, uri, nil, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// File is the content of a guest file returned by Download.
+type File struct {
+	io.ReadCloser
+	// Size is -1 for an archive, its size is not known up front.
+	Size int64
+	// Mode is the permission bits of the file, it is 0 for an archive.
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// Download returns the content of the guest file at path, or a tar archive of path when archive is true.
+// The caller must close the returned file.
+func (c *Client) Download(ctx context.Context, path string, archive bool) (*File, error) {
+	resp, err := c.do(ctx, http.MethodGet, filesURI(path, archive, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		ReadCloser: resp.Body,
+		Size:       resp.ContentLength,
+	}
+
+	if m := resp.Header.Get(restful.HeaderFileMode); m != "" {
+		mode, err := restful.ParseMode(m)
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("invalid %s header: %w", restful.HeaderFileMode, err)
+		}
+		f.Mode = mode
+	}
+
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		f.ModTime = t
+	}
+
+	return f, nil
+}
+
+// UploadOptions are the options of Upload.
+type UploadOptions struct {
+	// Mode is the mode of the uploaded file. 0 keeps the mode of the replaced file, or 0644 for a new one.
+	Mode os.FileMode
+	// Parents creates the missing parent directories of path.
+	Parents bool
+	// Archive extracts r, a tar archive, into the directory path instead of writing r to path.
+	Archive bool
+}
+
+// Upload writes r to the guest file at path, replacing the file once r is fully written.
+func (c *Client) Upload(ctx context.Context, path string, r io.Reader, opts *UploadOptions) (*restful.FileResponse, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+
+	q := url.Values{}
+	if opts.Mode != 0 {
+		q.Set("mode", restful.FormatMode(opts.Mode))
+	}
+	if opts.Parents {
+		q.Set("parents", "true")
+	}
+
+	var resp restful.FileResponse
+	if err := c.call(ctx, http.MethodPut, filesURI(path, opts.Archive, q), r, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func filesURI(path string, archive bool, q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+
+	q.Set("path", path)
+	if archive {
+		q.Set("archive", restful.ArchiveTar)
+	}
+
+	return "/files?" + q.Encode()
+}
+
+// ExecEvent is one server-sent event of /exec.
+type ExecEvent struct {
+	// Name is restful.ExecEventStdout, restful.ExecEventStderr or restful.ExecEventExit.
+	Name string
+	// Output is set for the stdout and stderr events.
+	Output *restful.ExecOutput
+	// Exit is set for the exit event.
+	Exit *restful.ExecExit
+	// Err is set on the last event when the stream ended before the exit event. Name is empty then.
+	Err error
+}
+
+// Exec runs the command in the guest. The events are sent to the returned channel,
+// which is closed after the exit event, when the stream ends or when ctx is done.
+func (c *Client) Exec(ctx context.Context, body *restful.ExecBody) (<-chan ExecEvent, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/exec", body)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan ExecEvent)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+
+		send := func(e ExecEvent) bool {
+			select {
+			case ch <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		err := readSSE(resp.Body, func(name, data string) bool {
+			e := ExecEvent{Name: name}
+
+			var err error
+			switch name {
+			case restful.ExecEventStdout, restful.ExecEventStderr:
+				e.Output = &restful.ExecOutput{}
+				err = json.Unmarshal([]byte(data), e.Output)
+			case restful.ExecEventExit:
+				e.Exit = &restful.ExecExit{}
+				err = json.Unmarshal([]byte(data), e.Exit)
+			default:
+				return true
+			}
+
+			if err != nil {
+				send(ExecEvent{Err: fmt.Errorf("decode %s event error: %w", name, err)})
+				return false
+			}
+
+			return send(e) && name != restful.ExecEventExit
+		})
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("stream closed before the command finished")
+		}
+		if err != nil && ctx.Err() == nil {
+			send(ExecEvent{Err: err})
+		}
+	}()
+
+	return ch, nil
+}
+
+// EventMessage is one event received by Events.
+type EventMessage struct {
+	Event *event.Event
+	// Err is set on the last message when the stream ended before the exit event. Event is nil then.
+	Err error
+}
+
+// Events follows the events of ovm, starting with the kept events after lastID, 0 for all of them.
+// The returned channel is closed after the exit event, when the stream ends or when ctx is done.
+// A stream that ends early, e.g. because the client fell behind, can be resumed with the ID of the last event.
+func (c *Client) Events(ctx context.Context, lastID uint64) (<-chan EventMessage, error) {
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/events?lastEventId=%d", lastID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan EventMessage)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+
+		send := func(m EventMessage) bool {
+			select {
+			case ch <- m:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		err := readSSE(resp.Body, func(name, data string) bool {
+			var e event.Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				send(EventMessage{Err: fmt.Errorf("decode %s event error: %w", name, err)})
+				return false
+			}
+
+			return send(EventMessage{Event: &e}) && e.Type != event.TypeExit
+		})
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("event stream closed before the exit event")
+		}
+		if err != nil && ctx.Err() == nil {
+			send(EventMessage{Err: err})
+		}
+	}()
+
+	return ch, nil
+}
+
+// EventStats returns the delivery statistics of the event destinations.
+func (c *Client) EventStats(ctx context.Context) (*restful.EventStatsResponse, error) {
+	var stats restful.EventStatsResponse
+	if err := c.call(ctx, http.MethodGet, "/events/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// do sends the request. A body that is an io.Reader is sent as is, any other body is encoded as JSON.
+func (c *Client) do(ctx context.Context, method, uri string, body any) (*http.Response, error) {
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r, contentType = b, "application/octet-stream"
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r, contentType = bytes.NewReader(data), "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+apiPrefix+uri, r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s error: %w", method, uri, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("%s %s error: %w", method, uri, statusError(resp))
+	}
+
+	return resp, nil
+}
+
+func statusError(resp *http.Response) *StatusError {
+	msg, _ := io.ReadAll(resp.Body)
+
+	var e restful.ErrorResponse
+	if err := json.Unmarshal(msg, &e); err != nil || e.Code == "" {
+		// not an API error, e.g. a proxy in between
+		e.Message = strings.TrimSpace(string(msg))
+	}
+
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Code:       e.Code,
+		Message:    e.Message,
+	}
+}
+
+// call sends the request and decodes the response into v, unless v is nil.
+func (c *Client) call(ctx context.Context, method, uri string, body, v any) error {
+	resp, err := c.do(ctx, method, uri, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode %s response error: %w", uri, err)
+	}
+
+	return nil
+}
+
+func (c *Client) state(ctx context.Context, method, uri string) (*restful.StateResponse, error) {
+	var state restful.StateResponse
+	if err := c.call(ctx, method, uri, nil, &state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// readSSE calls fn for every server-sent event until fn returns false or the stream ends.
+// It returns io.ErrUnexpectedEOF when the stream ends before fn returned false.
+func readSSE(r io.Reader, fn func(event, data string) bool) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var event string
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case line == "":
+			if event == "" && data == nil {
+				continue
+			}
+
+			if !fn(event, strings.Join(data, "\n")) {
+				return nil
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// comment, e.g. ping
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,289 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/hypervisor/fake"
+	"github.com/oomol-lab/ovm/pkg/ipc/restful"
+	"github.com/oomol-lab/ovm/pkg/logger"
+	"github.com/oomol-lab/ovm/pkg/testing/fakeguest"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+type testServer struct {
+	client *Client
+	vm     *fake.VirtualMachine
+	opt    *cli.Context
+}
+
+// newTestServer serves the API of a running fake virtual machine, whose sshd is a fakeguest.SSHServer.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	vm, err := fake.New(t.TempDir()).NewVirtualMachine(&config.VirtualMachine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeVM := vm.(*fake.VirtualMachine)
+	if err := fakeVM.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := logger.NewWithoutManage(t.TempDir(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(log.Close)
+
+	hostKey, clientKey := newSigner(t), newSigner(t)
+	sshd, err := fakeguest.NewSSHServer(hostKey, clientKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sshd.Close()
+	})
+
+	opt := &cli.Context{
+		SSHSigner:  clientKey,
+		SSHHostKey: hostKey.PublicKey(),
+		SSHPort:    sshd.Port(),
+	}
+
+	server := httptest.NewServer(restful.New(fakeVM, nil, log, opt, nil).Handler())
+	t.Cleanup(server.Close)
+
+	return &testServer{
+		client: NewWithHTTPClient(server.Client(), server.URL),
+		vm:     fakeVM,
+		opt:    opt,
+	}
+}
+
+func wantStatusError(t *testing.T, err error, status int, code string) {
+	t.Helper()
+
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != status || serr.Code != code {
+		t.Errorf("error = %v, want %d %s", err, status, code)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	s := newTestServer(t)
+
+	info, err := s.client.Info(context.Background())
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+
+	if info.SSHPort != s.opt.SSHPort || info.SSHUser != "root" {
+		t.Errorf("ssh = %s@%d, want root@%d", info.SSHUser, info.SSHPort, s.opt.SSHPort)
+	}
+	if want := ssh.FingerprintSHA256(s.opt.SSHHostKey); info.SSHHostKeyFingerprint != want {
+		t.Errorf("host key fingerprint = %s, want %s", info.SSHHostKeyFingerprint, want)
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	steps := []struct {
+		name string
+		do   func() (*restful.StateResponse, error)
+		want string
+	}{
+		{name: "state", do: func() (*restful.StateResponse, error) { return s.client.State(ctx) }, want: "VirtualMachineStateRunning"},
+		{name: "pause", do: func() (*restful.StateResponse, error) { return s.client.Pause(ctx) }, want: "VirtualMachineStatePaused"},
+		{name: "resume", do: func() (*restful.StateResponse, error) { return s.client.Resume(ctx) }, want: "VirtualMachineStateRunning"},
+		{name: "request stop", do: func() (*restful.StateResponse, error) { return s.client.RequestStop(ctx) }, want: "VirtualMachineStateStopped"},
+	}
+
+	for _, step := range steps {
+		state, err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if state.State != step.want {
+			t.Errorf("%s: state = %s, want %s", step.name, state.State, step.want)
+		}
+	}
+
+	state, err := s.client.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.CanStart || state.CanPause || state.CanStop {
+		t.Errorf("stopped state = %+v, want it to only start", state)
+	}
+
+	_, err = s.client.Resume(ctx)
+	wantStatusError(t, err, http.StatusConflict, restful.CodeInvalidState)
+
+	_, err = s.client.Stop(ctx)
+	wantStatusError(t, err, http.StatusConflict, restful.CodeInvalidState)
+
+	if err := s.vm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := s.client.Stop(ctx); err != nil || state.State != "VirtualMachineStateStopped" {
+		t.Errorf("Stop = %+v, %v, want stopped", state, err)
+	}
+}
+
+func TestPowerSaveMode(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, enable := range []bool{true, false} {
+		if err := s.client.PowerSaveMode(context.Background(), enable); err != nil {
+			t.Fatalf("PowerSaveMode(%v): %v", enable, err)
+		}
+		if s.opt.PowerSaveMode != enable {
+			t.Errorf("PowerSaveMode = %v, want %v", s.opt.PowerSaveMode, enable)
+		}
+	}
+}
+
+// collect returns the output and the exit of the exec events.
+func collect(t *testing.T, events <-chan ExecEvent) (stdout, stderr string, exit *restful.ExecExit) {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return stdout, stderr, exit
+			}
+			if e.Err != nil {
+				t.Fatalf("exec event error: %v", e.Err)
+			}
+
+			switch e.Name {
+			case restful.ExecEventStdout, restful.ExecEventStderr:
+				b, err := e.Output.Bytes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Name == restful.ExecEventStdout {
+					stdout += string(b)
+				} else {
+					stderr += string(b)
+				}
+			case restful.ExecEventExit:
+				exit = e.Exit
+			}
+		case <-timeout:
+			t.Fatal("exec did not finish")
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       *restful.ExecBody
+		wantStdout string
+		wantStderr string
+		wantCode   int
+	}{
+		{
+			name:       "stdin",
+			body:       &restful.ExecBody{Command: "cat", Stdin: []byte("\x00binary\xff")},
+			wantStdout: "\x00binary\xff",
+		},
+		{
+			name:       "compound command",
+			body:       &restful.ExecBody{Command: "echo a && echo b"},
+			wantStdout: "a\nb\n",
+		},
+		{
+			name:       "env and cwd",
+			body:       &restful.ExecBody{Command: "echo \"$A $B\" && pwd", Env: map[string]string{"B": "it's", "A": "1"}, Cwd: "/"},
+			wantStdout: "1 it's\n/\n",
+		},
+		{
+			name:       "exit code",
+			body:       &restful.ExecBody{Command: "echo failed >&2; exit 3"},
+			wantStderr: "failed\n",
+			wantCode:   3,
+		},
+	}
+
+	s := newTestServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := s.client.Exec(context.Background(), tt.body)
+			if err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+
+			stdout, stderr, exit := collect(t, events)
+			if stdout != tt.wantStdout || stderr != tt.wantStderr {
+				t.Errorf("stdout = %q, stderr = %q, want %q, %q", stdout, stderr, tt.wantStdout, tt.wantStderr)
+			}
+			if exit == nil {
+				t.Fatal("no exit event")
+			}
+			if exit.Code != tt.wantCode || (exit.Error == "") != (tt.wantCode == 0) {
+				t.Errorf("exit = %+v, want code %d", exit, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	for _, body := range []*restful.ExecBody{
+		{Command: " "},
+		{Command: "true", TimeoutSeconds: -1},
+		{Command: "true", Env: map[string]string{"NOT-A-NAME": "1"}},
+	} {
+		_, err := s.client.Exec(ctx, body)
+		wantStatusError(t, err, http.StatusBadRequest, restful.CodeBadRequest)
+	}
+
+	// the command can not be started without sshd, the exit event tells why
+	s.opt.SSHPort = 1
+	events, err := s.client.Exec(ctx, &restful.ExecBody{Command: "true"})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	_, _, exit := collect(t, events)
+	if exit == nil || exit.Code != -1 || !strings.Contains(exit.Error, "dial ssh error") {
+		t.Errorf("exit = %+v, want code -1 with a dial error", exit)
+	}
+}
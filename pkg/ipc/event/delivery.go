@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package event
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/logger"
+)
+
+const (
+	// queueSize is the number of events waiting for delivery before the oldest one is dropped.
+	queueSize = 256
+	// maxAttempts is how often an event is sent before it is given up.
+	maxAttempts = 8
+)
+
+// The delays of the delivery, variables so that the tests do not wait for them.
+var (
+	// retryBase is the wait after the first failed attempt, it doubles with every attempt up to retryMax.
+	retryBase = 100 * time.Millisecond
+	retryMax  = 3 * time.Second
+	// flushTimeout is how long NotifyExit waits for the queued events to be delivered.
+	flushTimeout = 3 * time.Second
+)
+
+// Stats is the delivery statistics of one event destination.
+type Stats struct {
+	// Sink is the destination, e.g. unix:/tmp/ovm-event.sock, file:/var/log/ovm/ovm-events.jsonl or stdout.
+	Sink string `json:"sink"`
+	// Queued is the number of events waiting for delivery.
+	Queued    int    `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	// Retries counts the failed attempts that were tried again.
+	Retries uint64 `json:"retries"`
+	// Failed counts the events given up after maxAttempts attempts or at the flush deadline.
+	Failed uint64 `json:"failed"`
+	// Dropped counts the events dropped from the full queue or still queued at the flush deadline.
+	Dropped          uint64     `json:"dropped"`
+	LastDeliveredSeq uint64     `json:"lastDeliveredSeq"`
+	LastError        string     `json:"lastError,omitempty"`
+	LastErrorAt      *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// delivery sends the events to one destination, one at a time and in order. A failed event is sent again
+// with exponential backoff before the next one, up to maxAttempts times. When the queue is full,
+// the oldest queued event is dropped, so the exit event is never lost to an unreachable destination.
+type delivery struct {
+	log  *logger.Context
+	sink *sink
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wake is signaled when an event is queued.
+	wake chan struct{}
+	// done is closed when the exit event has been handled or the delivery was canceled.
+	done chan struct{}
+
+	mu    sync.Mutex
+	queue []*Event
+	stats Stats
+}
+
+func newDelivery(s *sink, log *logger.Context) *delivery {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &delivery{
+		log:    log,
+		sink:   s,
+		ctx:    ctx,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		stats:  Stats{Sink: s.name},
+	}
+
+	go d.run()
+
+	return d
+}
+
+func (d *delivery) push(ev Event) {
+	d.mu.Lock()
+	if len(d.queue) == queueSize {
+		dropped := d.queue[0]
+		d.queue = d.queue[1:]
+		d.stats.Dropped++
+		d.log.Warnf("event queue of %s is full, dropping %s event %d", d.stats.Sink, dropped.Type, dropped.Seq)
+	}
+	d.queue = append(d.queue, &ev)
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *delivery) run() {
+	defer close(d.done)
+
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+
+			select {
+			case <-d.wake:
+				continue
+			case <-d.ctx.Done():
+				return
+			}
+		}
+
+		ev := d.queue[0]
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+
+		d.deliver(ev)
+
+		if ev.Type == TypeExit || d.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// deliver sends ev until it succeeds, maxAttempts attempts failed or the delivery is canceled.
+func (d *delivery) deliver(ev *Event) {
+	for attempt := 1; ; attempt++ {
+		err := d.sink.send(d.ctx, ev)
+
+		d.mu.Lock()
+		if err == nil {
+			d.stats.Delivered++
+			d.stats.LastDeliveredSeq = ev.Seq
+			d.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		d.stats.LastError = err.Error()
+		d.stats.LastErrorAt = &now
+
+		if attempt == maxAttempts || d.ctx.Err() != nil {
+			d.stats.Failed++
+			d.mu.Unlock()
+			d.log.Warnf("notify %s event %d to %s failed after %d attempts: %v", ev.Type, ev.Seq, d.stats.Sink, attempt, err)
+			return
+		}
+
+		d.stats.Retries++
+		d.mu.Unlock()
+
+		wait := min(retryBase<<(attempt-1), retryMax)
+		d.log.Warnf("notify %s event %d to %s failed, retrying in %s: %v", ev.Type, ev.Seq, d.stats.Sink, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-d.ctx.Done():
+		}
+	}
+}
+
+// flush waits until the exit event has been handled and closes the sink. When ctx is done first,
+// the event being sent is given up and the queued ones are dropped.
+func (d *delivery) flush(ctx context.Context) {
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		d.cancel()
+		<-d.done
+
+		d.mu.Lock()
+		d.stats.Dropped += uint64(len(d.queue))
+		d.queue = nil
+		d.mu.Unlock()
+
+		d.log.Warnf("event delivery to %s did not finish in %s", d.stats.Sink, flushTimeout)
+	}
+
+	d.cancel()
+
+	if d.sink.close != nil {
+		if err := d.sink.close(); err != nil {
+			d.log.Warnf("close event sink %s failed: %v", d.stats.Sink, err)
+		}
+	}
+
+	s := d.snapshot()
+	d.log.Infof("event delivery to %s: delivered %d, retries %d, failed %d, dropped %d", s.Sink, s.Delivered, s.Retries, s.Failed, s.Dropped)
+}
+
+func (d *delivery) snapshot() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.stats
+	s.Queued = len(d.queue)
+
+	return s
+}
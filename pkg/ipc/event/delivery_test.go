@@ -0,0 +1,296 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/logger"
+)
+
+// fakeSink fails the first failures attempts to send. While block is not nil, every attempt waits for it
+// to be closed or for the delivery to give up.
+type fakeSink struct {
+	mu        sync.Mutex
+	failures  int
+	block     chan struct{}
+	attempts  []time.Time
+	delivered []*Event
+	closed    bool
+}
+
+func (f *fakeSink) sink() *sink {
+	return &sink{name: "fake", send: f.send, close: f.close}
+}
+
+func (f *fakeSink) send(ctx context.Context, ev *Event) error {
+	f.mu.Lock()
+	f.attempts = append(f.attempts, time.Now())
+	block := f.block
+	f.mu.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("sink is down")
+	}
+	f.delivered = append(f.delivered, ev)
+
+	return nil
+}
+
+func (f *fakeSink) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+func (f *fakeSink) attemptCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.attempts)
+}
+
+func (f *fakeSink) seqs() []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(f.delivered))
+	for _, ev := range f.delivered {
+		seqs = append(seqs, ev.Seq)
+	}
+
+	return seqs
+}
+
+// newTestContext returns a Context delivering to sinks.
+func newTestContext(t *testing.T, sinks ...*fakeSink) *Context {
+	t.Helper()
+
+	log, err := logger.NewWithoutManage(t.TempDir(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(log.Close)
+
+	e := &Context{
+		log:         log,
+		vm:          "test",
+		subscribers: make(map[chan Event]struct{}),
+		prepare:     make(map[string]prepareProgress),
+	}
+	for _, s := range sinks {
+		e.deliveries = append(e.deliveries, newDelivery(s.sink(), log))
+	}
+
+	return e
+}
+
+// shortDelays shortens the retry delays for the test.
+func shortDelays(t *testing.T) {
+	t.Helper()
+
+	base, max := retryBase, retryMax
+	retryBase, retryMax = 5*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() {
+		retryBase, retryMax = base, max
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in 5s")
+		}
+	}
+}
+
+func seqRange(from, to uint64) []uint64 {
+	seqs := []uint64{}
+	for seq := from; seq <= to; seq++ {
+		seqs = append(seqs, seq)
+	}
+
+	return seqs
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	shortDelays(t)
+
+	tests := []struct {
+		name          string
+		failures      int
+		wantDelivered []uint64
+		wantRetries   uint64
+		wantFailed    uint64
+	}{
+		{name: "no failure", failures: 0, wantDelivered: seqRange(1, 4)},
+		{name: "retried", failures: 3, wantDelivered: seqRange(1, 4), wantRetries: 3},
+		{name: "last attempt", failures: maxAttempts - 1, wantDelivered: seqRange(1, 4), wantRetries: maxAttempts - 1},
+		{name: "given up", failures: maxAttempts, wantDelivered: seqRange(2, 4), wantRetries: maxAttempts - 1, wantFailed: 1},
+		{name: "two given up", failures: 2*maxAttempts + 1, wantDelivered: seqRange(3, 4), wantRetries: 2*maxAttempts - 1, wantFailed: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeSink{failures: tt.failures}
+			e := newTestContext(t, fs)
+
+			for i := 0; i < 3; i++ {
+				e.NotifyApp(Preparing)
+			}
+			e.NotifyExit()
+
+			if got := fs.seqs(); fmt.Sprint(got) != fmt.Sprint(tt.wantDelivered) {
+				t.Errorf("delivered = %v, want %v", got, tt.wantDelivered)
+			}
+
+			stats := e.Stats()[0]
+			if stats.Delivered != uint64(len(tt.wantDelivered)) || stats.Retries != tt.wantRetries || stats.Failed != tt.wantFailed || stats.Dropped != 0 {
+				t.Errorf("stats = %+v, want %d delivered, %d retries, %d failed", stats, len(tt.wantDelivered), tt.wantRetries, tt.wantFailed)
+			}
+			if stats.LastDeliveredSeq != 4 {
+				t.Errorf("last delivered = %d, want the exit event", stats.LastDeliveredSeq)
+			}
+			if (stats.LastError != "") != (tt.failures != 0) {
+				t.Errorf("last error = %q after %d failures", stats.LastError, tt.failures)
+			}
+			if !fs.closed {
+				t.Error("the sink was not closed")
+			}
+		})
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	shortDelays(t)
+
+	fs := &fakeSink{failures: maxAttempts}
+	e := newTestContext(t, fs)
+	e.NotifyExit()
+
+	if len(fs.attempts) != maxAttempts {
+		t.Fatalf("attempts = %d, want %d", len(fs.attempts), maxAttempts)
+	}
+
+	// the wait doubles after every failed attempt, up to retryMax
+	want := retryBase
+	for i := 1; i < len(fs.attempts); i++ {
+		if wait := fs.attempts[i].Sub(fs.attempts[i-1]); wait < want {
+			t.Errorf("wait before attempt %d = %s, want at least %s", i+1, wait, want)
+		}
+		want = min(want*2, retryMax)
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	shortDelays(t)
+
+	up, slow, down := &fakeSink{}, &fakeSink{failures: 5}, &fakeSink{failures: 1000}
+	e := newTestContext(t, up, slow, down)
+
+	for i := 0; i < 50; i++ {
+		e.NotifyApp(Preparing)
+	}
+	e.NotifyExit()
+
+	for _, fs := range []*fakeSink{up, slow} {
+		if got := fs.seqs(); fmt.Sprint(got) != fmt.Sprint(seqRange(1, 51)) {
+			t.Errorf("delivered = %v, want every event in order", got)
+		}
+	}
+
+	// a sink that is down does not hold up the others
+	stats := e.Stats()
+	if stats[0].Delivered != 51 || stats[1].Delivered != 51 {
+		t.Errorf("stats = %+v, want every event delivered to the sinks that are up", stats)
+	}
+	if s := stats[2]; s.Delivered != 0 || s.Failed+s.Dropped != 51 {
+		t.Errorf("stats of the sink that is down = %+v, want every event failed or dropped", s)
+	}
+}
+
+func TestDeliveryOverflow(t *testing.T) {
+	fs := &fakeSink{block: make(chan struct{})}
+	e := newTestContext(t, fs)
+
+	const events = queueSize + 100
+	e.NotifyApp(Preparing)
+	waitFor(t, func() bool { return fs.attemptCount() == 1 })
+	for i := 1; i < events; i++ {
+		e.NotifyApp(Preparing)
+	}
+
+	// the first event is being sent, the queue keeps the newest queueSize of the others
+	stats := e.Stats()[0]
+	if stats.Queued != queueSize || stats.Dropped != events-1-queueSize {
+		t.Errorf("stats = %+v, want %d queued and %d dropped", stats, queueSize, events-1-queueSize)
+	}
+
+	close(fs.block)
+	waitFor(t, func() bool { return e.Stats()[0].Queued == 0 })
+	e.NotifyExit()
+
+	want := append([]uint64{1}, seqRange(events-queueSize+1, events+1)...)
+	if got := fs.seqs(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delivered = %v, want the first, the newest and the exit event", got)
+	}
+
+	stats = e.Stats()[0]
+	if stats.Queued != 0 || stats.Delivered != uint64(len(want)) || stats.Dropped != events-1-queueSize {
+		t.Errorf("stats = %+v, want %d delivered and %d dropped", stats, len(want), events-1-queueSize)
+	}
+}
+
+func TestDeliveryFlushTimeout(t *testing.T) {
+	fs := &fakeSink{block: make(chan struct{})}
+	e := newTestContext(t, fs)
+
+	for i := 0; i < 10; i++ {
+		e.NotifyApp(Preparing)
+	}
+
+	start := time.Now()
+	e.NotifyExit()
+	if elapsed := time.Since(start); elapsed < flushTimeout || elapsed > flushTimeout+time.Second {
+		t.Errorf("NotifyExit took %s, want the flush timeout of %s", elapsed, flushTimeout)
+	}
+
+	// the event being sent failed, the queued ones and the exit event are dropped
+	stats := e.Stats()[0]
+	if stats.Delivered != 0 || stats.Failed != 1 || stats.Dropped != 10 || stats.Queued != 0 {
+		t.Errorf("stats = %+v, want 1 failed and 10 dropped", stats)
+	}
+	if !fs.closed {
+		t.Error("the sink was not closed")
+	}
+
+	// the events after the exit are not sent
+	e.NotifyApp(Ready)
+	close(fs.block)
+	time.Sleep(50 * time.Millisecond)
+	if got := fs.seqs(); len(got) != 0 {
+		t.Errorf("delivered = %v after the exit, want none", got)
+	}
+}
@@ -5,14 +5,13 @@ package event
 
 import (
 	"context"
-	"fmt"
-	"net"
-	"net/http"
-	"net/url"
+	"encoding/json"
+	"errors"
+	"sync"
 	"time"
 
-	"github.com/Code-Hex/go-infinity-channel"
 	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
 	"github.com/oomol-lab/ovm/pkg/logger"
 )
 
@@ -24,9 +23,28 @@ const (
 	kExit  key = "exit"
 )
 
+// The types of Event.
+const (
+	TypeApp   = string(kApp)
+	TypeError = string(kError)
+	TypeExit  = string(kExit)
+)
+
+// SchemaVersion is the version of the JSON format of Event. It changes when a field is removed or changes its meaning.
+const SchemaVersion = 1
+
+// The formats of the events sent to the unix socket and HTTP sinks. The file and stdout sinks always write JSON lines.
+const (
+	// FormatQuery sends GET /notify?event=TYPE&message=MESSAGE.
+	FormatQuery = "query"
+	// FormatJSON sends POST /notify with the Event as JSON body.
+	FormatJSON = "json"
+)
+
 type app string
 
 const (
+	Preparing        app = "Preparing"
 	Initializing     app = "Initializing"
 	GVProxyReady     app = "GVProxyReady"
 	IgnitionProgress app = "IgnitionProgress"
@@ -34,106 +52,293 @@ const (
 	Ready            app = "Ready"
 )
 
-type datum struct {
-	name    key
-	message string
+const (
+	// historySize is the number of events kept for the replay of Subscribe.
+	historySize = 512
+	// subscriberBuffer is how far a subscriber may fall behind before it is dropped.
+	subscriberBuffer = 64
+	// drainTimeout is how long NotifyExit waits for the subscribers to receive the exit event.
+	drainTimeout = time.Second
+)
+
+// Event is one notification of an ovm instance.
+type Event struct {
+	Version int `json:"version"`
+	// Seq starts at 1 and increases by one with every event.
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	// VM is the name of the virtual machine.
+	VM string `json:"vm"`
+	// Type is app, error, exit or one of the lifecycle types, e.g. state.
+	Type string `json:"type"`
+	// Phase is the latest app phase, e.g. the one an error occurred in. Empty before the first app event.
+	Phase string `json:"phase,omitempty"`
+	// Message is the app phase for app events and the error for error events, as in the query format.
+	Message string `json:"message,omitempty"`
+	// Data depends on Type, see ErrorData, ShutdownData and the other *Data types.
+	Data json.RawMessage `json:"data,omitempty"`
 }
 
-type event struct {
-	client  *http.Client
-	log     *logger.Context
-	channel *infinity.Channel[*datum]
+// ErrorData is the Data of error events.
+type ErrorData struct {
+	// Code is the name of the errcode.Code of the error, ExitCode the exit code of ovm for it.
+	Code     string `json:"code"`
+	ExitCode int    `json:"exitCode"`
+	// Cause is the innermost error.
+	Cause string `json:"cause"`
 }
 
-var e *event
+// Context sends the events of one ovm instance to the sinks and to the subscribers.
+// A nil *Context is valid, all notifications are dropped.
+type Context struct {
+	log *logger.Context
+	vm  string
 
-// see: https://github.com/Code-Hex/go-infinity-channel/issues/1
-var waitDone = make(chan struct{})
+	// deliveries send the events to the sinks, one per sink.
+	deliveries []*delivery
 
-func Setup(opt *cli.Context) error {
-	log, err := logger.New(opt.LogPath, opt.Name+"-event")
+	mu          sync.Mutex
+	lastID      uint64
+	phase       string
+	shutdown    *ShutdownData
+	prepare     map[string]prepareProgress
+	history     []Event
+	subscribers map[chan Event]struct{}
+	exited      bool
+
+	// streaming counts the subscriptions that have not been canceled yet.
+	streaming sync.WaitGroup
+}
+
+// New opens the sinks and starts the delivery to them. Without sinks the events are only kept for the subscribers.
+func New(opt *cli.Context) (*Context, error) {
+	log, err := opt.Loggers.New(opt.LogPath, opt.Name+"-event")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if opt.EventSocketPath == "" {
-		log.Info("no socket path, event will not be sent")
-		return nil
+	e := &Context{
+		log:         log,
+		vm:          opt.Name,
+		subscribers: make(map[chan Event]struct{}),
+		prepare:     make(map[string]prepareProgress),
 	}
 
-	c := &http.Client{
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				var d net.Dialer
-				return d.DialContext(ctx, "unix", opt.EventSocketPath)
-			},
-		},
-		Timeout: 200 * time.Millisecond,
+	sinks := make([]*sink, 0, len(opt.EventSinks))
+	for _, es := range opt.EventSinks {
+		sk, err := newSink(es, opt.EventFormat, log)
+		if err != nil {
+			for _, opened := range sinks {
+				if opened.close != nil {
+					_ = opened.close()
+				}
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sk)
 	}
 
-	e = &event{
-		client:  c,
-		log:     log,
-		channel: infinity.NewChannel[*datum](),
+	if len(sinks) == 0 {
+		log.Info("no event sinks, events are only served on the restful socket")
 	}
 
-	go func() {
-		for datum := range e.channel.Out() {
-			uri := fmt.Sprintf("http://ovm/notify?event=%s&message=%s", datum.name, url.QueryEscape(datum.message))
-			e.log.Infof("notify %s event to %s", datum.name, uri)
-
-			if resp, err := e.client.Get(uri); err != nil {
-				e.log.Warnf("notify %+v event failed: %v", *datum, err)
-			} else {
-				_ = resp.Body.Close()
-				if resp.StatusCode != http.StatusOK {
-					e.log.Warnf("notify %+v event failed, status code is: %d", *datum, resp.StatusCode)
-				}
-			}
+	for _, sk := range sinks {
+		log.Infof("sending events to %s", sk.name)
+		e.deliveries = append(e.deliveries, newDelivery(sk, log))
+	}
 
-			if datum.name == kExit {
-				waitDone <- struct{}{}
-				return
-			}
-		}
-	}()
+	return e, nil
+}
+
+// Stats returns the delivery statistics of the sinks.
+func (e *Context) Stats() []Stats {
+	stats := []Stats{}
+	if e == nil {
+		return stats
+	}
 
-	return nil
+	for _, d := range e.deliveries {
+		stats = append(stats, d.snapshot())
+	}
+
+	return stats
 }
 
-func NotifyApp(name app) {
+func (e *Context) NotifyApp(name app) {
 	if e == nil {
 		return
 	}
 
-	e.channel.In() <- &datum{
-		name:    kApp,
-		message: string(name),
-	}
+	e.notify(kApp, string(name), nil)
 }
 
-func NotifyError(err error) {
+// NotifyError sends the error with its errcode.Code and its innermost cause.
+func (e *Context) NotifyError(err error) {
 	if e == nil {
 		return
 	}
 
-	e.channel.In() <- &datum{
-		name:    kError,
-		message: err.Error(),
+	code := errcode.Of(err)
+	data := ErrorData{Code: code.Name, ExitCode: code.Exit, Cause: err.Error()}
+
+	for cause := errors.Unwrap(err); cause != nil; cause = errors.Unwrap(cause) {
+		data.Cause = cause.Error()
 	}
+
+	e.notify(kError, err.Error(), data)
 }
 
-func NotifyExit() {
+// NotifyExit sends the exit event and waits, for up to drainTimeout, until the subscribers have received it
+// and, for up to flushTimeout, until the queued events have been delivered to the sinks.
+// The subscriptions end after the exit event.
+func (e *Context) NotifyExit() {
 	if e == nil {
 		return
 	}
 
-	e.channel.In() <- &datum{
-		name:    kExit,
-		message: "",
+	e.mu.Lock()
+	shutdown := e.shutdown
+	e.mu.Unlock()
+
+	if shutdown != nil {
+		e.notify(kExit, "", shutdown)
+	} else {
+		e.notify(kExit, "", nil)
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		e.streaming.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		e.log.Warnf("event subscribers did not receive the exit event in %s", drainTimeout)
 	}
 
-	<-waitDone
-	close(waitDone)
-	e.channel.Close()
+	var wg sync.WaitGroup
+	for _, d := range e.deliveries {
+		wg.Add(1)
+		go func(d *delivery) {
+			defer wg.Done()
+			d.flush(flushCtx)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (e *Context) notify(name key, message string, data any) {
+	var raw json.RawMessage
+	if data != nil {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			e.log.Warnf("encode data of %s event failed: %v", name, err)
+		}
+	}
+
+	e.mu.Lock()
+
+	if name == kApp {
+		e.phase = message
+	}
+
+	e.lastID++
+	ev := Event{
+		Version:   SchemaVersion,
+		Seq:       e.lastID,
+		Timestamp: time.Now(),
+		VM:        e.vm,
+		Type:      string(name),
+		Phase:     e.phase,
+		Message:   message,
+		Data:      raw,
+	}
+
+	if len(e.history) == historySize {
+		e.history = e.history[1:]
+	}
+	e.history = append(e.history, ev)
+
+	for sub := range e.subscribers {
+		select {
+		case sub <- ev:
+		default:
+			// the subscriber resumes from its last event when it subscribes again
+			e.log.Warnf("event subscriber fell behind, dropping it")
+			e.unsubscribe(sub)
+		}
+	}
+
+	if name == kExit {
+		e.exited = true
+		for sub := range e.subscribers {
+			e.unsubscribe(sub)
+		}
+	}
+
+	// queued under mu, so the events are delivered in the order of Seq
+	for _, d := range e.deliveries {
+		if d.sink.legacyOnly && !legacy(ev.Type) {
+			continue
+		}
+		d.push(ev)
+	}
+
+	e.mu.Unlock()
+}
+
+// Subscribe returns the kept events with a Seq after lastID and a channel that receives the events after them.
+// A lastID that is newer than the latest event, e.g. from before ovm restarted, replays all kept events.
+// The channel is closed by cancel, after the exit event, or when the subscriber falls behind.
+// A subscriber whose lastID is older than the kept events sees the gap in Seq.
+func (e *Context) Subscribe(lastID uint64) (replay []Event, events <-chan Event, cancel func()) {
+	ch := make(chan Event, subscriberBuffer)
+	if e == nil {
+		close(ch)
+		return nil, ch, func() {}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if lastID > e.lastID {
+		lastID = 0
+	}
+
+	for _, ev := range e.history {
+		if ev.Seq > lastID {
+			replay = append(replay, ev)
+		}
+	}
+
+	if e.exited {
+		close(ch)
+		return replay, ch, func() {}
+	}
+
+	e.subscribers[ch] = struct{}{}
+	e.streaming.Add(1)
+
+	var once sync.Once
+	return replay, ch, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			e.unsubscribe(ch)
+			e.mu.Unlock()
+			e.streaming.Done()
+		})
+	}
+}
+
+// unsubscribe must be called with mu held.
+func (e *Context) unsubscribe(ch chan Event) {
+	if _, ok := e.subscribers[ch]; ok {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
 }
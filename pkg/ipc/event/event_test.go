@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package event
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func eventSeqs(events []Event) []uint64 {
+	seqs := []uint64{}
+	for _, ev := range events {
+		seqs = append(seqs, ev.Seq)
+	}
+
+	return seqs
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	const sent = historySize + 100
+
+	tests := []struct {
+		name   string
+		lastID uint64
+		want   []uint64
+	}{
+		{name: "from the start", lastID: 0, want: seqRange(sent-historySize+1, sent)},
+		{name: "after the last event", lastID: sent, want: []uint64{}},
+		{name: "after a kept event", lastID: sent - 10, want: seqRange(sent-9, sent)},
+		{name: "gap", lastID: 10, want: seqRange(sent-historySize+1, sent)},
+		{name: "newer than the last event", lastID: sent + 1, want: seqRange(sent-historySize+1, sent)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestContext(t)
+			for i := 0; i < sent; i++ {
+				e.NotifyApp(Preparing)
+			}
+
+			replay, events, cancel := e.Subscribe(tt.lastID)
+			defer cancel()
+
+			if got := eventSeqs(replay); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("replay = %v, want %v", got, tt.want)
+			}
+
+			// the events after the replay follow without a gap
+			e.NotifyApp(Ready)
+			select {
+			case ev := <-events:
+				if ev.Seq != e.lastID || ev.Type != TypeApp || ev.Message != string(Ready) {
+					t.Errorf("event = %+v, want ready with seq %d", ev, e.lastID)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no event after the replay")
+			}
+		})
+	}
+}
+
+func TestSubscribeEnd(t *testing.T) {
+	e := newTestContext(t)
+	e.NotifyApp(Preparing)
+
+	_, canceled, cancel := e.Subscribe(0)
+	cancel()
+	if _, ok := <-canceled; ok {
+		t.Error("canceled subscription is still open")
+	}
+
+	// a subscriber that falls behind is dropped and resumes with Subscribe
+	_, behind, cancelBehind := e.Subscribe(0)
+	for i := 0; i < subscriberBuffer+1; i++ {
+		e.NotifyApp(Initializing)
+	}
+
+	received := 0
+	for range behind {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("received %d events before the drop, want %d", received, subscriberBuffer)
+	}
+	cancelBehind()
+
+	replay, _, cancelResumed := e.Subscribe(e.lastID - 1)
+	cancelResumed()
+	if got := eventSeqs(replay); fmt.Sprint(got) != fmt.Sprint([]uint64{e.lastID}) {
+		t.Errorf("replay = %v, want the last event", got)
+	}
+
+	// the exit event is the last one of every subscription
+	_, live, cancelLive := e.Subscribe(e.lastID)
+	go func() {
+		// NotifyExit waits for the subscribers to receive it
+		time.Sleep(10 * time.Millisecond)
+		cancelLive()
+	}()
+	e.NotifyExit()
+
+	var last Event
+	for ev := range live {
+		last = ev
+	}
+	if last.Type != TypeExit {
+		t.Errorf("last event = %+v, want exit", last)
+	}
+
+	replay, after, _ := e.Subscribe(0)
+	if _, ok := <-after; ok || len(replay) == 0 || replay[len(replay)-1].Type != TypeExit {
+		t.Errorf("subscription after the exit = %d events, open %v, want the replay up to the exit", len(replay), ok)
+	}
+}
@@ -0,0 +1,304 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package event
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/errcode"
+)
+
+const (
+	kState    key = "state"
+	kPower    key = "power"
+	kTimeSync key = "time_sync"
+	kForward  key = "forward"
+	kSSHAgent key = "ssh_agent"
+	kBindPID  key = "bind_pid"
+	kShutdown key = "shutdown"
+	kRepair   key = "repair"
+	kPrepare  key = "prepare"
+	kMigrate  key = "migrate"
+)
+
+// The lifecycle types of Event. They are only sent in the JSON format, the query format keeps
+// sending app, error and exit only.
+const (
+	TypeState    = string(kState)
+	TypePower    = string(kPower)
+	TypeTimeSync = string(kTimeSync)
+	TypeForward  = string(kForward)
+	TypeSSHAgent = string(kSSHAgent)
+	TypeBindPID  = string(kBindPID)
+	TypeShutdown = string(kShutdown)
+	TypeRepair   = string(kRepair)
+	TypePrepare  = string(kPrepare)
+	TypeMigrate  = string(kMigrate)
+)
+
+// legacy reports whether t is sent in the query format.
+func legacy(t string) bool {
+	return t == TypeApp || t == TypeError || t == TypeExit
+}
+
+// StateData is the Data of state events, sent on every state change of the virtual machine.
+type StateData struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// PowerData is the Data of power events, sent when the host goes to sleep or wakes up.
+type PowerData struct {
+	// Activity is sleep or awake.
+	Activity string `json:"activity"`
+	// Action is what ovm did about it: pause, resume, sync_time or none.
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TimeSyncData is the Data of time_sync events.
+type TimeSyncData struct {
+	// Time is the time the guest clock was set to, zero if it was not set.
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// ForwardData is the Data of forward events, sent when a socket forward to the guest goes up or down.
+type ForwardData struct {
+	// Socket is the forwarded socket on the host, e.g. the podman socket.
+	Socket string `json:"socket"`
+	Up     bool   `json:"up"`
+	// Error is why the forward went down.
+	Error string `json:"error,omitempty"`
+}
+
+// SSHAgentData is the Data of ssh_agent events.
+type SSHAgentData struct {
+	Socket string `json:"socket"`
+}
+
+// BindPIDData is the Data of bind_pid events, sent when the process of -bind-pid exited.
+type BindPIDData struct {
+	PID int `json:"pid"`
+}
+
+// RepairData is the Data of repair events, sent when an artifact in the target path did not match
+// its checksum and was copied again.
+type RepairData struct {
+	Artifact string `json:"artifact"`
+	Target   string `json:"target"`
+	Reason   string `json:"reason"`
+}
+
+// PrepareData is the Data of prepare events, sent in the Preparing phase while an artifact is copied
+// to the target path.
+type PrepareData struct {
+	Artifact string `json:"artifact"`
+	Percent  int    `json:"percent"`
+	Done     int64  `json:"done"`
+	Total    int64  `json:"total"`
+}
+
+// MigrateData is the Data of migrate events, sent when the -data-migrate command exited in the guest.
+type MigrateData struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// prepareInterval is the least time between two prepare events of an artifact, except for the one of 100%.
+const prepareInterval = time.Second
+
+// prepareProgress is the last prepare event of an artifact.
+type prepareProgress struct {
+	percent int
+	at      time.Time
+}
+
+// ShutdownReason is why ovm shut down.
+type ShutdownReason string
+
+const (
+	// ShutdownSignal is a SIGINT or SIGTERM.
+	ShutdownSignal ShutdownReason = "signal"
+	// ShutdownBindPID is the exit of the process of -bind-pid.
+	ShutdownBindPID ShutdownReason = "bind_pid"
+	// ShutdownVMStopped is the virtual machine stopping by itself, e.g. poweroff in the guest.
+	ShutdownVMStopped ShutdownReason = "vm_stopped"
+	// ShutdownTimeout is a step of the startup that did not finish in time.
+	ShutdownTimeout ShutdownReason = "timeout"
+	// ShutdownAPIRequest is a stop or request-stop through the restful API.
+	ShutdownAPIRequest ShutdownReason = "api_request"
+	// ShutdownCanceled is the cancellation of the context passed to ovm.Run.
+	ShutdownCanceled ShutdownReason = "canceled"
+	// ShutdownError is any other error.
+	ShutdownError ShutdownReason = "error"
+)
+
+// ShutdownData is the Data of shutdown events and of the exit event.
+type ShutdownData struct {
+	Reason ShutdownReason `json:"reason"`
+	Detail string         `json:"detail,omitempty"`
+}
+
+// ReasonOf returns the shutdown reason of the errcode.Code of err.
+func ReasonOf(err error) ShutdownReason {
+	switch errcode.Of(err) {
+	case errcode.Signal:
+		return ShutdownSignal
+	case errcode.BindPIDExited:
+		return ShutdownBindPID
+	case errcode.VMStopped:
+		return ShutdownVMStopped
+	case errcode.GVProxyTimeout, errcode.VMStartTimeout, errcode.IgnitionTimeout, errcode.ReadyTimeout:
+		return ShutdownTimeout
+	case errcode.APIStop:
+		return ShutdownAPIRequest
+	case errcode.Canceled:
+		return ShutdownCanceled
+	}
+
+	return ShutdownError
+}
+
+func (e *Context) NotifyState(from, to string) {
+	if e == nil {
+		return
+	}
+
+	e.notify(kState, to, StateData{From: from, To: to})
+}
+
+// NotifyPower sends what was done about the sleep or wake up of the host, err is why it failed.
+func (e *Context) NotifyPower(activity, action string, err error) {
+	if e == nil {
+		return
+	}
+
+	data := PowerData{Activity: activity, Action: action}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	e.notify(kPower, activity, data)
+}
+
+func (e *Context) NotifyTimeSync(t time.Time, err error) {
+	if e == nil {
+		return
+	}
+
+	data := TimeSyncData{Time: t}
+	message := "synced"
+	if err != nil {
+		data.Error = err.Error()
+		message = "failed"
+	}
+
+	e.notify(kTimeSync, message, data)
+}
+
+// NotifyForward sends that the forward of socket went up, or down because of err.
+func (e *Context) NotifyForward(socket string, up bool, err error) {
+	if e == nil {
+		return
+	}
+
+	data := ForwardData{Socket: socket, Up: up}
+	message := "up"
+	if !up {
+		message = "down"
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	e.notify(kForward, message, data)
+}
+
+func (e *Context) NotifySSHAgent(socket string) {
+	if e == nil {
+		return
+	}
+
+	e.notify(kSSHAgent, "started", SSHAgentData{Socket: socket})
+}
+
+func (e *Context) NotifyRepair(artifact, target, reason string) {
+	if e == nil {
+		return
+	}
+
+	e.notify(kRepair, artifact, RepairData{Artifact: artifact, Target: target, Reason: reason})
+}
+
+// NotifyPrepare sends the progress of the copy of artifact, at most once per prepareInterval and percent.
+// It is a cli.Progress.
+func (e *Context) NotifyPrepare(artifact string, done, total int64) {
+	if e == nil {
+		return
+	}
+
+	percent := 100
+	if total > 0 {
+		percent = int(done * 100 / total)
+	}
+
+	e.mu.Lock()
+	last, ok := e.prepare[artifact]
+	if ok && (percent == last.percent || percent < 100 && time.Since(last.at) < prepareInterval) {
+		e.mu.Unlock()
+		return
+	}
+	e.prepare[artifact] = prepareProgress{percent: percent, at: time.Now()}
+	e.mu.Unlock()
+
+	e.notify(kPrepare, fmt.Sprintf("%s %d%%", artifact, percent), PrepareData{Artifact: artifact, Percent: percent, Done: done, Total: total})
+}
+
+func (e *Context) NotifyMigrate(from, to string, exitCode int, errMsg string) {
+	if e == nil {
+		return
+	}
+
+	msg := "done"
+	if exitCode != 0 {
+		msg = "failed"
+	}
+
+	e.notify(kMigrate, msg, MigrateData{From: from, To: to, ExitCode: exitCode, Error: errMsg})
+}
+
+func (e *Context) NotifyBindPIDExit(pid int) {
+	if e == nil {
+		return
+	}
+
+	e.notify(kBindPID, "exited", BindPIDData{PID: pid})
+}
+
+// NotifyShutdown sends the reason of the shutdown, see ReasonOf. Only the first call sends an event,
+// its reason is also sent with the exit event.
+func (e *Context) NotifyShutdown(cause error) {
+	if e == nil {
+		return
+	}
+
+	data := &ShutdownData{Reason: ReasonOf(cause)}
+	if cause != nil {
+		data.Detail = cause.Error()
+	}
+
+	e.mu.Lock()
+	if e.shutdown != nil {
+		e.mu.Unlock()
+		return
+	}
+	e.shutdown = data
+	e.mu.Unlock()
+
+	e.notify(kShutdown, string(data.Reason), data)
+}
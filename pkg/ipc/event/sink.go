@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/logger"
+)
+
+// sink is one destination of the events.
+type sink struct {
+	name string
+	send func(ctx context.Context, ev *Event) error
+	// close is called after the last event, it may be nil.
+	close func() error
+	// legacyOnly sinks only receive the types of the query format, see legacy.
+	legacyOnly bool
+}
+
+func newSink(s cli.EventSink, format string, log *logger.Context) (*sink, error) {
+	switch s.Kind {
+	case cli.EventSinkUnix:
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", s.Target)
+				},
+			},
+			Timeout: 200 * time.Millisecond,
+		}
+		return &sink{name: s.String(), send: httpSend(client, "http://ovm/notify", format, log), legacyOnly: format != FormatJSON}, nil
+	case cli.EventSinkHTTP:
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+		}
+		return &sink{name: s.String(), send: httpSend(client, s.Target, format, log), legacyOnly: format != FormatJSON}, nil
+	case cli.EventSinkFile:
+		f, err := os.OpenFile(s.Target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open event file %s error: %w", s.Target, err)
+		}
+		return &sink{name: s.String(), send: jsonLineSend(f), close: func() error {
+			_ = f.Sync()
+			return f.Close()
+		}}, nil
+	case cli.EventSinkStdout:
+		return &sink{name: s.String(), send: jsonLineSend(os.Stdout)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown event sink kind %q", s.Kind)
+}
+
+// httpSend sends the events to uri, as GET uri?event=TYPE&message=MESSAGE in the query format,
+// otherwise as POST uri with the Event as JSON body.
+func httpSend(client *http.Client, uri, format string, log *logger.Context) func(ctx context.Context, ev *Event) error {
+	return func(ctx context.Context, ev *Event) error {
+		var req *http.Request
+		if format == FormatJSON {
+			body, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+
+			log.Infof("notify %s event %d: %s", ev.Type, ev.Seq, body)
+			if req, err = http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(body)); err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			u, err := url.Parse(uri)
+			if err != nil {
+				return err
+			}
+			q := u.Query()
+			q.Set("event", ev.Type)
+			q.Set("message", ev.Message)
+			u.RawQuery = q.Encode()
+
+			log.Infof("notify %s event to %s", ev.Type, u.Redacted())
+			if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+				return err
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status code is %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// jsonLineSend writes every Event as one JSON line to w.
+func jsonLineSend(w io.Writer) func(ctx context.Context, ev *Event) error {
+	return func(ctx context.Context, ev *Event) error {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(append(line, '\n'))
+		return err
+	}
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
+)
+
+// handleEvents streams the events of ovm as server-sent events, starting with the kept events after
+// Last-Event-ID (or the lastEventId query parameter, for the first connection of an EventSource).
+// The stream ends after the exit event.
+func (s *Restful) handleEvents(w http.ResponseWriter, r *http.Request) {
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	var after uint64
+	if lastID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid last event ID %q", lastID))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "streaming is not supported")
+		return
+	}
+
+	s.log.Infof("request /events after %d", after)
+
+	replay, events, cancel := s.ev.Subscribe(after)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range replay {
+		encodeEvent(w, e)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+
+			encodeEvent(w, e)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-time.After(3 * time.Second):
+			_, _ = fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// EventStatsResponse is the body of GET /events/stats.
+type EventStatsResponse struct {
+	// Sinks are the destinations the events are delivered to, besides /events.
+	Sinks []event.Stats `json:"sinks"`
+}
+
+func (s *Restful) handleEventStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &EventStatsResponse{Sinks: s.ev.Stats()})
+}
+
+func encodeEvent(w http.ResponseWriter, e event.Event) {
+	data, _ := json.Marshal(e)
+
+	_, _ = fmt.Fprintf(w, "id: %d\n", e.Seq)
+	_, _ = fmt.Fprintf(w, "event: %s\n", e.Type)
+	_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+}
@@ -0,0 +1,354 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Code-Hex/go-infinity-channel"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExecBody is the body of POST /exec.
+type ExecBody struct {
+	// Command is a shell command, run with sh -c, so lists such as "a && b" and compound commands work.
+	Command string `json:"command"`
+	// Env is exported before the command runs.
+	Env map[string]string `json:"env,omitempty"`
+	// Cwd is the working directory of the command.
+	Cwd string `json:"cwd,omitempty"`
+	// User runs the command as this guest user instead of root.
+	User string `json:"user,omitempty"`
+	// TimeoutSeconds kills the command when it runs longer. 0 means no timeout.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// Stdin is written to the standard input of the command, base64 encoded in JSON.
+	Stdin []byte `json:"stdin,omitempty"`
+}
+
+// The server-sent events of /v1/exec. exit is always the last event.
+const (
+	ExecEventStdout = "stdout"
+	ExecEventStderr = "stderr"
+	ExecEventExit   = "exit"
+)
+
+// The encodings of ExecOutput.Data.
+const (
+	EncodingUTF8   = "utf-8"
+	EncodingBase64 = "base64"
+)
+
+// ExecOutput is the data of the stdout and stderr events.
+// Output that is not valid UTF-8 is base64 encoded.
+type ExecOutput struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"`
+}
+
+// Bytes returns the decoded output.
+func (o *ExecOutput) Bytes() ([]byte, error) {
+	if o.Encoding == EncodingBase64 {
+		return base64.StdEncoding.DecodeString(o.Data)
+	}
+
+	return []byte(o.Data), nil
+}
+
+func newExecOutput(p []byte) *ExecOutput {
+	if utf8.Valid(p) {
+		return &ExecOutput{
+			Data:     string(p),
+			Encoding: EncodingUTF8,
+		}
+	}
+
+	return &ExecOutput{
+		Data:     base64.StdEncoding.EncodeToString(p),
+		Encoding: EncodingBase64,
+	}
+}
+
+// ExecExit is the data of the exit event.
+type ExecExit struct {
+	// Code is the exit status of the command, -1 if the command did not report one,
+	// e.g. it was killed by a signal or the command could not be started.
+	Code int `json:"code"`
+	// Signal is the name of the signal that killed the command, e.g. "KILL".
+	Signal     string `json:"signal,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	TimedOut   bool   `json:"timedOut,omitempty"`
+	// Error describes why the command failed, empty when Code is 0.
+	Error string `json:"error,omitempty"`
+}
+
+var envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (b *ExecBody) validate() error {
+	if strings.TrimSpace(b.Command) == "" {
+		return errors.New("command is required")
+	}
+
+	if b.TimeoutSeconds < 0 {
+		return errors.New("timeoutSeconds must not be negative")
+	}
+
+	for key := range b.Env {
+		if !envKeyRegexp.MatchString(key) {
+			return fmt.Errorf("invalid env name %q", key)
+		}
+	}
+
+	return nil
+}
+
+// script wraps the command into a shell script that applies env, cwd and user. The command is
+// quoted and run by a sh -c that replaces the shell, so that the signals of timeouts and jobs
+// reach the shell running the command.
+func (b *ExecBody) script() string {
+	var sb strings.Builder
+
+	keys := make([]string, 0, len(b.Env))
+	for key := range b.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		sb.WriteString("export " + key + "=" + shellQuote(b.Env[key]) + " && ")
+	}
+
+	if b.Cwd != "" {
+		sb.WriteString("cd " + shellQuote(b.Cwd) + " && ")
+	}
+
+	sb.WriteString("exec /bin/sh -c " + shellQuote(b.Command))
+
+	if b.User == "" || b.User == "root" {
+		return sb.String()
+	}
+
+	return "su -s /bin/sh -c " + shellQuote(sb.String()) + " " + shellQuote(b.User)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+type execEvent struct {
+	name   string
+	output []byte
+	exit   *ExecExit
+}
+
+type eventWriter struct {
+	name string
+	ch   *infinity.Channel[execEvent]
+}
+
+func (w *eventWriter) Write(p []byte) (n int, err error) {
+	w.ch.In() <- execEvent{
+		name:   w.name,
+		output: append([]byte(nil), p...),
+	}
+	return len(p), nil
+}
+
+// handleExec streams the events of the command. The legacy format (out, error and done events)
+// is served on the unversioned path for the clients written before the exit event existed.
+func (s *Restful) handleExec(legacy bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body ExecBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.log.Warnf("Failed to decode request body: %v", err)
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
+			return
+		}
+
+		if err := body.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.log.Warnf("Bowser does not support server-sent events")
+			writeError(w, http.StatusInternalServerError, CodeInternal, "streaming is not supported")
+			return
+		}
+
+		free, err := s.ssh.reserve(false)
+		if err != nil {
+			writeSSHError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		events := infinity.NewChannel[execEvent]()
+		go s.exec(r.Context(), &body, free, events, nil)
+
+		encode := encodeExecEvent
+		if legacy {
+			encode = legacyExecEncoder()
+		}
+
+		for {
+			select {
+			case e, ok := <-events.Out():
+				if !ok {
+					s.log.Info("Command execution finished")
+					return
+				}
+
+				encode(w, e)
+				flusher.Flush()
+			case <-r.Context().Done():
+				s.log.Warnf("Client closed connection")
+				return
+			case <-time.After(3 * time.Second):
+				_, _ = fmt.Fprintf(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func encodeExecEvent(w http.ResponseWriter, e execEvent) {
+	var data []byte
+	if e.exit != nil {
+		data, _ = json.Marshal(e.exit)
+	} else {
+		data, _ = json.Marshal(newExecOutput(e.output))
+	}
+
+	_, _ = fmt.Fprintf(w, "event: %s\n", e.name)
+	_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// legacyExecEncoder merges stdout and stderr into out events, reports a failure as an error event
+// with the last stderr output, and ends with a done event.
+func legacyExecEncoder() func(w http.ResponseWriter, e execEvent) {
+	var lastStderr []byte
+
+	return func(w http.ResponseWriter, e execEvent) {
+		if e.exit == nil {
+			if e.name == ExecEventStderr {
+				lastStderr = e.output
+			}
+
+			_, _ = fmt.Fprintf(w, "event: out\n")
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", encodeSSE(string(e.output)))
+			return
+		}
+
+		if e.exit.Error != "" {
+			_, _ = fmt.Fprintf(w, "event: error\n")
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", encodeSSE(fmt.Sprintf("%s\n%s", lastStderr, e.exit.Error)))
+		}
+
+		_, _ = fmt.Fprintf(w, "event: done\n")
+		_, _ = fmt.Fprintf(w, "data: done\n\n")
+	}
+}
+
+func encodeSSE(str string) string {
+	return strings.ReplaceAll(strings.TrimSpace(str), "\n", "\ndata: ")
+}
+
+// exec runs the command and sends its output to events, followed by the exit event. events is closed afterwards.
+// The signals received from signals, if not nil, are sent to the command. free is the reservation of
+// the session (see sshPool.reserve), it is released once the command exited.
+func (s *Restful) exec(ctx context.Context, body *ExecBody, free func(), events *infinity.Channel[execEvent], signals <-chan ssh.Signal) {
+	s.log.Info("request /exec")
+
+	start := time.Now()
+	exit := &ExecExit{Code: -1}
+	defer func() {
+		free()
+
+		exit.DurationMs = time.Since(start).Milliseconds()
+		if exit.Error != "" {
+			s.log.Warnf("Failed to execute command: %s", exit.Error)
+		}
+
+		events.In() <- execEvent{name: ExecEventExit, exit: exit}
+		events.Close()
+	}()
+
+	if body.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(body.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	session, err := s.ssh.open()
+	if err != nil {
+		exit.Error = err.Error()
+		return
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+	})
+	defer stop()
+
+	if signals != nil {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case sig := <-signals:
+					if err := session.Signal(sig); err != nil {
+						s.log.Warnf("Send signal %s to command error: %v", sig, err)
+					}
+				}
+			}
+		}()
+	}
+
+	session.Stdout = &eventWriter{name: ExecEventStdout, ch: events}
+	session.Stderr = &eventWriter{name: ExecEventStderr, ch: events}
+	if len(body.Stdin) != 0 {
+		session.Stdin = bytes.NewReader(body.Stdin)
+	}
+
+	err = session.Run(body.script())
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		exit.Code = 0
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		exit.TimedOut = true
+		exit.Signal = string(ssh.SIGKILL)
+		exit.Error = fmt.Sprintf("command timed out after %d seconds", body.TimeoutSeconds)
+	case errors.As(err, &exitErr):
+		if exitErr.Signal() == "" {
+			exit.Code = exitErr.ExitStatus()
+		}
+		exit.Signal = exitErr.Signal()
+		exit.Error = err.Error()
+	default:
+		exit.Error = err.Error()
+	}
+}
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/hypervisor/fake"
+	"github.com/oomol-lab/ovm/pkg/testing/fakeguest"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// newGuestRestful returns the API of a running fake virtual machine whose sshd is a fakeguest.SSHServer.
+func newGuestRestful(t *testing.T) (*Restful, *fakeguest.SSHServer) {
+	t.Helper()
+
+	vm, err := fake.New(t.TempDir()).NewVirtualMachine(&config.VirtualMachine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, clientKey := newSigner(t), newSigner(t)
+	sshd, err := fakeguest.NewSSHServer(hostKey, clientKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sshd.Close()
+	})
+
+	opt := &cli.Context{
+		SSHSigner:  clientKey,
+		SSHHostKey: hostKey.PublicKey(),
+		SSHPort:    sshd.Port(),
+	}
+
+	s := New(vm, nil, newTestRestful(t).log, opt, nil)
+
+	return s, sshd
+}
+
+// postExec runs body through uri, /v1/exec or the legacy /exec, and returns the data of the events by name.
+func postExec(t *testing.T, s *Restful, uri string, body *ExecBody) map[string][]string {
+	t.Helper()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.mux().ServeHTTP(w, httptest.NewRequest(http.MethodPost, uri, bytes.NewReader(b)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST %s: status %d, body %s", uri, w.Code, w.Body)
+	}
+
+	events := map[string][]string{}
+	name := ""
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			events[name] = append(events[name], strings.TrimPrefix(line, "data: "))
+		}
+	}
+
+	return events
+}
+
+func stdout(t *testing.T, events map[string][]string) string {
+	t.Helper()
+
+	var out strings.Builder
+	for _, data := range events[ExecEventStdout] {
+		var o ExecOutput
+		if err := json.Unmarshal([]byte(data), &o); err != nil {
+			t.Fatal(err)
+		}
+		b, err := o.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Write(b)
+	}
+
+	return out.String()
+}
+
+func TestExecCompoundCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		body ExecBody
+		want string
+	}{
+		{name: "and list", body: ExecBody{Command: "echo a && echo b"}, want: "a\nb\n"},
+		{name: "sequence", body: ExecBody{Command: "echo a; echo b"}, want: "a\nb\n"},
+		{name: "or list", body: ExecBody{Command: "false || echo b"}, want: "b\n"},
+		{name: "pipeline", body: ExecBody{Command: "printf 'a\\nb\\n' | sort -r"}, want: "b\na\n"},
+		{name: "if and for", body: ExecBody{Command: "if true; then echo a; fi; for x in b c; do echo $x; done"}, want: "a\nb\nc\n"},
+		{name: "quotes", body: ExecBody{Command: `echo "it's" 'a "b"'`}, want: "it's a \"b\"\n"},
+		{name: "env and cwd", body: ExecBody{Command: "echo $A && pwd", Env: map[string]string{"A": "x y"}, Cwd: "/"}, want: "x y\n/\n"},
+	}
+
+	s, _ := newGuestRestful(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := postExec(t, s, apiPrefix+"/exec", &tt.body)
+			if got := stdout(t, events); got != tt.want {
+				t.Errorf("stdout = %q, want %q", got, tt.want)
+			}
+
+			var exit ExecExit
+			if len(events[ExecEventExit]) != 1 || json.Unmarshal([]byte(events[ExecEventExit][0]), &exit) != nil || exit.Code != 0 {
+				t.Errorf("exit events = %v, want one with code 0", events[ExecEventExit])
+			}
+		})
+	}
+}
+
+func TestLegacyExecCompoundCommand(t *testing.T) {
+	s, _ := newGuestRestful(t)
+
+	events := postExec(t, s, "/exec", &ExecBody{Command: "echo a && echo b"})
+	if got := strings.Join(events["out"], "\n"); got != "a\nb" {
+		t.Errorf("out = %q, want both lines", got)
+	}
+	if len(events["error"]) != 0 || len(events["done"]) != 1 {
+		t.Errorf("events = %v, want done without error", events)
+	}
+}
@@ -0,0 +1,670 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// HeaderFileMode carries the permission bits of a file in octal, e.g. 0644, in the response of GET /v1/files.
+const HeaderFileMode = "X-File-Mode"
+
+// ArchiveTar is the only archive format of /v1/files.
+const ArchiveTar = "tar"
+
+// FileResponse is the body of PUT /v1/files.
+type FileResponse struct {
+	Path string `json:"path"`
+	// Size is the number of bytes written, for an archive the sum over its regular files.
+	Size int64 `json:"size"`
+	// Mode is the permission bits in octal, e.g. 0644.
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	// Entries is the number of extracted entries of an archive.
+	Entries int `json:"entries,omitempty"`
+}
+
+// fileRequest is the query of /v1/files.
+type fileRequest struct {
+	path    string
+	archive bool
+	// mode is the mode of an uploaded file if hasMode is true.
+	mode    os.FileMode
+	hasMode bool
+	parents bool
+}
+
+func parseFileRequest(r *http.Request) (*fileRequest, error) {
+	q := r.URL.Query()
+
+	p := q.Get("path")
+	if p == "" || !path.IsAbs(p) {
+		return nil, errors.New("path must be an absolute path in the guest")
+	}
+
+	f := &fileRequest{path: path.Clean(p)}
+
+	switch q.Get("archive") {
+	case "":
+	case ArchiveTar:
+		f.archive = true
+	default:
+		return nil, fmt.Errorf("unsupported archive %q, only %s is supported", q.Get("archive"), ArchiveTar)
+	}
+
+	if m := q.Get("mode"); m != "" {
+		mode, err := ParseMode(m)
+		if err != nil {
+			return nil, err
+		}
+		f.mode, f.hasMode = mode, true
+	}
+
+	if p := q.Get("parents"); p != "" {
+		parents, err := strconv.ParseBool(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parents %q", p)
+		}
+		f.parents = parents
+	}
+
+	return f, nil
+}
+
+// handleFiles downloads (GET) and uploads (PUT) files in the guest over SFTP. Neither is limited to the virtio-fs shares.
+func (s *Restful) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPut {
+		methodNotAllowed(w, r, http.MethodGet, http.MethodHead, http.MethodPut)
+		return
+	}
+
+	req, err := parseFileRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	s.log.Infof("request %s /files %s", r.Method, req.path)
+
+	client, closeClient, err := s.sftp(r.Context())
+	if err != nil {
+		s.log.Warnf("Open sftp client error: %v", err)
+		writeSSHError(w, err)
+		return
+	}
+	defer closeClient()
+
+	switch {
+	case r.Method == http.MethodPut && req.archive:
+		s.extract(w, r, client, req)
+	case r.Method == http.MethodPut:
+		s.upload(w, r, client, req)
+	case req.archive:
+		s.archive(w, r, client, req)
+	default:
+		s.download(w, r, client, req)
+	}
+}
+
+// sftp starts an SFTP client on a session of the SSH pool. closeClient must be called once the client is no longer used.
+func (s *Restful) sftp(ctx context.Context) (client *sftp.Client, closeClient func(), err error) {
+	session, release, err := s.ssh.session()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("start sftp subsystem error: %w", err)
+	}
+
+	client, err = sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("new sftp client error: %w", err)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Close()
+	})
+
+	return client, func() {
+		stop()
+		_ = client.Close()
+		release()
+	}, nil
+}
+
+// download serves a regular file, with support for Range and conditional requests.
+func (s *Restful) download(w http.ResponseWriter, r *http.Request, client *sftp.Client, req *fileRequest) {
+	info, err := client.Stat(req.path)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+
+	if info.IsDir() {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, req.path+" is a directory, use archive="+ArchiveTar)
+		return
+	}
+
+	f, err := client.Open(req.path)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(HeaderFileMode, FormatMode(info.Mode()))
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// archive streams path as a tar archive whose entries are named after the last element of path.
+// The response has started when an entry fails to be read, the connection is then aborted so the client sees a truncated archive.
+func (s *Restful) archive(w http.ResponseWriter, r *http.Request, client *sftp.Client, req *fileRequest) {
+	if _, err := client.Lstat(req.path); err != nil {
+		writeFileError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	base := path.Base(req.path)
+	if req.path == "/" {
+		base = "."
+	}
+
+	tw := tar.NewWriter(w)
+	walker := client.Walk(req.path)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			s.log.Warnf("Skip %s in archive: %v", walker.Path(), err)
+			continue
+		}
+
+		if err := s.archiveEntry(tw, client, walker.Path(), path.Join(base, strings.TrimPrefix(walker.Path(), req.path)), walker.Stat()); err != nil {
+			s.log.Warnf("Archive %s error: %v", walker.Path(), err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		s.log.Warnf("Close archive of %s error: %v", req.path, err)
+	}
+}
+
+func (s *Restful) archiveEntry(tw *tar.Writer, client *sftp.Client, p, name string, info os.FileInfo) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = client.ReadLink(p); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		hdr.Uid, hdr.Gid = int(stat.UID), int(stat.GID)
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := client.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the file may have grown since Lstat, the header decides how much of it is archived
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// upload writes the body to path. A body with Content-Range is written in place at its offset, anything else
+// is written to a temporary file first, which then replaces path, so readers never see a partial file.
+func (s *Restful) upload(w http.ResponseWriter, r *http.Request, client *sftp.Client, req *fileRequest) {
+	if req.parents {
+		if err := client.MkdirAll(path.Dir(req.path)); err != nil {
+			writeFileError(w, err)
+			return
+		}
+	}
+
+	existing, err := client.Stat(req.path)
+	switch {
+	case err == nil && existing.IsDir():
+		writeError(w, http.StatusBadRequest, CodeBadRequest, req.path+" is a directory, use archive="+ArchiveTar)
+		return
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		writeFileError(w, err)
+		return
+	}
+
+	mode := os.FileMode(0o644)
+	switch {
+	case req.hasMode:
+		mode = req.mode
+	case existing != nil:
+		mode = existing.Mode() & modeBits
+	}
+
+	var n int64
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		n, err = s.uploadRange(r, client, req.path, cr, mode)
+	} else {
+		n, err = s.uploadReplace(r, client, req.path, existing, mode)
+	}
+	if err != nil {
+		var bad *badRequestError
+		if errors.As(err, &bad) {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		s.log.Warnf("Upload %s error: %v", req.path, err)
+		writeFileError(w, err)
+		return
+	}
+
+	info, err := client.Stat(req.path)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if existing == nil {
+		status = http.StatusCreated
+	}
+
+	writeJSON(w, status, &FileResponse{
+		Path:    req.path,
+		Size:    n,
+		Mode:    FormatMode(info.Mode()),
+		ModTime: info.ModTime(),
+	})
+}
+
+func (s *Restful) uploadReplace(r *http.Request, client *sftp.Client, p string, existing os.FileInfo, mode os.FileMode) (int64, error) {
+	suffix := make([]byte, 6)
+	_, _ = rand.Read(suffix)
+	tmp := path.Join(path.Dir(p), "."+path.Base(p)+".ovm-upload-"+hex.EncodeToString(suffix))
+
+	f, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return 0, err
+	}
+
+	done := false
+	defer func() {
+		if !done {
+			_ = client.Remove(tmp)
+		}
+	}()
+
+	n, err := f.ReadFrom(r.Body)
+	if err != nil {
+		_ = f.Close()
+		return n, err
+	}
+
+	// the replaced file keeps its owner, uploads are written as root.
+	// chown clears the setuid and setgid bits, so it goes first.
+	if stat, ok := sysStat(existing); ok {
+		if err := f.Chown(int(stat.UID), int(stat.GID)); err != nil {
+			_ = f.Close()
+			return n, err
+		}
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		return n, err
+	}
+
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	if err := client.PosixRename(tmp, p); err != nil {
+		return n, fmt.Errorf("rename %s to %s error: %w", tmp, p, err)
+	}
+
+	done = true
+	return n, nil
+}
+
+func (s *Restful) uploadRange(r *http.Request, client *sftp.Client, p, contentRange string, mode os.FileMode) (int64, error) {
+	start, end, err := parseContentRange(contentRange)
+	if err != nil {
+		return 0, &badRequestError{err}
+	}
+
+	size := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != size {
+		return 0, &badRequestError{fmt.Errorf("body has %d bytes, Content-Range expects %d", r.ContentLength, size)}
+	}
+
+	f, err := client.OpenFile(p, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r.Body, size))
+	if err != nil {
+		return n, err
+	}
+
+	if n != size {
+		return n, &badRequestError{fmt.Errorf("body has %d bytes, Content-Range expects %d", n, size)}
+	}
+
+	// a chunked body has no Content-Length to check up front
+	if extra, _ := r.Body.Read(make([]byte, 1)); extra > 0 {
+		return n, &badRequestError{fmt.Errorf("body has more bytes than Content-Range expects (%d)", size)}
+	}
+
+	return n, f.Chmod(mode)
+}
+
+// extract writes the entries of the tar archive in the body into the directory path, creating it if needed.
+// Modes, owners and modification times of the entries are kept.
+func (s *Restful) extract(w http.ResponseWriter, r *http.Request, client *sftp.Client, req *fileRequest) {
+	if err := client.MkdirAll(req.path); err != nil {
+		writeFileError(w, err)
+		return
+	}
+
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+
+	var (
+		resp = &FileResponse{Path: req.path}
+		dirs []dirTime
+	)
+
+	tr := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("read archive error: %v", err))
+			return
+		}
+
+		// names cannot leave path, e.g. ../etc/passwd is written to path/etc/passwd,
+		// and extractEntry refuses to write through symlinks below path
+		target := path.Join(req.path, path.Clean("/"+hdr.Name))
+
+		n, err := s.extractEntry(client, tr, hdr, req.path, target)
+		if err != nil {
+			s.log.Warnf("Extract %s to %s error: %v", hdr.Name, target, err)
+
+			var bad *badRequestError
+			if errors.As(err, &bad) {
+				writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+				return
+			}
+			writeFileError(w, err)
+			return
+		}
+
+		resp.Size += n
+		resp.Entries++
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{path: target, modTime: hdr.ModTime})
+		}
+	}
+
+	// directories last, extracting their entries changed their modification time
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = client.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+	}
+
+	info, err := client.Stat(req.path)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	resp.Mode, resp.ModTime = FormatMode(info.Mode()), info.ModTime()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Restful) extractEntry(client *sftp.Client, tr *tar.Reader, hdr *tar.Header, root, target string) (int64, error) {
+	mode := hdr.FileInfo().Mode() & modeBits
+
+	// a symlink entry itself is replaced, the others would follow it
+	if err := checkNoSymlink(client, root, target, hdr.Typeflag != tar.TypeSymlink); err != nil {
+		return 0, err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := client.MkdirAll(target); err != nil {
+			return 0, err
+		}
+		if err := client.Chown(target, hdr.Uid, hdr.Gid); err != nil {
+			return 0, err
+		}
+		return 0, client.Chmod(target, mode)
+	case tar.TypeReg:
+		if err := client.MkdirAll(path.Dir(target)); err != nil {
+			return 0, err
+		}
+
+		f, err := client.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+
+		n, err := f.ReadFrom(tr)
+		if err != nil {
+			return n, err
+		}
+		// chown clears the setuid and setgid bits, so it goes first
+		if err := f.Chown(hdr.Uid, hdr.Gid); err != nil {
+			return n, err
+		}
+		if err := f.Chmod(mode); err != nil {
+			return n, err
+		}
+		return n, client.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		if err := client.MkdirAll(path.Dir(target)); err != nil {
+			return 0, err
+		}
+		_ = client.Remove(target)
+		return 0, client.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		source := path.Join(root, path.Clean("/"+hdr.Linkname))
+		if err := checkNoSymlink(client, root, source, false); err != nil {
+			return 0, err
+		}
+
+		_ = client.Remove(target)
+		return 0, client.Link(source, target)
+	default:
+		s.log.Warnf("Skip %s in archive, type %c is not supported", hdr.Name, hdr.Typeflag)
+		return 0, nil
+	}
+}
+
+// checkNoSymlink fails when a directory between root and p is a symlink, or p itself if self is set.
+// Writing there would follow the link, which may point outside root. Missing components are fine,
+// they are created as directories.
+func checkNoSymlink(client *sftp.Client, root, p string, self bool) error {
+	rel := strings.Trim(strings.TrimPrefix(p, root), "/")
+	if rel == "" {
+		return nil
+	}
+
+	names := strings.Split(rel, "/")
+	if !self {
+		names = names[:len(names)-1]
+	}
+
+	cur := root
+	for _, name := range names {
+		cur = path.Join(cur, name)
+
+		info, err := client.Lstat(cur)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return &badRequestError{fmt.Errorf("%s is a symlink, archive entries are not extracted through it", cur)}
+		}
+	}
+
+	return nil
+}
+
+// badRequestError is an error caused by the request rather than the guest.
+type badRequestError struct {
+	err error
+}
+
+func (e *badRequestError) Error() string {
+	return e.err.Error()
+}
+
+// parseContentRange parses "bytes start-end/size", size may be *.
+func parseContentRange(s string) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q, expected bytes start-end/size", s)
+	}
+
+	rng, _, _ := strings.Cut(spec, "/")
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q, expected bytes start-end/size", s)
+	}
+
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q, expected bytes start-end/size", s)
+	}
+
+	return start, end, nil
+}
+
+func writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		writeError(w, http.StatusNotFound, CodeNotFound, err.Error())
+	case errors.Is(err, os.ErrPermission):
+		writeError(w, http.StatusForbidden, CodeForbidden, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+	}
+}
+
+// modeBits are the bits of a file mode that /v1/files preserves.
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// FormatMode formats the permission bits of mode the way chmod takes them, e.g. 4755.
+func FormatMode(mode os.FileMode) string {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+
+	return fmt.Sprintf("%04o", m)
+}
+
+// ParseMode is the reverse of FormatMode.
+func ParseMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0o7777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permission bits, e.g. 0644", s)
+	}
+
+	mode := os.FileMode(m & 0o777)
+	if m&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode, nil
+}
+
+func sysStat(info os.FileInfo) (*sftp.FileStat, bool) {
+	if info == nil {
+		return nil, false
+	}
+
+	stat, ok := info.Sys().(*sftp.FileStat)
+	return stat, ok
+}
@@ -0,0 +1,238 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/logger"
+	"github.com/pkg/sftp"
+)
+
+// pipeConn joins the read side of one pipe with the write side of another.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// newSFTPClient serves the local filesystem over an in-memory SFTP connection.
+func newSFTPClient(t *testing.T) *sftp.Client {
+	t.Helper()
+
+	serverR, clientW := io.Pipe()
+	clientR, serverW := io.Pipe()
+
+	server, err := sftp.NewServer(&pipeConn{Reader: serverR, WriteCloser: serverW})
+	if err != nil {
+		t.Fatalf("new sftp server: %v", err)
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+
+	client, err := sftp.NewClientPipe(clientR, clientW)
+	if err != nil {
+		t.Fatalf("new sftp client: %v", err)
+	}
+
+	// the client waits for the server to hang up
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+
+	return client
+}
+
+func newTestRestful(t *testing.T) *Restful {
+	t.Helper()
+
+	log, err := logger.NewWithoutManage(t.TempDir(), "test")
+	if err != nil {
+		t.Fatalf("new logger: %v", err)
+	}
+	t.Cleanup(log.Close)
+
+	return &Restful{log: log}
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func tarArchive(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			ModTime:  time.Now(),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("write tar body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+
+	return &buf
+}
+
+func extractArchive(t *testing.T, root string, archive io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+
+	s := newTestRestful(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/v1/files?archive=tar&path="+root, archive)
+	s.extract(w, r, newSFTPClient(t), &fileRequest{path: root, archive: true})
+
+	return w
+}
+
+func TestExtract(t *testing.T) {
+	root := t.TempDir()
+
+	w := extractArchive(t, root, tarArchive(t,
+		tarEntry{name: "dir/", typeflag: tar.TypeDir},
+		tarEntry{name: "dir/a.txt", typeflag: tar.TypeReg, body: "hello"},
+		tarEntry{name: "dir/link", typeflag: tar.TypeSymlink, linkname: "a.txt"},
+		tarEntry{name: "../escape.txt", typeflag: tar.TypeReg, body: "inside"},
+	))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(root, "dir", "link")); err != nil || string(b) != "hello" {
+		t.Errorf("dir/link = %q, %v, want hello", b, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "escape.txt")); err != nil || string(b) != "inside" {
+		t.Errorf("escape.txt = %q, %v, want inside", b, err)
+	}
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name: "absolute",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "OUTSIDE"},
+				{name: "a/passwd", typeflag: tar.TypeReg, body: "owned"},
+			},
+		},
+		{
+			name: "relative",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "../OUTSIDE_NAME"},
+				{name: "a/passwd", typeflag: tar.TypeReg, body: "owned"},
+			},
+		},
+		{
+			name: "chain",
+			entries: []tarEntry{
+				{name: "s", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "s/../OUTSIDE_NAME/passwd", typeflag: tar.TypeReg, body: "owned"},
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "s/../OUTSIDE_NAME"},
+				{name: "a/passwd", typeflag: tar.TypeReg, body: "owned"},
+			},
+		},
+		{
+			name: "file",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "OUTSIDE/passwd"},
+				{name: "a", typeflag: tar.TypeReg, body: "owned"},
+			},
+		},
+		{
+			name: "dir",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "OUTSIDE"},
+				{name: "a/", typeflag: tar.TypeDir},
+			},
+		},
+		{
+			name: "hard link",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "OUTSIDE"},
+				{name: "b", typeflag: tar.TypeLink, linkname: "a/passwd"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "root")
+			outside := filepath.Join(parent, "outside")
+			if err := os.MkdirAll(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			passwd := filepath.Join(outside, "passwd")
+			if err := os.WriteFile(passwd, []byte("original"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, e := range tt.entries {
+				switch e.linkname {
+				case "OUTSIDE":
+					tt.entries[i].linkname = outside
+				case "OUTSIDE/passwd":
+					tt.entries[i].linkname = passwd
+				case "../OUTSIDE_NAME":
+					tt.entries[i].linkname = "../outside"
+				case "s/../OUTSIDE_NAME":
+					tt.entries[i].linkname = "s/../outside"
+				}
+			}
+
+			w := extractArchive(t, root, tarArchive(t, tt.entries...))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d, body %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+
+			if b, err := os.ReadFile(passwd); err != nil || string(b) != "original" {
+				t.Errorf("outside file = %q, %v, want original", b, err)
+			}
+			if info, err := os.Stat(passwd); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("outside file mode = %v, %v, want 0600", info.Mode(), err)
+			}
+			if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0755 {
+				t.Errorf("outside dir mode = %v, %v, want 0755", info.Mode(), err)
+			}
+			if entries, _ := os.ReadDir(parent); len(entries) != 2 {
+				t.Errorf("entries next to root = %d, want 2", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,449 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/go-infinity-channel"
+	"golang.org/x/crypto/ssh"
+)
+
+// The statuses of a job.
+const (
+	JobRunning = "running"
+	JobExited  = "exited"
+)
+
+const (
+	// maxFinishedJobs is the number of finished jobs kept, the oldest are removed first.
+	maxFinishedJobs = 32
+	// maxJobOutput is the output buffered per job, the oldest output is dropped first.
+	maxJobOutput = 4 * 1024 * 1024
+)
+
+// JobOutput is a chunk of the output of a job.
+type JobOutput struct {
+	// Stream is ExecEventStdout or ExecEventStderr.
+	Stream string `json:"stream"`
+	// Offset is the position of the chunk in the output of the job, stdout and stderr counted together.
+	Offset int64 `json:"offset"`
+	ExecOutput
+}
+
+// JobResponse is the body of the job routes.
+type JobResponse struct {
+	ID         string     `json:"id"`
+	Command    string     `json:"command"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Exit       *ExecExit  `json:"exit,omitempty"`
+	// OutputStart is the offset of the oldest buffered output, the output before it was dropped.
+	OutputStart int64 `json:"outputStart"`
+	// OutputEnd is the offset right after the newest output.
+	OutputEnd int64       `json:"outputEnd"`
+	Output    []JobOutput `json:"output,omitempty"`
+}
+
+type jobChunk struct {
+	stream string
+	offset int64
+	data   []byte
+}
+
+// job is a command running detached from the request that started it.
+type job struct {
+	id      string
+	command string
+	created time.Time
+	signals chan ssh.Signal
+
+	mu       sync.Mutex
+	chunks   []jobChunk
+	start    int64
+	end      int64
+	buffered int
+	exit     *ExecExit
+	finished time.Time
+	// changed is closed and replaced whenever output is added or the job exits.
+	changed chan struct{}
+}
+
+func (j *job) add(e execEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if e.exit != nil {
+		j.exit = e.exit
+		j.finished = time.Now()
+	} else {
+		j.chunks = append(j.chunks, jobChunk{stream: e.name, offset: j.end, data: e.output})
+		j.end += int64(len(e.output))
+		j.buffered += len(e.output)
+
+		for j.buffered > maxJobOutput && len(j.chunks) > 1 {
+			j.buffered -= len(j.chunks[0].data)
+			j.chunks = j.chunks[1:]
+		}
+		j.start = j.chunks[0].offset
+	}
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// since returns the buffered output after offset, the exit of the job if it exited,
+// and a channel that is closed on the next change.
+func (j *job) since(offset int64) ([]jobChunk, *ExecExit, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var chunks []jobChunk
+	for _, c := range j.chunks {
+		if c.offset+int64(len(c.data)) <= offset {
+			continue
+		}
+
+		if c.offset < offset {
+			c.data = c.data[offset-c.offset:]
+			c.offset = offset
+		}
+		chunks = append(chunks, c)
+	}
+
+	return chunks, j.exit, j.changed
+}
+
+func (j *job) response(offset int64, withOutput bool) *JobResponse {
+	chunks, exit, _ := j.since(offset)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	resp := &JobResponse{
+		ID:          j.id,
+		Command:     j.command,
+		Status:      JobRunning,
+		CreatedAt:   j.created,
+		Exit:        exit,
+		OutputStart: j.start,
+		OutputEnd:   j.end,
+	}
+
+	if exit != nil {
+		finished := j.finished
+		resp.Status = JobExited
+		resp.FinishedAt = &finished
+	}
+
+	if withOutput {
+		resp.Output = make([]JobOutput, 0, len(chunks))
+		for _, c := range chunks {
+			resp.Output = append(resp.Output, JobOutput{
+				Stream:     c.stream,
+				Offset:     c.offset,
+				ExecOutput: *newExecOutput(c.data),
+			})
+		}
+	}
+
+	return resp
+}
+
+func (j *job) exited() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.exit != nil
+}
+
+type jobManager struct {
+	// ctx bounds the lifetime of the jobs, it is done when ovm exits.
+	ctx context.Context
+	s   *Restful
+
+	mu sync.Mutex
+	// jobs are in creation order.
+	jobs []*job
+}
+
+func newJobManager(s *Restful) *jobManager {
+	return &jobManager{
+		ctx: context.Background(),
+		s:   s,
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// create starts the job on the session reserved by free, see sshPool.reserve.
+func (m *jobManager) create(body *ExecBody, free func()) *job {
+	j := &job{
+		id:      newJobID(),
+		command: body.Command,
+		created: time.Now(),
+		signals: make(chan ssh.Signal, 1),
+		changed: make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.jobs = append(m.jobs, j)
+	m.mu.Unlock()
+
+	events := infinity.NewChannel[execEvent]()
+	go m.s.exec(m.ctx, body, free, events, j.signals)
+	go func() {
+		for e := range events.Out() {
+			j.add(e)
+		}
+
+		m.prune()
+	}()
+
+	return j
+}
+
+func (m *jobManager) get(id string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, j := range m.jobs {
+		if j.id == id {
+			return j
+		}
+	}
+
+	return nil
+}
+
+func (m *jobManager) list() []*job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*job(nil), m.jobs...)
+}
+
+func (m *jobManager) remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, j := range m.jobs {
+		if j.id == id {
+			m.jobs = append(m.jobs[:i], m.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// prune removes the oldest finished jobs beyond maxFinishedJobs.
+func (m *jobManager) prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	finished := 0
+	for _, j := range m.jobs {
+		if j.exited() {
+			finished++
+		}
+	}
+
+	kept := m.jobs[:0]
+	for _, j := range m.jobs {
+		if finished > maxFinishedJobs && j.exited() {
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	m.jobs = kept
+}
+
+var jobSignals = map[string]ssh.Signal{
+	"ABRT": ssh.SIGABRT,
+	"ALRM": ssh.SIGALRM,
+	"FPE":  ssh.SIGFPE,
+	"HUP":  ssh.SIGHUP,
+	"ILL":  ssh.SIGILL,
+	"INT":  ssh.SIGINT,
+	"KILL": ssh.SIGKILL,
+	"PIPE": ssh.SIGPIPE,
+	"QUIT": ssh.SIGQUIT,
+	"SEGV": ssh.SIGSEGV,
+	"TERM": ssh.SIGTERM,
+	"USR1": ssh.SIGUSR1,
+	"USR2": ssh.SIGUSR2,
+}
+
+// handleJobs serves /jobs: POST starts a job, GET lists the jobs without their output.
+func (m *jobManager) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var body ExecBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			m.s.log.Warnf("Failed to decode request body: %v", err)
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
+			return
+		}
+
+		if err := body.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+
+		free, err := m.s.ssh.reserve(true)
+		if err != nil {
+			writeSSHError(w, err)
+			return
+		}
+
+		j := m.create(&body, free)
+		m.s.log.Infof("Job %s started: %s", j.id, j.command)
+		writeJSON(w, http.StatusCreated, j.response(0, false))
+	case http.MethodGet:
+		jobs := m.list()
+		resp := make([]*JobResponse, 0, len(jobs))
+		for _, j := range jobs {
+			resp = append(resp, j.response(0, false))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleJob serves /jobs/{id} and /jobs/{id}/stream.
+func (m *jobManager) handleJob(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, apiPrefix+"/jobs/")
+	id, sub, _ := strings.Cut(rest, "/")
+
+	j := m.get(id)
+	if j == nil || (sub != "" && sub != "stream") {
+		writeError(w, http.StatusNotFound, CodeNotFound, r.URL.Path+" not found")
+		return
+	}
+
+	offset, err := parseOffset(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	switch {
+	case sub == "stream" && r.Method == http.MethodGet:
+		m.stream(w, r, j, offset)
+	case sub == "stream":
+		methodNotAllowed(w, r, http.MethodGet)
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, j.response(offset, true))
+	case r.Method == http.MethodDelete:
+		m.delete(w, r, j)
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// parseOffset reads the offset to resume from, the Last-Event-ID header of a reconnecting
+// EventSource takes precedence over the offset query parameter.
+func parseOffset(r *http.Request) (int64, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("offset")
+	}
+	if s == "" {
+		return 0, nil
+	}
+
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset %q", s)
+	}
+
+	return offset, nil
+}
+
+// delete signals a running job, default with TERM, and removes a finished job.
+func (m *jobManager) delete(w http.ResponseWriter, r *http.Request, j *job) {
+	if j.exited() {
+		m.remove(j.id)
+		m.s.log.Infof("Job %s removed", j.id)
+		writeJSON(w, http.StatusOK, j.response(0, false))
+		return
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(r.URL.Query().Get("signal")), "SIG")
+	if name == "" {
+		name = "TERM"
+	}
+
+	sig, ok := jobSignals[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("unknown signal %q", name))
+		return
+	}
+
+	select {
+	case j.signals <- sig:
+		m.s.log.Infof("Send signal %s to job %s", name, j.id)
+	default:
+		// a signal is still pending, the command has not started yet
+		writeError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("a signal to job %s is still pending, %s was not sent", j.id, name))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, j.response(0, false))
+}
+
+// stream sends the output after offset as the events of /exec, each with the offset following it as ID,
+// and ends with the exit event once the job exited.
+func (m *jobManager) stream(w http.ResponseWriter, r *http.Request, j *job, offset int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		chunks, exit, changed := j.since(offset)
+		for _, c := range chunks {
+			offset = c.offset + int64(len(c.data))
+			data, _ := json.Marshal(newExecOutput(c.data))
+			_, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", offset, c.stream, data)
+		}
+
+		if exit != nil {
+			data, _ := json.Marshal(exit)
+			_, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", offset, ExecEventExit, data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-time.After(3 * time.Second):
+			_, _ = fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestJob returns a job that does not run a command, its output and exit are added by the test.
+func newTestJob(command string) *job {
+	return &job{
+		id:      newJobID(),
+		command: command,
+		created: time.Now(),
+		signals: make(chan ssh.Signal, 1),
+		changed: make(chan struct{}),
+	}
+}
+
+func serveJobs(t *testing.T, s *Restful, method, uri string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.mux().ServeHTTP(w, httptest.NewRequest(method, uri, bytes.NewReader(b)))
+
+	return w
+}
+
+func TestJobsPrune(t *testing.T) {
+	m := newJobManager(newTestRestful(t))
+
+	var running, finished []*job
+	for i := 0; i < maxFinishedJobs+8; i++ {
+		j := newTestJob("true")
+		j.add(execEvent{name: ExecEventExit, exit: &ExecExit{}})
+		m.jobs = append(m.jobs, j)
+		finished = append(finished, j)
+
+		// the running jobs are never removed, however old they are
+		if i%10 == 0 {
+			r := newTestJob("sleep")
+			running = append(running, r)
+			m.jobs = append(m.jobs, r)
+		}
+	}
+	m.prune()
+
+	if len(m.jobs) != maxFinishedJobs+len(running) {
+		t.Errorf("%d jobs kept, want %d finished and %d running", len(m.jobs), maxFinishedJobs, len(running))
+	}
+
+	for _, j := range running {
+		if m.get(j.id) == nil {
+			t.Errorf("running job %s was removed", j.id)
+		}
+	}
+	for i, j := range finished {
+		if kept := m.get(j.id) != nil; kept != (i >= 8) {
+			t.Errorf("finished job %d kept = %v, want only the newest %d", i, kept, maxFinishedJobs)
+		}
+	}
+}
+
+func TestJobOutputTruncation(t *testing.T) {
+	j := newTestJob("cat")
+
+	const chunk = 1024 * 1024
+	for i := 0; i < 6; i++ {
+		j.add(execEvent{name: ExecEventStdout, output: bytes.Repeat([]byte{byte('a' + i)}, chunk)})
+	}
+
+	resp := j.response(0, true)
+	if resp.OutputStart != 2*chunk || resp.OutputEnd != 6*chunk {
+		t.Errorf("output = [%d, %d), want [%d, %d)", resp.OutputStart, resp.OutputEnd, 2*chunk, 6*chunk)
+	}
+
+	total := 0
+	for _, o := range resp.Output {
+		b, err := o.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(b)
+	}
+	if total != maxJobOutput || resp.Output[0].Offset != 2*chunk {
+		t.Errorf("%d bytes from offset %d, want the newest %d", total, resp.Output[0].Offset, maxJobOutput)
+	}
+
+	// a single chunk larger than the buffer is kept whole
+	big := newTestJob("cat")
+	big.add(execEvent{name: ExecEventStdout, output: make([]byte, maxJobOutput+1)})
+	if resp := big.response(0, false); resp.OutputStart != 0 || resp.OutputEnd != maxJobOutput+1 {
+		t.Errorf("output = [%d, %d), want the whole chunk", resp.OutputStart, resp.OutputEnd)
+	}
+}
+
+func TestJobOffsetRead(t *testing.T) {
+	s := newTestRestful(t)
+	s.jobs = newJobManager(s)
+
+	j := newTestJob("echo")
+	j.add(execEvent{name: ExecEventStdout, output: []byte("hello ")})
+	j.add(execEvent{name: ExecEventStderr, output: []byte("oops ")})
+	j.add(execEvent{name: ExecEventStdout, output: []byte("world")})
+	s.jobs.jobs = append(s.jobs.jobs, j)
+
+	tests := []struct {
+		offset string
+		want   []string
+	}{
+		{offset: "", want: []string{"stdout:hello ", "stderr:oops ", "stdout:world"}},
+		{offset: "3", want: []string{"stdout:lo ", "stderr:oops ", "stdout:world"}},
+		{offset: "6", want: []string{"stderr:oops ", "stdout:world"}},
+		{offset: "13", want: []string{"stdout:rld"}},
+		{offset: "16", want: []string{}},
+		{offset: "100", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		w := serveJobs(t, s, http.MethodGet, apiPrefix+"/jobs/"+j.id+"?offset="+tt.offset, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("offset %s: status %d, body %s", tt.offset, w.Code, w.Body)
+		}
+
+		var resp JobResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, o := range resp.Output {
+			b, _ := o.Bytes()
+			got = append(got, o.Stream+":"+string(b))
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("offset %s: output = %q, want %q", tt.offset, got, tt.want)
+		}
+		if resp.OutputEnd != 16 || resp.Status != JobRunning {
+			t.Errorf("offset %s: end = %d, status = %s, want 16 and running", tt.offset, resp.OutputEnd, resp.Status)
+		}
+	}
+
+	if w := serveJobs(t, s, http.MethodGet, apiPrefix+"/jobs/"+j.id+"?offset=-1", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("negative offset: status %d, want 400", w.Code)
+	}
+}
+
+func TestJobSignals(t *testing.T) {
+	s := newTestRestful(t)
+	s.jobs = newJobManager(s)
+
+	j := newTestJob("sleep")
+	s.jobs.jobs = append(s.jobs.jobs, j)
+	uri := apiPrefix + "/jobs/" + j.id
+
+	if w := serveJobs(t, s, http.MethodDelete, uri+"?signal=NOPE", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown signal: status %d, want 400", w.Code)
+	}
+
+	if w := serveJobs(t, s, http.MethodDelete, uri+"?signal=sigint", nil); w.Code != http.StatusOK {
+		t.Errorf("INT: status %d, body %s", w.Code, w.Body)
+	}
+
+	// the command has not taken the signal yet
+	w := serveJobs(t, s, http.MethodDelete, uri, nil)
+	var resp ErrorResponse
+	if w.Code != http.StatusConflict || json.Unmarshal(w.Body.Bytes(), &resp) != nil || resp.Code != CodeConflict {
+		t.Errorf("pending signal: status %d, body %s, want 409 conflict", w.Code, w.Body)
+	}
+	if sig := <-j.signals; sig != ssh.SIGINT {
+		t.Errorf("signal = %s, want INT", sig)
+	}
+
+	// a finished job is removed
+	j.add(execEvent{name: ExecEventExit, exit: &ExecExit{Signal: string(ssh.SIGINT), Code: -1}})
+	if w := serveJobs(t, s, http.MethodDelete, uri, nil); w.Code != http.StatusOK {
+		t.Errorf("remove: status %d, body %s", w.Code, w.Body)
+	}
+	if w := serveJobs(t, s, http.MethodGet, uri, nil); w.Code != http.StatusNotFound {
+		t.Errorf("removed job: status %d, want 404", w.Code)
+	}
+}
+
+func TestJobRun(t *testing.T) {
+	s, _ := newGuestRestful(t)
+
+	w := serveJobs(t, s, http.MethodPost, apiPrefix+"/jobs", &ExecBody{Command: "echo a && sleep 0.2 && echo b"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", w.Code, w.Body)
+	}
+
+	var created JobResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp JobResponse
+	for deadline := time.Now().Add(10 * time.Second); resp.Status != JobExited; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("job did not exit")
+		}
+
+		w := serveJobs(t, s, http.MethodGet, apiPrefix+"/jobs/"+created.ID, nil)
+		resp = JobResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	for _, o := range resp.Output {
+		b, _ := o.Bytes()
+		out.Write(b)
+	}
+	if out.String() != "a\nb\n" || resp.Exit == nil || resp.Exit.Code != 0 {
+		t.Errorf("job = %+v, output %q, want a and b with exit code 0", resp, out.String())
+	}
+
+	// the long session was released
+	if h := s.ssh.health(); h.LongSessions != 0 || h.ActiveSessions != 0 {
+		t.Errorf("sessions = %d long, %d active, want none", h.LongSessions, h.ActiveSessions)
+	}
+}
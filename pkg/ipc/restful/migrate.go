@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/go-infinity-channel"
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/utils"
+)
+
+// migrateDialAttempts bounds how often Migrate dials sshd, about a minute with the backoff.
+const migrateDialAttempts = 60
+
+// Migrate runs the -data-migrate command in the guest, with the old data disk attached read-only.
+// Its output is written to the log and the result is sent as a migrate event, a failed migration
+// does not stop the virtual machine, the old data disk is still kept as a backup and the migration
+// stays pending in versions.json, so that the next start runs it again. The command is run with sh -c,
+// like exec, once sshd of the guest accepts connections.
+func (s *Restful) Migrate(ctx context.Context) {
+	m := s.opt.DataMigration
+	if m == nil {
+		return
+	}
+
+	s.log.Infof("migrate data from version %s to %s, old data disk: %s", m.FromVersion, m.ToVersion, m.OldDataPath)
+
+	body := &ExecBody{
+		Command: m.Command,
+		Env: map[string]string{
+			"OVM_OLD_DATA_DEVICE":   cli.OldDataDevice,
+			"OVM_DATA_VERSION_FROM": m.FromVersion,
+			"OVM_DATA_VERSION_TO":   m.ToVersion,
+		},
+	}
+
+	free, err := s.ssh.reserve(false)
+	if err == nil {
+		if err = s.waitSSH(ctx); err != nil {
+			free()
+		}
+	}
+	if err != nil {
+		s.log.Warnf("migrate data failed: %v", err)
+		s.ev.NotifyMigrate(m.FromVersion, m.ToVersion, -1, err.Error())
+		return
+	}
+
+	events := infinity.NewChannel[execEvent]()
+	go s.exec(ctx, body, free, events, nil)
+
+	exit := &ExecExit{Code: -1}
+	for e := range events.Out() {
+		if e.exit != nil {
+			exit = e.exit
+			continue
+		}
+
+		for _, line := range strings.Split(strings.TrimRight(string(e.output), "\n"), "\n") {
+			s.log.Infof("migrate %s: %s", e.name, line)
+		}
+	}
+
+	if exit.Code != 0 {
+		s.log.Warnf("migrate data failed, exit code %d: %s", exit.Code, exit.Error)
+	} else {
+		s.log.Infof("migrate data done in %dms", exit.DurationMs)
+	}
+
+	s.ev.NotifyMigrate(m.FromVersion, m.ToVersion, exit.Code, exit.Error)
+
+	if exit.Code == 0 {
+		if err := s.opt.DataMigrated(); err != nil {
+			s.log.Warnf("clear the pending data migration failed: %v", err)
+		}
+	}
+}
+
+// waitSSH connects to the guest. The guest reports ready before sshd may accept connections,
+// so the dial is retried with backoff, a wrong host key is not.
+func (s *Restful) waitSSH(ctx context.Context) error {
+	backoff := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		_, _, err := s.ssh.get()
+		if err == nil {
+			return nil
+		}
+
+		if i >= migrateDialAttempts || errors.Is(err, utils.ErrHostKeyMismatch) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, time.Second)
+	}
+}
@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/oomol-lab/ovm/pkg/cli"
+)
+
+// pendingMigration sets a pending migration of command in a versions.json of a temporary directory,
+// it returns the path of the file the command may write to.
+func pendingMigration(t *testing.T, s *Restful, command string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	s.opt.VersionsPath = filepath.Join(dir, "versions.json")
+	data := `{"data":"2","migration":{"backup":"` + filepath.Join(dir, "data.img.bak") + `","from":"1","to":"2"}}`
+	if err := os.WriteFile(s.opt.VersionsPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.opt.DataMigration = &cli.DataMigration{
+		Command:     command,
+		OldDataPath: filepath.Join(dir, "data.img.bak"),
+		FromVersion: "1",
+		ToVersion:   "2",
+	}
+
+	return filepath.Join(dir, "out")
+}
+
+// isPending reports whether versions.json still has the pending migration.
+func isPending(t *testing.T, s *Restful) bool {
+	t.Helper()
+
+	b, err := os.ReadFile(s.opt.VersionsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct {
+		Migration json.RawMessage `json:"migration"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	return v.Migration != nil
+}
+
+func TestMigrateCompoundCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		wantOut     string
+		wantPending bool
+	}{
+		{
+			name:    "every step runs",
+			command: "echo $OVM_DATA_VERSION_FROM > %[1]s && echo $OVM_DATA_VERSION_TO >> %[1]s; echo done >> %[1]s",
+			wantOut: "1\n2\ndone\n",
+		},
+		{
+			name:        "failed step",
+			command:     "echo 1 > %[1]s && false && echo 2 >> %[1]s",
+			wantOut:     "1\n",
+			wantPending: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newGuestRestful(t)
+			out := pendingMigration(t, s, "")
+			s.opt.DataMigration.Command = fmt.Sprintf(tt.command, shellQuote(out))
+
+			s.Migrate(context.Background())
+
+			b, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantOut {
+				t.Errorf("output = %q, want %q", b, tt.wantOut)
+			}
+			if got := isPending(t, s); got != tt.wantPending {
+				t.Errorf("pending = %v, want %v", got, tt.wantPending)
+			}
+		})
+	}
+}
+
+// refuseFirst forwards the connections to port, after closing the first n of them, like a guest whose sshd is
+// not up yet. It returns the port to connect to.
+func refuseFirst(t *testing.T, port int, n int32) int {
+	t.Helper()
+
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = nl.Close()
+	})
+
+	var count atomic.Int32
+	go func() {
+		for {
+			conn, err := nl.Accept()
+			if err != nil {
+				return
+			}
+
+			if count.Add(1) <= n {
+				_ = conn.Close()
+				continue
+			}
+
+			go func() {
+				defer conn.Close()
+
+				upstream, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				go func() {
+					_, _ = io.Copy(upstream, conn)
+				}()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return nl.Addr().(*net.TCPAddr).Port
+}
+
+func TestMigrateWaitsForSSH(t *testing.T) {
+	s, sshd := newGuestRestful(t)
+	out := pendingMigration(t, s, "")
+	s.opt.DataMigration.Command = "echo migrated > " + shellQuote(out)
+	s.opt.SSHPort = refuseFirst(t, sshd.Port(), 3)
+
+	s.Migrate(context.Background())
+
+	if b, err := os.ReadFile(out); err != nil || string(b) != "migrated\n" {
+		t.Errorf("output = %q, %v, want the migration to run once sshd is up", b, err)
+	}
+	if isPending(t, s) {
+		t.Error("the migration is still pending")
+	}
+}
+
+func TestMigrateHostKeyMismatch(t *testing.T) {
+	s, _ := newGuestRestful(t)
+	pendingMigration(t, s, "true")
+	s.opt.SSHHostKey = newSigner(t).PublicKey()
+
+	s.Migrate(context.Background())
+
+	if !isPending(t, s) {
+		t.Error("the migration is not pending after the host key did not match")
+	}
+	if h := s.ssh.health(); h.ActiveSessions != 0 {
+		t.Errorf("active sessions = %d, want the reservation released", h.ActiveSessions)
+	}
+}
@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPI describes the routes under apiPrefix. Keep it in sync with Restful.routes, TestOpenAPIMatchesRoutes checks it.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+func serveOpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPI)
+}
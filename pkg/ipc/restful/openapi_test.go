@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type openAPIDocument struct {
+	Info struct {
+		Description string `json:"description"`
+	} `json:"info"`
+	Paths map[string]json.RawMessage `json:"paths"`
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(openAPI, &doc); err != nil {
+		t.Fatalf("parse openapi.json: %v", err)
+	}
+
+	var unversioned []string
+	for _, rt := range (&Restful{}).routes() {
+		p := rt.path
+		if strings.HasSuffix(p, "/") {
+			p += "{id}"
+		}
+		if _, ok := doc.Paths[p]; !ok {
+			t.Errorf("route %s is not described in openapi.json", rt.path)
+		}
+
+		if !rt.versionedOnly {
+			unversioned = append(unversioned, rt.path)
+		}
+	}
+
+	_, list, ok := strings.Cut(doc.Info.Description, "without the /v1 prefix:")
+	if !ok {
+		t.Fatalf("description does not list the routes served without the /v1 prefix: %q", doc.Info.Description)
+	}
+	list, _, _ = strings.Cut(list, ", which")
+	described := regexp.MustCompile(`/[a-z-]+`).FindAllString(list, -1)
+
+	slices.Sort(unversioned)
+	slices.Sort(described)
+	if !slices.Equal(unversioned, described) {
+		t.Errorf("routes without the /v1 prefix are %v, openapi.json lists %v", unversioned, described)
+	}
+}
@@ -7,32 +7,34 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"strings"
-	"sync"
-	"time"
+	"sync/atomic"
 
-	"github.com/Code-Hex/go-infinity-channel"
-	"github.com/Code-Hex/vz/v3"
 	"github.com/crc-org/vfkit/pkg/config"
 	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
 	"github.com/oomol-lab/ovm/pkg/logger"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 )
 
-type stateResponse struct {
+// StateResponse is the body of GET /state.
+type StateResponse struct {
 	State          string `json:"state"`
 	CanStart       bool   `json:"canStart"`
 	CanRequestStop bool   `json:"canRequestStop"`
 	CanStop        bool   `json:"canStop"`
 	CanPause       bool   `json:"canPause"`
 	CanResume      bool   `json:"canResume"`
+	// SSH is the health of the SSH connection used by exec, jobs and shell.
+	SSH *SSHHealth `json:"ssh"`
 }
 
-type infoResponse struct {
+// InfoResponse is the body of GET /info.
+type InfoResponse struct {
 	PodmanSocketPath  string `json:"podmanSocketPath"`
 	SSHPort           int    `json:"sshPort"`
 	SSHUser           string `json:"sshUser"`
@@ -40,182 +42,160 @@ type infoResponse struct {
 	SSHPrivateKeyPath string `json:"sshPrivateKeyPath"`
 	SSHPublicKey      string `json:"sshPublicKey"`
 	SSHPrivateKey     string `json:"sshPrivateKey"`
+	// SSHHostKey is the host key of the guest in authorized_keys format, SSHHostKeyFingerprint its SHA256 fingerprint.
+	SSHHostKey            string `json:"sshHostKey"`
+	SSHHostKeyFingerprint string `json:"sshHostKeyFingerprint"`
+	// KnownHostsPath is the private known_hosts file of the instance holding the host key for 127.0.0.1 at SSHPort.
+	KnownHostsPath string `json:"knownHostsPath"`
 }
 
 type Restful struct {
-	vz  *vz.VirtualMachine
+	vm  hypervisor.VirtualMachine
 	vmC *config.VirtualMachine
 	log *logger.Context
 	opt *cli.Context
+	ev  *event.Context
+
+	ssh  *sshPool
+	jobs *jobManager
+
+	// stopRequested is set once a stop or request stop succeeded.
+	stopRequested atomic.Bool
 }
 
-func New(vz *vz.VirtualMachine, vmC *config.VirtualMachine, log *logger.Context, opt *cli.Context) *Restful {
-	return &Restful{
-		vz:  vz,
+func New(vm hypervisor.VirtualMachine, vmC *config.VirtualMachine, log *logger.Context, opt *cli.Context, ev *event.Context) *Restful {
+	s := &Restful{
+		vm:  vm,
 		vmC: vmC,
 		log: log,
 		opt: opt,
+		ev:  ev,
 	}
+	s.ssh = newSSHPool(s.dialSSH, func() bool {
+		return vm.State() == hypervisor.StateRunning
+	}, log)
+	s.jobs = newJobManager(s)
+
+	return s
 }
 
-type powerSaveModeBody struct {
+// PowerSaveModeBody is the body of PUT /power-save-mode.
+type PowerSaveModeBody struct {
 	Enable bool `json:"enable"`
 }
 
-type execBody struct {
-	Command string `json:"command"`
+// apiPrefix is the prefix of the current API version. The routes are also served without it,
+// for the clients written before the API was versioned.
+const apiPrefix = "/v1"
+
+type route struct {
+	path string
+	// method is the only allowed method. Empty if handler checks the method itself.
+	method  string
+	handler http.HandlerFunc
+	// versionedOnly routes are not served without apiPrefix.
+	versionedOnly bool
+	// legacyHandler, if set, serves the route without apiPrefix instead of handler.
+	legacyHandler http.HandlerFunc
 }
 
-func (s *Restful) mux() *http.ServeMux {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "get only", http.StatusBadRequest)
-			return
-		}
-
-		_ = json.NewEncoder(w).Encode(s.info())
-	})
-	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "get only", http.StatusBadRequest)
-			return
-		}
-
-		_ = json.NewEncoder(w).Encode(s.state())
-	})
-	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "post only", http.StatusBadRequest)
-			return
-		}
-
-		if err := s.pause(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
-	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "post only", http.StatusBadRequest)
-			return
-		}
+func (s *Restful) routes() []route {
+	return []route{
+		{path: "/info", method: http.MethodGet, handler: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, s.info())
+		}},
+		{path: "/state", method: http.MethodGet, handler: func(w http.ResponseWriter, r *http.Request) {
+			s.log.Info("request /state")
+			writeJSON(w, http.StatusOK, s.state())
+		}},
+		{path: "/pause", method: http.MethodPost, handler: func(w http.ResponseWriter, r *http.Request) {
+			s.changeState(w, "pause", s.vm.CanPause, s.pause)
+		}},
+		{path: "/resume", method: http.MethodPost, handler: func(w http.ResponseWriter, r *http.Request) {
+			s.changeState(w, "resume", s.vm.CanResume, s.resume)
+		}},
+		{path: "/request-stop", method: http.MethodPost, handler: func(w http.ResponseWriter, r *http.Request) {
+			s.changeState(w, "request stop", s.vm.CanRequestStop, s.requestStop)
+		}},
+		{path: "/stop", method: http.MethodPost, handler: func(w http.ResponseWriter, r *http.Request) {
+			s.changeState(w, "stop", s.vm.CanStop, s.stop)
+		}},
+		{path: "/power-save-mode", method: http.MethodPut, handler: func(w http.ResponseWriter, r *http.Request) {
+			var body PowerSaveModeBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				s.log.Warnf("Failed to decode request body: %v", err)
+				writeError(w, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
+				return
+			}
 
-		if err := s.resume(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
-	mux.HandleFunc("/request-stop", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "post only", http.StatusBadRequest)
-			return
-		}
+			s.powerSaveMode(body.Enable)
+			writeJSON(w, http.StatusOK, &body)
+		}},
+		{path: "/exec", method: http.MethodPost, handler: s.handleExec(false), legacyHandler: s.handleExec(true)},
+		{path: "/jobs", handler: s.jobs.handleJobs, versionedOnly: true},
+		{path: "/jobs/", handler: s.jobs.handleJob, versionedOnly: true},
+		{path: "/events", method: http.MethodGet, handler: s.handleEvents, versionedOnly: true},
+		{path: "/events/stats", method: http.MethodGet, handler: s.handleEventStats, versionedOnly: true},
+		{path: "/files", handler: s.handleFiles, versionedOnly: true},
+		{path: "/shell", method: http.MethodGet, handler: s.handleShell, versionedOnly: true},
+		{path: "/openapi.json", method: http.MethodGet, handler: serveOpenAPI, versionedOnly: true},
+	}
+}
 
-		if err := s.requestStop(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	})
-	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "post only", http.StatusBadRequest)
-			return
-		}
+func (s *Restful) mux() *http.ServeMux {
+	mux := http.NewServeMux()
 
-		if err := s.stop(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	for _, rt := range s.routes() {
+		h, legacy := rt.handler, rt.handler
+		if rt.legacyHandler != nil {
+			legacy = rt.legacyHandler
 		}
-	})
-	mux.HandleFunc("/power-save-mode", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			http.Error(w, "put only", http.StatusBadRequest)
-			return
+		if rt.method != "" {
+			h, legacy = allowMethod(rt.method, h), allowMethod(rt.method, legacy)
 		}
 
-		var body powerSaveModeBody
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			s.log.Warnf("Failed to decode request body: %v", err)
-			http.Error(w, "failed to decode request body", http.StatusBadRequest)
-			return
+		mux.HandleFunc(apiPrefix+rt.path, h)
+		if !rt.versionedOnly {
+			mux.HandleFunc(rt.path, legacy)
 		}
+	}
 
-		s.powerSaveMode(body.Enable)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, CodeNotFound, r.URL.Path+" not found")
 	})
-	mux.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "post only", http.StatusBadRequest)
-			return
-		}
 
-		var body execBody
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			s.log.Warnf("Failed to decode request body: %v", err)
-			http.Error(w, "failed to decode request body", http.StatusBadRequest)
-			return
-		}
+	return mux
+}
 
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+// changeState answers 409 when the virtual machine can not do the action in its current state,
+// otherwise it runs do and answers the resulting state.
+func (s *Restful) changeState(w http.ResponseWriter, action string, can func() bool, do func() error) {
+	if !can() {
+		writeError(w, http.StatusConflict, CodeInvalidState, fmt.Sprintf("can not %s virtual machine in state %s", action, s.vm.State()))
+		return
+	}
 
-		if _, ok := w.(http.Flusher); !ok {
-			s.log.Warnf("Bowser does not support server-sent events")
-			return
-		}
+	if err := do(); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
 
-		outCh := infinity.NewChannel[string]()
-		errCh := make(chan string, 1)
-		doneCh := make(chan struct{}, 1)
+	writeJSON(w, http.StatusOK, s.state())
+}
 
-		go func() {
-			if err := s.exec(r.Context(), body.Command, outCh, errCh); err != nil {
-				s.log.Warnf("Failed to execute command: %v", err)
-			}
+// Handler returns the handler of the API, e.g. to serve it with an httptest.Server.
+func (s *Restful) Handler() http.Handler {
+	return s.mux()
+}
 
-			doneCh <- struct{}{}
-			outCh.Close()
-			close(errCh)
-		}()
-
-		defer func() {
-			select {
-			case <-r.Context().Done():
-				// pass
-			default:
-				_, _ = fmt.Fprintf(w, "event: done\n")
-				_, _ = fmt.Fprintf(w, "data: done\n\n")
-				w.(http.Flusher).Flush()
-			}
-		}()
+func (s *Restful) Start(ctx context.Context, g *errgroup.Group, nl net.Listener) {
+	s.jobs.ctx = ctx
 
-		for {
-			select {
-			case <-doneCh:
-				s.log.Warnf("Command execution finished")
-				return
-			case err := <-errCh:
-				_, _ = fmt.Fprintf(w, "event: error\n")
-				_, _ = fmt.Fprintf(w, "data: %s\n\n", encodeSSE(err))
-				w.(http.Flusher).Flush()
-				continue
-			case out := <-outCh.Out():
-				_, _ = fmt.Fprintf(w, "event: out\n")
-				_, _ = fmt.Fprintf(w, "data: %s\n\n", encodeSSE(out))
-				w.(http.Flusher).Flush()
-				continue
-			case <-r.Context().Done():
-				s.log.Warnf("Client closed connection")
-				return
-			case <-time.After(3 * time.Second):
-				_, _ = fmt.Fprintf(w, ": ping\n\n")
-				w.(http.Flusher).Flush()
-				continue
-			}
-		}
+	g.Go(func() error {
+		s.ssh.keepAlive(ctx)
+		return nil
 	})
 
-	return mux
-}
-
-func (s *Restful) Start(ctx context.Context, g *errgroup.Group, nl net.Listener) {
 	g.Go(func() error {
 		<-ctx.Done()
 		return nl.Close()
@@ -229,9 +209,14 @@ func (s *Restful) Start(ctx context.Context, g *errgroup.Group, nl net.Listener)
 	})
 }
 
-func (s *Restful) info() *infoResponse {
+// StopRequested reports whether the virtual machine was asked to stop through the API.
+func (s *Restful) StopRequested() bool {
+	return s.stopRequested.Load()
+}
+
+func (s *Restful) info() *InfoResponse {
 	s.log.Info("request /info")
-	return &infoResponse{
+	return &InfoResponse{
 		PodmanSocketPath:  s.opt.ForwardSocketPath,
 		SSHPort:           s.opt.SSHPort,
 		SSHUser:           "root",
@@ -239,24 +224,28 @@ func (s *Restful) info() *infoResponse {
 		SSHPrivateKeyPath: s.opt.SSHPrivateKeyPath,
 		SSHPublicKey:      s.opt.SSHPublicKey,
 		SSHPrivateKey:     s.opt.SSHPrivateKey,
+
+		SSHHostKey:            strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.opt.SSHHostKey))),
+		SSHHostKeyFingerprint: ssh.FingerprintSHA256(s.opt.SSHHostKey),
+		KnownHostsPath:        s.opt.KnownHostsPath,
 	}
 }
 
-func (s *Restful) state() *stateResponse {
-	s.log.Info("request /state")
-	return &stateResponse{
-		State:          s.vz.State().String(),
-		CanStart:       s.vz.CanStart(),
-		CanRequestStop: s.vz.CanRequestStop(),
-		CanStop:        s.vz.CanStop(),
-		CanPause:       s.vz.CanPause(),
-		CanResume:      s.vz.CanResume(),
+func (s *Restful) state() *StateResponse {
+	return &StateResponse{
+		State:          s.vm.State().String(),
+		CanStart:       s.vm.CanStart(),
+		CanRequestStop: s.vm.CanRequestStop(),
+		CanStop:        s.vm.CanStop(),
+		CanPause:       s.vm.CanPause(),
+		CanResume:      s.vm.CanResume(),
+		SSH:            s.ssh.health(),
 	}
 }
 
 func (s *Restful) pause() error {
 	s.log.Info("request /pause")
-	err := s.vz.Pause()
+	err := s.vm.Pause()
 	if err != nil {
 		s.log.Warnf("request pause VM failed: %v", err)
 	}
@@ -266,31 +255,42 @@ func (s *Restful) pause() error {
 
 func (s *Restful) resume() error {
 	s.log.Info("request /resume")
-	err := s.vz.Resume()
+	err := s.vm.Resume()
 	if err != nil {
 		s.log.Warnf("request resume VM failed: %v", err)
+		return err
 	}
 
-	return err
+	// the connection may not have survived the pause, find out before the next session needs it
+	go s.ssh.check()
+
+	return nil
 }
 
 func (s *Restful) requestStop() error {
 	s.log.Info("request /requestStop")
-	ok, err := s.vz.RequestStop()
+	// set before, the VM may be stopped before RequestStop returns
+	s.stopRequested.Store(true)
+	ok, err := s.vm.RequestStop()
 	if err != nil {
 		s.log.Warnf("request requestStop VM failed: %v", err)
 	} else if !ok {
 		err = fmt.Errorf("request requestStop VM failed, ok is false")
 		s.log.Warnf("request requestStop VM failed: %v", err)
 	}
+	if err != nil {
+		s.stopRequested.Store(false)
+	}
 
 	return err
 }
 
 func (s *Restful) stop() error {
 	s.log.Info("request /stop")
-	err := s.vz.Stop()
+	s.stopRequested.Store(true)
+	err := s.vm.Stop()
 	if err != nil {
+		s.stopRequested.Store(false)
 		s.log.Warnf("request stop VM failed: %v", err)
 	}
 
@@ -301,88 +301,3 @@ func (s *Restful) powerSaveMode(enable bool) {
 	s.log.Info("request /powerSaveMode")
 	s.opt.PowerSaveMode = enable
 }
-
-func (s *Restful) exec(ctx context.Context, command string, outCh *infinity.Channel[string], errCh chan string) error {
-	s.log.Info("request /exec")
-
-	conf := &ssh.ClientConfig{
-		User:            "root",
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(s.opt.SSHSigner),
-		},
-	}
-
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.opt.SSHPort), conf)
-	if err != nil {
-		errCh <- fmt.Sprintf("dial ssh error: %v", err)
-		return fmt.Errorf("dial ssh error: %w", err)
-	}
-	defer conn.Close()
-
-	context.AfterFunc(ctx, func() {
-		_ = conn.Close()
-	})
-
-	session, err := conn.NewSession()
-	if err != nil {
-		errCh <- fmt.Sprintf("new ssh session error: %v", err)
-		return fmt.Errorf("new ssh session error: %w", err)
-	}
-	defer session.Close()
-
-	w := ch2Writer(outCh)
-	session.Stdout = w
-	stderr := recordWriter(w)
-	session.Stderr = stderr
-
-	if err := session.Run(command); err != nil {
-		newErr := fmt.Errorf("%s\n%s", stderr.LastRecord(), err)
-		errCh <- fmt.Sprintf(newErr.Error())
-		return fmt.Errorf("run ssh command error: %w", newErr)
-	}
-
-	return nil
-}
-
-type chWriter struct {
-	ch *infinity.Channel[string]
-	mu sync.Mutex
-}
-
-func (w *chWriter) Write(p []byte) (n int, err error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.ch.In() <- string(p)
-	return len(p), nil
-}
-
-func ch2Writer(ch *infinity.Channel[string]) io.Writer {
-	return &chWriter{
-		ch: ch,
-	}
-}
-
-type writer struct {
-	w    io.Writer
-	last []byte
-}
-
-func (w *writer) Write(p []byte) (n int, err error) {
-	w.last = p
-	return w.w.Write(p)
-}
-
-func (w *writer) LastRecord() string {
-	return string(w.last)
-}
-
-func recordWriter(w io.Writer) *writer {
-	return &writer{
-		w: w,
-	}
-}
-
-func encodeSSE(str string) string {
-	return strings.ReplaceAll(strings.TrimSpace(str), "\n", "\ndata: ")
-}
@@ -0,0 +1,245 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+)
+
+// /v1/shell upgrades to a WebSocket attached to a login shell on a PTY in the guest.
+//
+// Framing:
+//   - Binary frames carry raw terminal bytes in both directions: keystrokes from the client,
+//     terminal output from the server. They can be passed to and from xterm.js as they are.
+//   - Text frames carry a ShellMessage as JSON. The client sends "resize" whenever the terminal
+//     size changes, the server sends "exit" once the shell ended, right before closing the connection.
+//
+// The initial terminal is set with the query parameters cols, rows (default 80x24) and term
+// (default xterm-256color). user opens the shell as that guest user instead of root.
+
+// The types of ShellMessage.
+const (
+	ShellMessageResize = "resize"
+	ShellMessageExit   = "exit"
+)
+
+// ShellMessage is a control message of /v1/shell, sent as a WebSocket text frame.
+type ShellMessage struct {
+	Type string `json:"type"`
+	// Cols and Rows are the new terminal size of a resize message.
+	Cols uint32 `json:"cols,omitempty"`
+	Rows uint32 `json:"rows,omitempty"`
+	// Exit is the result of the shell in an exit message.
+	Exit *ExecExit `json:"exit,omitempty"`
+}
+
+type shellOptions struct {
+	cols uint32
+	rows uint32
+	term string
+	user string
+}
+
+func parseShellOptions(r *http.Request) (*shellOptions, error) {
+	q := r.URL.Query()
+	o := &shellOptions{
+		cols: 80,
+		rows: 24,
+		term: "xterm-256color",
+		user: q.Get("user"),
+	}
+
+	if t := q.Get("term"); t != "" {
+		o.term = t
+	}
+
+	for name, v := range map[string]*uint32{"cols": &o.cols, "rows": &o.rows} {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid %s %q", name, s)
+		}
+		*v = uint32(n)
+	}
+
+	return o, nil
+}
+
+// shellFrame is a WebSocket frame together with its type.
+type shellFrame struct {
+	payloadType byte
+	data        []byte
+}
+
+var shellCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		f := v.(*shellFrame)
+		return f.data, f.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		f := v.(*shellFrame)
+		f.payloadType = payloadType
+		f.data = data
+		return nil
+	},
+}
+
+type shellWriter struct {
+	ws *websocket.Conn
+}
+
+func (w *shellWriter) Write(p []byte) (n int, err error) {
+	if err := shellCodec.Send(w.ws, &shellFrame{payloadType: websocket.BinaryFrame, data: p}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *Restful) handleShell(w http.ResponseWriter, r *http.Request) {
+	o, err := parseShellOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	// the handler runs within ServeHTTP, the session is released once the shell exited
+	free, err := s.ssh.reserve(true)
+	if err != nil {
+		writeSSHError(w, err)
+		return
+	}
+	defer free()
+
+	server := websocket.Server{
+		// The socket is only reachable by the local user, there is no browser origin to check.
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			s.shell(ws, o)
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+func (s *Restful) shell(ws *websocket.Conn, o *shellOptions) {
+	s.log.Info("request /shell")
+
+	start := time.Now()
+	exit := &ExecExit{Code: -1}
+	defer func() {
+		exit.DurationMs = time.Since(start).Milliseconds()
+		if exit.Error != "" {
+			s.log.Warnf("Shell failed: %s", exit.Error)
+		}
+
+		data, _ := json.Marshal(&ShellMessage{Type: ShellMessageExit, Exit: exit})
+		_ = shellCodec.Send(ws, &shellFrame{payloadType: websocket.TextFrame, data: data})
+		_ = ws.Close()
+	}()
+
+	session, err := s.ssh.open()
+	if err != nil {
+		exit.Error = err.Error()
+		return
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(o.term, int(o.rows), int(o.cols), modes); err != nil {
+		exit.Error = fmt.Sprintf("request pty error: %v", err)
+		return
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		exit.Error = fmt.Sprintf("stdin pipe error: %v", err)
+		return
+	}
+
+	session.Stdout = &shellWriter{ws: ws}
+	session.Stderr = session.Stdout
+
+	if o.user == "" || o.user == "root" {
+		err = session.Shell()
+	} else {
+		err = session.Start("su -l " + shellQuote(o.user))
+	}
+	if err != nil {
+		exit.Error = fmt.Sprintf("start shell error: %v", err)
+		return
+	}
+
+	// end the shell when the client goes away
+	go func() {
+		s.receiveShell(ws, session, stdin)
+		_ = session.Close()
+	}()
+
+	err = session.Wait()
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		exit.Code = 0
+	case errors.As(err, &exitErr):
+		if exitErr.Signal() == "" {
+			exit.Code = exitErr.ExitStatus()
+		}
+		exit.Signal = exitErr.Signal()
+		exit.Error = err.Error()
+	default:
+		exit.Error = err.Error()
+	}
+}
+
+// receiveShell forwards the frames of the client to the shell until the client closes the connection.
+func (s *Restful) receiveShell(ws *websocket.Conn, session *ssh.Session, stdin io.WriteCloser) {
+	defer stdin.Close()
+
+	for {
+		var f shellFrame
+		if err := shellCodec.Receive(ws, &f); err != nil {
+			return
+		}
+
+		if f.payloadType == websocket.BinaryFrame {
+			if _, err := stdin.Write(f.data); err != nil {
+				return
+			}
+			continue
+		}
+
+		var msg ShellMessage
+		if err := json.Unmarshal(f.data, &msg); err != nil {
+			s.log.Warnf("Invalid shell message: %v", err)
+			continue
+		}
+
+		if msg.Type == ShellMessageResize && msg.Cols != 0 && msg.Rows != 0 {
+			if err := session.WindowChange(int(msg.Rows), int(msg.Cols)); err != nil {
+				s.log.Warnf("Resize shell error: %v", err)
+			}
+		}
+	}
+}
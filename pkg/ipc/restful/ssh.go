@@ -0,0 +1,315 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/logger"
+	"github.com/oomol-lab/ovm/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxSSHSessions matches the MaxSessions default of OpenSSH, the guest refuses more sessions on one connection.
+	maxSSHSessions = 10
+	// maxLongSSHSessions caps the sessions jobs and shells hold for their whole lifetime,
+	// the others are left for exec, files and the data migration.
+	maxLongSSHSessions   = 6
+	sshKeepAliveInterval = 5 * time.Second
+)
+
+// errSSHBusy is returned instead of waiting for a session when the pool is full.
+var errSSHBusy = errors.New("too many ssh sessions are open, try again later")
+
+// SSHHealth is the state of the SSH connection to the guest shared by exec, jobs and shell.
+type SSHHealth struct {
+	Connected      bool       `json:"connected"`
+	ConnectedAt    *time.Time `json:"connectedAt,omitempty"`
+	LastKeepAlive  *time.Time `json:"lastKeepAlive,omitempty"`
+	ActiveSessions int        `json:"activeSessions"`
+	MaxSessions    int        `json:"maxSessions"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+
+	// LongSessions are the sessions held by jobs and shells, at most MaxLongSessions.
+	LongSessions    int `json:"longSessions"`
+	MaxLongSessions int `json:"maxLongSessions"`
+}
+
+// dialSSH connects to the guest as root with the SSH key of ovm, the guest must present the host key installed by ignition.
+func (s *Restful) dialSSH() (*ssh.Client, error) {
+	conf := &ssh.ClientConfig{
+		User:              "root",
+		HostKeyCallback:   utils.HostKeyCallback(s.opt.SSHHostKey),
+		HostKeyAlgorithms: []string{s.opt.SSHHostKey.Type()},
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(s.opt.SSHSigner),
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	conn, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.opt.SSHPort), conf)
+	if err != nil {
+		return nil, fmt.Errorf("dial ssh error: %w", err)
+	}
+
+	return conn, nil
+}
+
+// sshPool keeps one SSH connection to the guest and multiplexes sessions over it.
+// The connection is made on first use and made again after it broke, e.g. after the guest restarted sshd
+// or the connection through gvproxy went stale while the virtual machine was paused.
+type sshPool struct {
+	dial   func() (*ssh.Client, error)
+	active func() bool
+	log    *logger.Context
+
+	// sessions holds a token for every open session, long also holds one for the sessions of jobs and shells.
+	sessions chan struct{}
+	long     chan struct{}
+
+	// dialMu makes concurrent sessions share one connection attempt.
+	dialMu sync.Mutex
+
+	mu            sync.Mutex
+	client        *ssh.Client
+	connectedAt   time.Time
+	lastKeepAlive time.Time
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// newSSHPool creates a pool connecting with dial. Keepalives are only sent while active returns true.
+func newSSHPool(dial func() (*ssh.Client, error), active func() bool, log *logger.Context) *sshPool {
+	return &sshPool{
+		dial:     dial,
+		active:   active,
+		log:      log,
+		sessions: make(chan struct{}, maxSSHSessions),
+		long:     make(chan struct{}, maxLongSSHSessions),
+	}
+}
+
+// reserve takes a session of the pool, long ones are for jobs and shells. It does not wait,
+// errSSHBusy is returned when the pool is full. release must be called once the session is closed.
+func (p *sshPool) reserve(long bool) (release func(), err error) {
+	if long {
+		select {
+		case p.long <- struct{}{}:
+		default:
+			return nil, errSSHBusy
+		}
+	}
+
+	select {
+	case p.sessions <- struct{}{}:
+	default:
+		if long {
+			<-p.long
+		}
+		return nil, errSSHBusy
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-p.sessions
+			if long {
+				<-p.long
+			}
+		})
+	}, nil
+}
+
+// open opens a session on a reservation of reserve, the caller closes it.
+func (p *sshPool) open() (*ssh.Session, error) {
+	for {
+		client, fresh, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+
+		session, err := client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+
+		err = fmt.Errorf("new ssh session error: %w", err)
+		p.drop(client, err)
+
+		// a new connection failing will not get better by connecting again
+		if fresh {
+			return nil, err
+		}
+	}
+}
+
+// session reserves and opens a short session, release must be called once it is no longer used.
+func (p *sshPool) session() (session *ssh.Session, release func(), err error) {
+	free, err := p.reserve(false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err = p.open()
+	if err != nil {
+		free()
+		return nil, nil, err
+	}
+
+	return session, func() {
+		_ = session.Close()
+		free()
+	}, nil
+}
+
+// get returns the connection, connecting first if there is none. fresh reports whether it was just connected.
+func (p *sshPool) get() (client *ssh.Client, fresh bool, err error) {
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+
+	p.mu.Lock()
+	client = p.client
+	p.mu.Unlock()
+
+	if client != nil {
+		return client, false, nil
+	}
+
+	client, err = p.dial()
+	if err != nil {
+		p.mu.Lock()
+		p.setError(err)
+		p.mu.Unlock()
+		return nil, false, err
+	}
+
+	p.mu.Lock()
+	p.client = client
+	p.connectedAt = time.Now()
+	p.mu.Unlock()
+	p.log.Info("SSH connection to the guest established")
+
+	go func() {
+		_ = client.Wait()
+		p.drop(client, errors.New("ssh connection closed"))
+	}()
+
+	return client, true, nil
+}
+
+// drop closes client if it is still the connection of the pool, the next session connects again.
+func (p *sshPool) drop(client *ssh.Client, reason error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != client {
+		return
+	}
+
+	p.log.Warnf("Drop SSH connection to the guest: %v", reason)
+	p.setError(reason)
+	p.client = nil
+	_ = client.Close()
+}
+
+func (p *sshPool) setError(err error) {
+	p.lastError = err.Error()
+	p.lastErrorAt = time.Now()
+}
+
+// keepAlive checks the connection every sshKeepAliveInterval until ctx is done, then closes it.
+func (p *sshPool) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.mu.Lock()
+			client := p.client
+			p.mu.Unlock()
+
+			if client != nil {
+				p.drop(client, context.Cause(ctx))
+			}
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// check sends a keepalive over the connection, if any, and drops it when the guest does not answer in time.
+func (p *sshPool) check() {
+	if !p.active() {
+		return
+	}
+
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		// OpenSSH answers unknown requests with a failure, any answer means the connection is alive
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			p.drop(client, fmt.Errorf("ssh keepalive error: %w", err))
+			return
+		}
+
+		p.mu.Lock()
+		p.lastKeepAlive = time.Now()
+		p.mu.Unlock()
+	case <-time.After(sshKeepAliveInterval):
+		p.drop(client, errors.New("ssh keepalive timed out"))
+	}
+}
+
+func (p *sshPool) health() *SSHHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := &SSHHealth{
+		Connected:      p.client != nil,
+		ActiveSessions: len(p.sessions),
+		MaxSessions:    maxSSHSessions,
+		LastError:      p.lastError,
+
+		LongSessions:    len(p.long),
+		MaxLongSessions: maxLongSSHSessions,
+	}
+
+	if p.client != nil {
+		h.ConnectedAt = timePtr(p.connectedAt)
+		if !p.lastKeepAlive.IsZero() && p.lastKeepAlive.After(p.connectedAt) {
+			h.LastKeepAlive = timePtr(p.lastKeepAlive)
+		}
+	}
+
+	if !p.lastErrorAt.IsZero() {
+		h.LastErrorAt = timePtr(p.lastErrorAt)
+	}
+
+	return h
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package restful
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHPoolLimits(t *testing.T) {
+	p := newSSHPool(nil, func() bool { return true }, newTestRestful(t).log)
+
+	var long []func()
+	for i := 0; i < maxLongSSHSessions; i++ {
+		release, err := p.reserve(true)
+		if err != nil {
+			t.Fatalf("long session %d: %v", i, err)
+		}
+		long = append(long, release)
+	}
+	if _, err := p.reserve(true); !errors.Is(err, errSSHBusy) {
+		t.Errorf("long session beyond %d: %v, want busy", maxLongSSHSessions, err)
+	}
+
+	// the short sessions get the rest
+	var short []func()
+	for i := maxLongSSHSessions; i < maxSSHSessions; i++ {
+		release, err := p.reserve(false)
+		if err != nil {
+			t.Fatalf("short session %d: %v", i, err)
+		}
+		short = append(short, release)
+	}
+	if _, err := p.reserve(false); !errors.Is(err, errSSHBusy) {
+		t.Errorf("session beyond %d: %v, want busy", maxSSHSessions, err)
+	}
+
+	// a release counts once, however often it is called
+	long[0]()
+	short[0]()
+	long[0]()
+	if h := p.health(); h.ActiveSessions != maxSSHSessions-2 || h.LongSessions != maxLongSSHSessions-1 {
+		t.Errorf("health = %+v, want %d active and %d long", h, maxSSHSessions-2, maxLongSSHSessions-1)
+	}
+
+	release, err := p.reserve(true)
+	if err != nil {
+		t.Fatalf("long session after a release: %v", err)
+	}
+	if _, err := p.reserve(true); !errors.Is(err, errSSHBusy) {
+		t.Errorf("long session beyond %d: %v, want busy", maxLongSSHSessions, err)
+	}
+	// the refused long reservation took no session
+	if _, err := p.reserve(false); err != nil {
+		t.Errorf("short session: %v", err)
+	}
+	release()
+
+	if h := p.health(); h.MaxSessions != maxSSHSessions || h.MaxLongSessions != maxLongSSHSessions {
+		t.Errorf("health = %+v, want the limits %d and %d", h, maxSSHSessions, maxLongSSHSessions)
+	}
+}
+
+func TestSSHPoolReleaseOnError(t *testing.T) {
+	dials := 0
+	p := newSSHPool(func() (*ssh.Client, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}, func() bool { return true }, newTestRestful(t).log)
+
+	for i := 0; i < maxSSHSessions+1; i++ {
+		if _, _, err := p.session(); err == nil || errors.Is(err, errSSHBusy) {
+			t.Fatalf("session %d: %v, want the dial error", i, err)
+		}
+	}
+
+	h := p.health()
+	if h.ActiveSessions != 0 || h.Connected || h.LastError != "connection refused" || h.LastErrorAt == nil {
+		t.Errorf("health = %+v, want no session and the dial error", h)
+	}
+	if dials != maxSSHSessions+1 {
+		t.Errorf("%d dials, want one per session", dials)
+	}
+}
+
+func TestSSHPoolReconnect(t *testing.T) {
+	s, sshd := newGuestRestful(t)
+
+	session, release, err := s.ssh.session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := session.Output("echo a"); err != nil || string(out) != "a\n" {
+		t.Errorf("output = %q, %v", out, err)
+	}
+	release()
+
+	s.ssh.check()
+	h := s.ssh.health()
+	if !h.Connected || h.ActiveSessions != 0 || h.LastKeepAlive == nil {
+		t.Errorf("health = %+v, want connected with a keepalive", h)
+	}
+
+	// sshd restarted in the guest, the next session connects again
+	sshd.CloseConnections()
+	waitForHealth(t, s, func(h *SSHHealth) bool { return !h.Connected })
+
+	_, release, err = s.ssh.session()
+	if err != nil {
+		t.Fatalf("session after the connection broke: %v", err)
+	}
+	release()
+	if h := s.ssh.health(); !h.Connected || h.LastError != "ssh connection closed" {
+		t.Errorf("health = %+v, want connected again", h)
+	}
+}
+
+func TestSSHPoolKeepAliveTeardown(t *testing.T) {
+	s, _ := newGuestRestful(t)
+
+	if _, _, err := s.ssh.get(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ssh.keepAlive(ctx)
+	}()
+
+	cancel(errors.New("ovm exits"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepAlive did not return")
+	}
+
+	if h := s.ssh.health(); h.Connected || h.LastError != "ovm exits" {
+		t.Errorf("health = %+v, want the connection closed with the cause", h)
+	}
+}
+
+func TestSSHPoolInactive(t *testing.T) {
+	s, _ := newGuestRestful(t)
+
+	if _, _, err := s.ssh.get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a paused guest does not answer, the connection is kept until it runs again
+	s.ssh.active = func() bool { return false }
+	s.ssh.check()
+	if h := s.ssh.health(); !h.Connected || h.LastKeepAlive != nil {
+		t.Errorf("health = %+v, want connected without a keepalive", h)
+	}
+}
+
+func waitForHealth(t *testing.T, s *Restful, cond func(h *SSHHealth) bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(s.ssh.health()); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("health = %+v, condition not met in 5s", s.ssh.health())
+		}
+	}
+}
@@ -12,8 +12,6 @@ import (
 	"time"
 )
 
-var cs = make([]*Context, 0, 10)
-
 func NewWithoutManage(p, n string) (*Context, error) {
 	c := &Context{
 		path: p,
@@ -30,24 +28,6 @@ func NewWithoutManage(p, n string) (*Context, error) {
 	return c, nil
 }
 
-func New(p, n string) (*Context, error) {
-	c := &Context{
-		path: p,
-		name: n,
-		syncWriter: syncWriter{
-			m:    sync.Mutex{},
-			file: nil,
-		},
-	}
-	if err := c.init(); err != nil {
-		return nil, err
-	}
-
-	cs = append(cs, c)
-
-	return c, nil
-}
-
 func NewWithoutStream(p, n string) (string, error) {
 	c := &Context{
 		path: p,
@@ -68,10 +48,33 @@ func NewWithoutStream(p, n string) (string, error) {
 	return path.Join(p, n+".log"), nil
 }
 
-func CloseAll() {
-	for _, c := range cs {
+// Group keeps track of the loggers created by one ovm instance, so that they can be closed together.
+type Group struct {
+	m  sync.Mutex
+	cs []*Context
+}
+
+func (g *Group) New(p, n string) (*Context, error) {
+	c, err := NewWithoutManage(p, n)
+	if err != nil {
+		return nil, err
+	}
+
+	g.m.Lock()
+	g.cs = append(g.cs, c)
+	g.m.Unlock()
+
+	return c, nil
+}
+
+func (g *Group) CloseAll() {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	for _, c := range g.cs {
 		_ = c.file.Close()
 	}
+	g.cs = nil
 }
 
 type syncWriter struct {
@@ -0,0 +1,13 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package ovm
+
+import (
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+	"github.com/oomol-lab/ovm/pkg/hypervisor/vzbackend"
+)
+
+func defaultBackend() hypervisor.Backend {
+	return vzbackend.New()
+}
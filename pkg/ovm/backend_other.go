@@ -0,0 +1,13 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin
+
+package ovm
+
+import "github.com/oomol-lab/ovm/pkg/hypervisor"
+
+// defaultBackend returns nil, there is no hypervisor outside of macOS. Set Config.Backend instead.
+func defaultBackend() hypervisor.Backend {
+	return nil
+}
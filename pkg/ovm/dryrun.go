@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package ovm
+
+import (
+	"github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/gvproxy"
+	"github.com/oomol-lab/ovm/pkg/vfkit"
+)
+
+// Plan is everything Run would do for a configuration.
+type Plan struct {
+	VM        *vfkit.Plan          `json:"vm"`
+	Network   *types.Configuration `json:"network"`
+	Artifacts []cli.Artifact       `json:"artifacts"`
+}
+
+// DryRun resolves cfg the same way as Run, without locking, deleting sockets, copying artifacts or booting.
+func DryRun(cfg Config) (*Plan, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, &Error{Stage: StageValidate, Err: err}
+	}
+
+	opt := cli.Init(&cfg.Options)
+	if err := opt.Plan(); err != nil {
+		return nil, &Error{Stage: StageSetup, Err: err}
+	}
+
+	vm, err := vfkit.NewPlan(opt)
+	if err != nil {
+		return nil, &Error{Stage: StageSetup, Err: err}
+	}
+
+	// the search domains are optional, gvproxy also starts without them
+	domains, _ := gvproxy.SearchDomains()
+
+	return &Plan{
+		VM:        vm,
+		Network:   gvproxy.Configuration(opt, domains),
+		Artifacts: opt.Artifacts,
+	}, nil
+}
@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package ovm
+
+import "fmt"
+
+// Stage is the step of Run in which an error occurred.
+type Stage string
+
+const (
+	StageValidate       Stage = "validate flags"
+	StagePreSetup       Stage = "pre setup"
+	StageSingleInstance Stage = "make single instance"
+	StageLogger         Stage = "create ovm logger"
+	StageEvent          Stage = "event init"
+	StageSetup          Stage = "setup"
+	StageSSHAgent       Stage = "start ssh agent sock"
+	StageReadySocket    Stage = "create ready socket"
+	StageMain           Stage = "main"
+)
+
+// Error is the error returned by Run. Use errcode.Of to classify it and errcode.ExitCode for the exit code of the process.
+type Error struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error: %v", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
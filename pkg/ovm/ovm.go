@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package ovm runs an ovm-core virtual machine in-process.
+package ovm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/channel"
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
+	"github.com/oomol-lab/ovm/pkg/gvproxy"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
+	"github.com/oomol-lab/ovm/pkg/logger"
+	"github.com/oomol-lab/ovm/pkg/sshagentsock"
+	"github.com/oomol-lab/ovm/pkg/utils"
+	"github.com/oomol-lab/ovm/pkg/vfkit"
+	"golang.org/x/sync/errgroup"
+)
+
+// Config is the configuration of a virtual machine started by Run.
+type Config struct {
+	cli.Options
+
+	// Backend creates the virtual machine. The Virtualization framework is used when it is nil.
+	Backend hypervisor.Backend
+	// Timeouts overrides the timeouts of the boot and the shutdown, e.g. to let tests of a misbehaving guest fail fast.
+	Timeouts cli.Timeouts
+}
+
+// Run starts the virtual machine and blocks until it exits.
+//
+// Canceling ctx stops the virtual machine, the cause of ctx is reported as the reason of the exit.
+// A cause that is an *errcode.Error keeps its code, any other gets errcode.Canceled.
+// The error is never nil, it is an *Error with the reason of the exit, e.g. errcode.VMStopped
+// after a poweroff in the guest, see errcode.Of for its code.
+func Run(ctx context.Context, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return &Error{Stage: StageValidate, Err: errcode.Wrap(errcode.InvalidConfig, err)}
+	}
+
+	backend := cfg.Backend
+	if backend == nil {
+		if backend = defaultBackend(); backend == nil {
+			return &Error{Stage: StageValidate, Err: errcode.New(errcode.VMCreateFailed, "no hypervisor backend is available on this platform")}
+		}
+	}
+
+	opt := cli.Init(&cfg.Options)
+	opt.Timeouts = cfg.Timeouts.WithDefaults()
+	defer opt.Loggers.CloseAll()
+
+	if err := opt.PreSetup(); err != nil {
+		return &Error{Stage: StagePreSetup, Err: errcode.Wrap(errcode.SetupFailed, err)}
+	}
+
+	lock, err := makeSingleInstance(opt.LogPath, opt.LockFile, opt.ExecutablePath)
+	if err != nil {
+		return &Error{Stage: StageSingleInstance, Err: errcode.Wrap(errcode.InstanceLocked, err)}
+	}
+	defer lock.Unlock()
+
+	log, err := opt.Loggers.New(opt.LogPath, opt.Name+"-ovm")
+	if err != nil {
+		return &Error{Stage: StageLogger, Err: errcode.Wrap(errcode.SetupFailed, err)}
+	}
+
+	ev, err := event.New(opt)
+	if err != nil {
+		_ = log.Errorf("event init error: %v", err)
+		return &Error{Stage: StageEvent, Err: errcode.Wrap(errcode.SetupFailed, err)}
+	}
+	defer ev.NotifyExit()
+
+	ev.NotifyApp(event.Preparing)
+
+	if err := opt.Setup(ctx, ev.NotifyPrepare); err != nil {
+		_ = log.Errorf("setup error: %v", err)
+		err = &Error{Stage: StageSetup, Err: errcode.Wrap(errcode.SetupFailed, err)}
+		ev.NotifyShutdown(err)
+		ev.NotifyError(err)
+		return err
+	}
+
+	ch := channel.New()
+	defer ch.Close()
+
+	agent, err := sshagentsock.Start(opt.SSHAuthSocketPath, log)
+	if err != nil {
+		_ = log.Errorf("start ssh agent sock error: %v", err)
+		err = &Error{Stage: StageSSHAgent, Err: errcode.Wrap(errcode.SetupFailed, err)}
+		ev.NotifyError(err)
+		return err
+	}
+
+	ev.NotifyApp(event.Initializing)
+	ev.NotifySSHAgent(opt.SSHAuthSocketPath)
+	for _, a := range opt.Artifacts {
+		if s := a.Copy; s != nil {
+			log.Infof("copied %s to %s: %s", a.Source, a.Target, s)
+		}
+		if a.Repair {
+			log.Warnf("%s was repaired from %s: %s", a.Target, a.Source, a.Reason)
+			ev.NotifyRepair(a.Name, a.Target, a.Reason)
+		}
+	}
+
+	// The errgroup context is not derived from ctx, so that the cancellation of ctx is reported
+	// as the error of the group (see below) instead of whichever goroutine notices it first.
+	g, gctx := errgroup.WithContext(context.WithoutCancel(ctx))
+
+	// ready
+	{
+		nl, err := net.Listen("unix", opt.SocketReadyPath)
+		if err != nil {
+			_ = agent.Close()
+			_ = log.Errorf("create ready socket error: %v", err)
+			err = &Error{Stage: StageReadySocket, Err: errcode.Wrap(errcode.SetupFailed, err)}
+			ev.NotifyError(err)
+			return err
+		}
+
+		g.Go(func() error {
+			if err := waitReady(gctx, nl, opt.Timeouts.Ready, log); err != nil {
+				return err
+			}
+
+			ch.NotifyVMReady()
+			ev.NotifyApp(event.Ready)
+
+			if opt.DataMigration != nil {
+				ch.NotifyDataMigrate()
+			}
+
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		<-gctx.Done()
+		ev.NotifyShutdown(context.Cause(gctx))
+		return agent.Close()
+	})
+
+	g.Go(func() error {
+		waitBindPID(gctx, log, opt.BindPID)
+		if gctx.Err() == nil {
+			ev.NotifyBindPIDExit(opt.BindPID)
+		}
+		return errcode.New(errcode.BindPIDExited, "bind pid %d is not alive", opt.BindPID)
+	})
+
+	g.Go(func() error {
+		return gvproxy.Run(gctx, g, opt, ch, ev)
+	})
+
+	g.Go(func() error {
+		return vfkit.Run(gctx, g, opt, backend, ch, ev)
+	})
+
+	g.Go(func() error {
+		select {
+		case <-ctx.Done():
+			return errcode.Wrap(errcode.Canceled, context.Cause(ctx))
+		case <-gctx.Done():
+			return nil
+		}
+	})
+
+	// the group always fails, the goroutine of the bind pid returns an error once the others are done
+	err = g.Wait()
+	reason := context.Cause(gctx)
+	_ = log.Errorf("main error: %v, reason: %v", err, reason)
+	err = &Error{Stage: StageMain, Err: fmt.Errorf("%w, reason: %v", err, reason)}
+	ev.NotifyError(err)
+
+	return err
+}
+
+// waitReady waits until the guest sends "Ready" on the ready socket. A connection that closes
+// without it, e.g. a guest that crashed while connecting, is ignored and the guest may connect again.
+func waitReady(ctx context.Context, nl net.Listener, timeout time.Duration, log *logger.Context) error {
+	deadline := time.Now().Add(timeout)
+	timer := time.After(timeout)
+
+	for {
+		conn, err := utils.AcceptTimeout(ctx, nl, timer)
+		if errors.Is(err, utils.ErrAcceptTimeout) {
+			return errcode.New(errcode.ReadyTimeout, "ready accept timeout: %w", err)
+		}
+		if err != nil {
+			return fmt.Errorf("ready accept failed: %w", err)
+		}
+
+		_ = conn.SetReadDeadline(deadline)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		_ = conn.Close()
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = nl.Close()
+			return errcode.New(errcode.ReadyTimeout, "read ready timeout: %w", err)
+		}
+		if err == nil && strings.TrimSpace(line) == "Ready" {
+			return nil
+		}
+
+		log.Warnf("ignore the ready connection, read %q: %v", line, err)
+	}
+}
@@ -0,0 +1,481 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package ovm_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+	"github.com/oomol-lab/ovm/pkg/hypervisor/fake"
+	"github.com/oomol-lab/ovm/pkg/ipc/client"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
+	"github.com/oomol-lab/ovm/pkg/ipc/restful"
+	"github.com/oomol-lab/ovm/pkg/ovm"
+	"github.com/oomol-lab/ovm/pkg/testing/fakeguest"
+)
+
+// testVM is a virtual machine run by ovm.Run with the fake backend and a fake guest.
+type testVM struct {
+	backend *fake.Backend
+	guest   *fakeguest.Guest
+	client  *client.Client
+
+	cancel context.CancelCauseFunc
+	done   chan error
+}
+
+// shortTempDir is a temporary directory for unix sockets, whose paths are limited to about 100 bytes.
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "ovm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+func newConfig(t *testing.T) ovm.Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range []string{"kernel", "initrd", "rootfs"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ovm.Config{
+		Options: cli.Options{
+			Name:       "test",
+			LogPath:    filepath.Join(dir, "logs"),
+			SocketPath: shortTempDir(t),
+			SSHKeyPath: filepath.Join(dir, "ssh"),
+			CPUS:       1,
+			Memory:     512,
+			KernelPath: filepath.Join(dir, "kernel"),
+			InitrdPath: filepath.Join(dir, "initrd"),
+			RootfsPath: filepath.Join(dir, "rootfs"),
+			TargetPath: filepath.Join(dir, "target"),
+			Versions:   map[string]string{"kernel": "1", "initrd": "1", "rootfs": "1", "data": "1"},
+			EventSinks: []string{"file"},
+		},
+	}
+}
+
+// start runs cfg with a fake guest, script changes the behavior of the guest before it boots.
+// The virtual machine is canceled and waited for when the test ends.
+func start(t *testing.T, cfg ovm.Config, script func(g *fakeguest.Guest)) *testVM {
+	t.Helper()
+
+	backend := fake.New(shortTempDir(t))
+	cfg.Backend = backend
+
+	guest := fakeguest.New(backend.VsockPath)
+	if script != nil {
+		script(guest)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	vm := &testVM{
+		backend: backend,
+		guest:   guest,
+		client:  client.New(client.SocketPath(cfg.SocketPath, cfg.Name)),
+		cancel:  cancel,
+		done:    make(chan error, 1),
+	}
+
+	guestCtx, guestCancel := context.WithCancel(context.Background())
+	guestDone := make(chan struct{})
+	go func() {
+		defer close(guestDone)
+		_ = guest.Run(guestCtx)
+	}()
+
+	go func() {
+		vm.done <- ovm.Run(ctx, cfg)
+	}()
+
+	t.Cleanup(func() {
+		cancel(errors.New("test done"))
+		<-vm.done
+		guestCancel()
+		<-guestDone
+	})
+
+	return vm
+}
+
+// wait waits for ovm.Run to return.
+func (vm *testVM) wait(t *testing.T, timeout time.Duration) error {
+	t.Helper()
+
+	select {
+	case err := <-vm.done:
+		vm.done <- err
+		return err
+	case <-time.After(timeout):
+		t.Fatalf("ovm.Run did not return in %s", timeout)
+		return nil
+	}
+}
+
+// waitEvent waits for the first event of typ with message, as seen by a client of the restful API.
+// It fails the test if ovm exits or timeout expires first.
+func (vm *testVM) waitEvent(t *testing.T, typ, message string, timeout time.Duration) *event.Event {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the restful socket is listening once the virtual machine is created
+	var events <-chan client.EventMessage
+	for events == nil {
+		ch, err := vm.client.Events(ctx, 0)
+		if err == nil {
+			events = ch
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("connect to the restful socket: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	for m := range events {
+		if m.Err != nil {
+			t.Fatalf("wait for %s %s event: %v", typ, message, m.Err)
+		}
+		if m.Event.Type == typ && m.Event.Message == message {
+			return m.Event
+		}
+	}
+
+	t.Fatalf("no %s %s event before the stream ended: %v", typ, message, ctx.Err())
+	return nil
+}
+
+// sentEvents returns the events written to the file sink, they are complete once ovm.Run returned.
+func sentEvents(t *testing.T, cfg ovm.Config) []event.Event {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join(cfg.LogPath, cfg.Name+"-events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []event.Event
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e event.Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+// messages returns the messages of the events of typ, for state events the state changed to.
+func messages(t *testing.T, events []event.Event, typ string) []string {
+	t.Helper()
+
+	var messages []string
+	for _, e := range events {
+		if e.Type != typ {
+			continue
+		}
+
+		if typ != event.TypeState {
+			messages = append(messages, e.Message)
+			continue
+		}
+
+		var data event.StateData
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			t.Fatalf("decode state event: %v", err)
+		}
+		messages = append(messages, strings.TrimPrefix(data.To, "VirtualMachineState"))
+	}
+
+	return messages
+}
+
+func TestRunGuestScripts(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts cli.Timeouts
+		script   func(g *fakeguest.Guest)
+		want     errcode.Code
+	}{
+		{
+			name:     "late ready",
+			timeouts: cli.Timeouts{Ready: 10 * time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ready.Delay = 2 * time.Second
+			},
+			// the test stops the virtual machine once it is ready
+			want: errcode.Signal,
+		},
+		{
+			name:     "ignition too late",
+			timeouts: cli.Timeouts{Ignition: time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ignition.Delay = 3 * time.Second
+			},
+			want: errcode.IgnitionTimeout,
+		},
+		{
+			name:     "no ignition",
+			timeouts: cli.Timeouts{Ignition: time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ignition.Skip = true
+			},
+			want: errcode.IgnitionTimeout,
+		},
+		{
+			name:     "no ready",
+			timeouts: cli.Timeouts{Ready: 3 * time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ready.Skip = true
+			},
+			want: errcode.ReadyTimeout,
+		},
+		{
+			name:     "ready disconnect",
+			timeouts: cli.Timeouts{Ready: 3 * time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ready.Disconnect = true
+			},
+			want: errcode.ReadyTimeout,
+		},
+		{
+			name:     "garbage ready",
+			timeouts: cli.Timeouts{Ready: 3 * time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ready.Payload = []byte("\x00\xffnot ready\n")
+			},
+			want: errcode.ReadyTimeout,
+		},
+		{
+			name:     "ready without newline",
+			timeouts: cli.Timeouts{Ready: 3 * time.Second},
+			script: func(g *fakeguest.Guest) {
+				g.Ready.Payload = []byte("Ready")
+			},
+			want: errcode.ReadyTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig(t)
+			cfg.Timeouts = tt.timeouts
+			vm := start(t, cfg, tt.script)
+
+			if tt.want == errcode.Signal {
+				vm.waitEvent(t, event.TypeApp, string(event.Ready), 20*time.Second)
+				vm.cancel(errcode.New(errcode.Signal, "test stops the virtual machine"))
+
+				if _, err := vm.guest.WaitIgnition(context.Background()); err != nil || !vm.guest.ReadySent() {
+					t.Errorf("guest ignition %v, ready sent %v", err, vm.guest.ReadySent())
+				}
+			}
+
+			err := vm.wait(t, 20*time.Second)
+			if got := errcode.Of(err); got != tt.want {
+				t.Errorf("ovm.Run error code = %s, want %s, error: %v", got.Name, tt.want.Name, err)
+			}
+		})
+	}
+}
+
+func TestRunBoot(t *testing.T) {
+	cfg := newConfig(t)
+	vm := start(t, cfg, nil)
+
+	vm.waitEvent(t, event.TypeApp, string(event.Ready), 20*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := vm.client.Info(ctx)
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+
+	script, err := vm.guest.WaitIgnition(ctx)
+	if err != nil {
+		t.Fatalf("WaitIgnition: %v", err)
+	}
+	for _, want := range []string{info.SSHPublicKey, "ssh_host_ed25519_key", "VSOCK-CONNECT:2:1026"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("ignition script has no %q: %s", want, script)
+		}
+	}
+
+	state, err := vm.client.State(ctx)
+	if err != nil || state.State != "VirtualMachineStateRunning" {
+		t.Fatalf("State = %+v, %v, want running", state, err)
+	}
+
+	vm.cancel(errcode.New(errcode.Signal, "test stops the virtual machine"))
+	if err := vm.wait(t, 20*time.Second); errcode.Of(err) != errcode.Signal {
+		t.Errorf("ovm.Run error = %v, want a signal error", err)
+	}
+
+	events := sentEvents(t, cfg)
+	wantApp := []string{"Preparing", "Initializing", "GVProxyReady", "IgnitionProgress", "IgnitionDone", "Ready"}
+	if got := messages(t, events, event.TypeApp); !reflect.DeepEqual(got, wantApp) {
+		t.Errorf("app events = %v, want %v", got, wantApp)
+	}
+	if last := events[len(events)-1]; last.Type != event.TypeExit {
+		t.Errorf("last event = %s, want exit", last.Type)
+	}
+}
+
+func TestRunStopVM(t *testing.T) {
+	tests := []struct {
+		name string
+		// ignoreRequestStop is a guest that does not power off when asked to.
+		ignoreRequestStop bool
+		// poweroff stops the virtual machine from the guest instead of canceling ovm.Run.
+		poweroff    bool
+		wantCode    errcode.Code
+		wantStates  []string
+		minDuration time.Duration
+	}{
+		{
+			name:       "request stop",
+			wantCode:   errcode.Signal,
+			wantStates: []string{"Starting", "Running", "Stopping", "Stopped"},
+		},
+		{
+			name:              "force stop",
+			ignoreRequestStop: true,
+			wantCode:          errcode.Signal,
+			wantStates:        []string{"Starting", "Running", "Stopped"},
+			minDuration:       2 * time.Second,
+		},
+		{
+			name:       "poweroff in the guest",
+			poweroff:   true,
+			wantCode:   errcode.VMStopped,
+			wantStates: []string{"Starting", "Running", "Stopped"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig(t)
+			cfg.Timeouts = cli.Timeouts{RequestStop: 2 * time.Second}
+			vm := start(t, cfg, nil)
+
+			vm.waitEvent(t, event.TypeApp, string(event.Ready), 20*time.Second)
+			fakeVM := vm.backend.VirtualMachines()[0]
+			fakeVM.IgnoreRequestStop = tt.ignoreRequestStop
+
+			stopped := time.Now()
+			if tt.poweroff {
+				fakeVM.SetState(hypervisor.StateStopped)
+			} else {
+				vm.cancel(errcode.New(errcode.Signal, "test stops the virtual machine"))
+			}
+
+			// even a clean exit returns its reason
+			err := vm.wait(t, 20*time.Second)
+			var runErr *ovm.Error
+			if !errors.As(err, &runErr) || errcode.Of(err) != tt.wantCode {
+				t.Errorf("ovm.Run error = %v, want an *Error with code %s", err, tt.wantCode.Name)
+			}
+
+			if d := time.Since(stopped); d < tt.minDuration {
+				t.Errorf("stopped in %s, want at least %s", d, tt.minDuration)
+			}
+			if got := messages(t, sentEvents(t, cfg), event.TypeState); !reflect.DeepEqual(got, tt.wantStates) {
+				t.Errorf("states = %v, want %v", got, tt.wantStates)
+			}
+		})
+	}
+}
+
+func TestRunRestfulState(t *testing.T) {
+	tests := []struct {
+		name       string
+		stop       func(c *client.Client, ctx context.Context) (*restful.StateResponse, error)
+		wantStates []string
+	}{
+		{
+			name:       "request stop",
+			stop:       (*client.Client).RequestStop,
+			wantStates: []string{"Starting", "Running", "Pausing", "Paused", "Resuming", "Running", "Stopping", "Stopped"},
+		},
+		{
+			name:       "stop",
+			stop:       (*client.Client).Stop,
+			wantStates: []string{"Starting", "Running", "Pausing", "Paused", "Resuming", "Running", "Stopped"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig(t)
+			vm := start(t, cfg, nil)
+
+			vm.waitEvent(t, event.TypeApp, string(event.Ready), 20*time.Second)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			state, err := vm.client.Pause(ctx)
+			if err != nil || state.State != "VirtualMachineStatePaused" || !state.CanResume {
+				t.Fatalf("Pause = %+v, %v", state, err)
+			}
+
+			var serr *client.StatusError
+			if _, err := vm.client.Pause(ctx); !errors.As(err, &serr) || serr.StatusCode != http.StatusConflict || serr.Code != restful.CodeInvalidState {
+				t.Errorf("Pause when paused = %v, want 409 %s", err, restful.CodeInvalidState)
+			}
+
+			if state, err := vm.client.Resume(ctx); err != nil || state.State != "VirtualMachineStateRunning" {
+				t.Fatalf("Resume = %+v, %v", state, err)
+			}
+
+			// the guest clock is synced after a resume
+			if command, err := vm.guest.WaitTimeSync(ctx); err != nil || !strings.HasPrefix(command, "date -s @") {
+				t.Errorf("time sync after resume = %q, %v", command, err)
+			}
+
+			if _, err := tt.stop(vm.client, ctx); err != nil {
+				t.Fatalf("stop: %v", err)
+			}
+
+			if err := vm.wait(t, 20*time.Second); errcode.Of(err) != errcode.APIStop {
+				t.Errorf("ovm.Run error = %v, want an api stop error", err)
+			}
+			if got := messages(t, sentEvents(t, cfg), event.TypeState); !reflect.DeepEqual(got, tt.wantStates) {
+				t.Errorf("states = %v, want %v", got, tt.wantStates)
+			}
+		})
+	}
+}
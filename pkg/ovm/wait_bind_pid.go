@@ -1,7 +1,7 @@
 // SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
 // SPDX-License-Identifier: MPL-2.0
 
-package main
+package ovm
 
 import (
 	"context"
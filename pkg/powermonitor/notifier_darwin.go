@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package powermonitor
+
+import (
+	"github.com/prashantgupta24/mac-sleep-notifier/notifier"
+)
+
+// startNotifier forwards the sleep and awake notifications of macOS. The returned channel is closed by stop.
+func startNotifier() (activities <-chan activity, stop func()) {
+	src := notifier.GetInstance().Start()
+	dst := make(chan activity)
+
+	go func() {
+		defer close(dst)
+
+		for a := range src {
+			switch a.Type {
+			case notifier.Awake:
+				dst <- awake
+			case notifier.Sleep:
+				dst <- sleep
+			}
+		}
+	}()
+
+	return dst, func() {
+		notifier.GetInstance().Quit()
+		close(src)
+	}
+}
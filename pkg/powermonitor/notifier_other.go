@@ -0,0 +1,15 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin
+
+package powermonitor
+
+// startNotifier never reports any activity, sleep and awake are only watched on macOS.
+func startNotifier() (activities <-chan activity, stop func()) {
+	dst := make(chan activity)
+
+	return dst, func() {
+		close(dst)
+	}
+}
@@ -5,71 +5,86 @@ package powermonitor
 
 import (
 	"context"
+	"fmt"
 
-	"github.com/Code-Hex/vz/v3"
 	"github.com/oomol-lab/ovm/pkg/channel"
 	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
 	"github.com/oomol-lab/ovm/pkg/logger"
-	"github.com/prashantgupta24/mac-sleep-notifier/notifier"
 	"golang.org/x/sync/errgroup"
 )
 
-func Setup(ctx context.Context, g *errgroup.Group, opt *cli.Context, vm *vz.VirtualMachine, log *logger.Context) error {
-	if err := initTimeSync(ctx, g, opt.TimeSyncSocketPath, log); err != nil {
+type activity string
+
+const (
+	awake activity = "awake"
+	sleep activity = "sleep"
+)
+
+func Setup(ctx context.Context, g *errgroup.Group, opt *cli.Context, vm hypervisor.VirtualMachine, ch *channel.Context, ev *event.Context, log *logger.Context) error {
+	if err := initTimeSync(ctx, g, opt.TimeSyncSocketPath, ch, ev, log); err != nil {
 		return err
 	}
 
-	ch := notifier.GetInstance().Start()
+	activityCh, stop := startNotifier()
 
 	log.Info("power monitor started")
 
 	g.Go(func() error {
 		<-ctx.Done()
 		log.Info("power monitor stopping")
-		notifier.GetInstance().Quit()
-		close(ch)
+		stop()
 		log.Info("power monitor stopped")
 		return nil
 	})
 
 	g.Go(func() error {
-		for activity := range ch {
+		for activity := range activityCh {
 
-			log.Infof("os %s, power save mode: %v", activity.Type, opt.PowerSaveMode)
+			log.Infof("os %s, power save mode: %v", activity, opt.PowerSaveMode)
 
-			switch activity.Type {
-			case notifier.Awake:
+			switch activity {
+			case awake:
 				if !opt.PowerSaveMode {
 					log.Info("not power save mode, notify sync time")
-					channel.NotifySyncTime()
+					ev.NotifyPower(string(activity), "sync_time", nil)
+					ch.NotifySyncTime()
 					continue
 				}
 
 				if !vm.CanResume() {
 					log.Warnf("VM can not resume, current state: %s", vm.State())
+					ev.NotifyPower(string(activity), "none", fmt.Errorf("VM can not resume in state %s", vm.State()))
 					continue
 				}
 
 				if err := vm.Resume(); err != nil {
 					log.Warnf("resume VM failed: %v", err)
+					ev.NotifyPower(string(activity), "resume", err)
 				} else {
 					log.Infof("resume VM success")
+					ev.NotifyPower(string(activity), "resume", nil)
 				}
 
-			case notifier.Sleep:
+			case sleep:
 				if !opt.PowerSaveMode {
+					ev.NotifyPower(string(activity), "none", nil)
 					continue
 				}
 
 				if !vm.CanPause() {
 					log.Warnf("VM can not pause, current state: %s", vm.State())
+					ev.NotifyPower(string(activity), "none", fmt.Errorf("VM can not pause in state %s", vm.State()))
 					continue
 				}
 
 				if err := vm.Pause(); err != nil {
 					log.Warnf("pause VM failed: %v", err)
+					ev.NotifyPower(string(activity), "pause", err)
 				} else {
 					log.Infof("pause VM success")
+					ev.NotifyPower(string(activity), "pause", nil)
 				}
 			}
 		}
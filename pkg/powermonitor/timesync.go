@@ -6,20 +6,19 @@ package powermonitor
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/oomol-lab/ovm/pkg/channel"
+	"github.com/oomol-lab/ovm/pkg/ipc/event"
 	"github.com/oomol-lab/ovm/pkg/logger"
 	"golang.org/x/sync/errgroup"
 )
 
-var (
-	timeSyncConn *net.Conn
-)
-
-func initTimeSync(ctx context.Context, g *errgroup.Group, socketPath string, log *logger.Context) error {
+func initTimeSync(ctx context.Context, g *errgroup.Group, socketPath string, ch *channel.Context, ev *event.Context, log *logger.Context) error {
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		return fmt.Errorf("listen time sync socket file error: %w", err)
@@ -30,6 +29,8 @@ func initTimeSync(ctx context.Context, g *errgroup.Group, socketPath string, log
 		return listener.Close()
 	})
 
+	var timeSyncConn atomic.Pointer[net.Conn]
+
 	g.Go(func() error {
 		log.Info("waiting for time sync connection")
 
@@ -38,7 +39,7 @@ func initTimeSync(ctx context.Context, g *errgroup.Group, socketPath string, log
 			return fmt.Errorf("accept time sync socket file error: %w", err)
 		}
 
-		timeSyncConn = &conn
+		timeSyncConn.Store(&conn)
 		log.Info("time sync connected")
 
 		return nil
@@ -50,40 +51,48 @@ func initTimeSync(ctx context.Context, g *errgroup.Group, socketPath string, log
 			case <-ctx.Done():
 				log.Info("cancel sync time event receive")
 				return nil
-			case <-channel.ReceiveSyncTime():
+			case <-ch.ReceiveSyncTime():
 				log.Info("receive sync time event")
 				break
 			}
 
-			if timeSyncConn == nil {
+			conn := timeSyncConn.Load()
+			if conn == nil {
+				ev.NotifyTimeSync(time.Time{}, errors.New("time sync is not connected yet"))
 				continue
 			}
 
 			log.Info("start sync time")
 
-			command := []byte(fmt.Sprintf("date -s @%d", time.Now().Unix()))
+			now := time.Now()
+			command := []byte(fmt.Sprintf("date -s @%d", now.Unix()))
 			length := len(command)
 			header := make([]byte, 2)
 			binary.LittleEndian.PutUint16(header, uint16(length))
 
-			if err := writeConn(header); err != nil {
-				return fmt.Errorf("write time sync header error: %w", err)
+			if err := writeConn(*conn, header); err != nil {
+				err = fmt.Errorf("write time sync header error: %w", err)
+				ev.NotifyTimeSync(time.Time{}, err)
+				return err
 			}
-			if err := writeConn(command); err != nil {
-				return fmt.Errorf("write time sync command error: %w", err)
+			if err := writeConn(*conn, command); err != nil {
+				err = fmt.Errorf("write time sync command error: %w", err)
+				ev.NotifyTimeSync(time.Time{}, err)
+				return err
 			}
 
 			log.Info("sync time success")
+			ev.NotifyTimeSync(now.Truncate(time.Second), nil)
 		}
 	})
 
 	return nil
 }
 
-func writeConn(data []byte) error {
+func writeConn(conn net.Conn, data []byte) error {
 	total := 0
 	for {
-		now, err := (*timeSyncConn).Write(data[total:])
+		now, err := conn.Write(data[total:])
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,283 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+// Package fakeguest plays the guest side of the ovm-core protocols for integration tests.
+// It connects to the host vsock ports like ovm-core does, records what the host sends,
+// and can be scripted to misbehave so that the timeouts and error paths of the host can be asserted.
+// SSHServer stands in for its sshd.
+package fakeguest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The vsock ports used by ovm-core, see vfkit.vmConfig.
+const (
+	PortIgnition uint32 = 1025
+	PortReady    uint32 = 1026
+	PortTimeSync uint32 = 1027
+)
+
+// Script describes how the guest behaves on one port.
+type Script struct {
+	// Delay is waited before connecting, e.g. a slow boot.
+	Delay time.Duration
+	// Skip never connects to the port.
+	Skip bool
+	// Disconnect closes the connection right after connecting, without sending or reading anything.
+	Disconnect bool
+	// Payload replaces what the guest sends after connecting. Only used by the ready port.
+	Payload []byte
+}
+
+type Guest struct {
+	Ignition Script
+	Ready    Script
+	TimeSync Script
+
+	// RetryInterval is the interval between connection attempts while the host is not listening yet.
+	RetryInterval time.Duration
+
+	socketPath func(port uint32) string
+
+	mu           sync.Mutex
+	ignition     []byte
+	ignitionDone chan struct{}
+	readySent    bool
+	timeSync     []string
+	timeSyncCh   chan string
+}
+
+// New creates a guest that reaches the vsock port of the host through the unix socket returned by socketPath,
+// e.g. fake.Backend.VsockPath.
+func New(socketPath func(port uint32) string) *Guest {
+	return &Guest{
+		RetryInterval: 50 * time.Millisecond,
+		socketPath:    socketPath,
+		ignitionDone:  make(chan struct{}),
+		timeSyncCh:    make(chan string, 64),
+	}
+}
+
+// Run boots the guest: the ignition command is received first, then ready is sent.
+// Time sync is served in parallel until ctx is done or the host closes the connection.
+// Once Run returned it can be called again, e.g. to boot the guest of a restarted host,
+// what the previous boot received is cleared when Run starts.
+func (g *Guest) Run(ctx context.Context) error {
+	g.reset()
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		if err := g.runIgnition(ctx); err != nil {
+			return err
+		}
+
+		return g.runReady(ctx)
+	})
+
+	eg.Go(func() error {
+		return g.runTimeSync(ctx)
+	})
+
+	return eg.Wait()
+}
+
+// reset clears what the previous Run received. A WaitIgnition that already waits keeps waiting
+// for this Run, only the channel of a finished ignition is replaced.
+func (g *Guest) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case <-g.ignitionDone:
+		g.ignitionDone = make(chan struct{})
+	default:
+	}
+
+	g.ignition = nil
+	g.readySent = false
+	g.timeSync = nil
+
+	for {
+		select {
+		case <-g.timeSyncCh:
+		default:
+			return
+		}
+	}
+}
+
+// IgnitionScript returns the ignition command received from the host.
+func (g *Guest) IgnitionScript() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return string(g.ignition)
+}
+
+// WaitIgnition waits until the ignition command of the current Run is fully received.
+// Between the end of a Run and the start of the next one, it returns at once.
+func (g *Guest) WaitIgnition(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	done := g.ignitionDone
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-done:
+		return g.IgnitionScript(), nil
+	}
+}
+
+// ReadySent reports whether the ready payload was written to the host.
+func (g *Guest) ReadySent() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.readySent
+}
+
+// TimeSyncCommands returns the time sync commands received so far, e.g. "date -s @1700000000".
+func (g *Guest) TimeSyncCommands() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]string(nil), g.timeSync...)
+}
+
+// WaitTimeSync waits for the next time sync command.
+func (g *Guest) WaitTimeSync(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case command := <-g.timeSyncCh:
+		return command, nil
+	}
+}
+
+func (g *Guest) runIgnition(ctx context.Context) error {
+	conn, err := g.connect(ctx, PortIgnition, g.Ignition)
+	if conn == nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the host closes the connection after writing the command
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("read ignition command error: %w", err)
+	}
+
+	g.mu.Lock()
+	g.ignition = data
+	close(g.ignitionDone)
+	g.mu.Unlock()
+
+	return nil
+}
+
+func (g *Guest) runReady(ctx context.Context) error {
+	conn, err := g.connect(ctx, PortReady, g.Ready)
+	if conn == nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload := g.Ready.Payload
+	if payload == nil {
+		payload = []byte("Ready\n")
+	}
+
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("write ready error: %w", err)
+	}
+
+	g.mu.Lock()
+	g.readySent = true
+	g.mu.Unlock()
+
+	return nil
+}
+
+func (g *Guest) runTimeSync(ctx context.Context) error {
+	conn, err := g.connect(ctx, PortTimeSync, g.TimeSync)
+	if conn == nil {
+		return err
+	}
+	defer conn.Close()
+
+	context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return ignoreClosed(ctx, err)
+		}
+
+		command := make([]byte, binary.LittleEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, command); err != nil {
+			return ignoreClosed(ctx, err)
+		}
+
+		g.mu.Lock()
+		g.timeSync = append(g.timeSync, string(command))
+		g.mu.Unlock()
+
+		select {
+		case g.timeSyncCh <- string(command):
+		default:
+		}
+	}
+}
+
+// connect applies the script and connects to the port. A nil conn means there is nothing more to do on the port.
+func (g *Guest) connect(ctx context.Context, port uint32, script Script) (net.Conn, error) {
+	if script.Skip {
+		return nil, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, nil
+	case <-time.After(script.Delay):
+	}
+
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "unix", g.socketPath(port))
+		if err == nil {
+			if script.Disconnect {
+				return nil, conn.Close()
+			}
+
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(g.RetryInterval):
+		}
+	}
+}
+
+func ignoreClosed(ctx context.Context, err error) error {
+	if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return fmt.Errorf("read time sync command error: %w", err)
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package fakeguest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// host plays the host side of one boot: it writes script on the ignition port and reads the ready line.
+func host(t *testing.T, dir, script string) <-chan string {
+	t.Helper()
+
+	listen := func(port uint32) net.Listener {
+		nl, err := net.Listen("unix", filepath.Join(dir, fmt.Sprintf("%d.sock", port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nl
+	}
+
+	ignition, ready := listen(PortIgnition), listen(PortReady)
+	readyCh := make(chan string, 1)
+	go func() {
+		defer ignition.Close()
+		defer ready.Close()
+		defer close(readyCh)
+
+		conn, err := ignition.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte(script))
+		_ = conn.Close()
+
+		conn, err = ready.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		readyCh <- line
+	}()
+
+	return readyCh
+}
+
+func TestRunAgain(t *testing.T) {
+	dir, err := os.MkdirTemp("", "fakeguest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	g := New(func(port uint32) string {
+		return filepath.Join(dir, fmt.Sprintf("%d.sock", port))
+	})
+	g.TimeSync.Skip = true
+
+	for _, script := range []string{"first boot", "second boot"} {
+		ready := host(t, dir, script)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := g.Run(ctx); err != nil {
+			t.Fatalf("%s: Run: %v", script, err)
+		}
+
+		got, err := g.WaitIgnition(ctx)
+		cancel()
+		if err != nil || got != script {
+			t.Errorf("%s: WaitIgnition = %q, %v", script, got, err)
+		}
+		if line := <-ready; line != "Ready\n" || !g.ReadySent() {
+			t.Errorf("%s: host read %q, ReadySent %v", script, line, g.ReadySent())
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package fakeguest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer plays sshd of the guest. The exec requests run with /bin/sh on the machine of the test,
+// so that the scripts built by the host are run by a real shell.
+type SSHServer struct {
+	conf *ssh.ServerConfig
+	nl   net.Listener
+
+	mu    sync.Mutex
+	conns []ssh.Conn
+	execs []string
+}
+
+// NewSSHServer listens on a random port of 127.0.0.1 with hostKey, only authorized may log in.
+func NewSSHServer(hostKey ssh.Signer, authorized ssh.PublicKey) (*SSHServer, error) {
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		},
+	}
+	conf.AddHostKey(hostKey)
+
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SSHServer{conf: conf, nl: nl}
+	go s.serve()
+
+	return s, nil
+}
+
+// Port is the port the server listens on, e.g. for cli.Context.SSHPort.
+func (s *SSHServer) Port() int {
+	return s.nl.Addr().(*net.TCPAddr).Port
+}
+
+// Execs returns the commands of the exec requests received so far.
+func (s *SSHServer) Execs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.execs...)
+}
+
+// CloseConnections drops the open connections, like sshd restarted in the guest.
+func (s *SSHServer) CloseConnections() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// Close stops listening and drops the open connections.
+func (s *SSHServer) Close() error {
+	err := s.nl.Close()
+	s.CloseConnections()
+
+	return err
+}
+
+func (s *SSHServer) serve() {
+	for {
+		conn, err := s.nl.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			sconn, chans, reqs, err := ssh.NewServerConn(conn, s.conf)
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.conns = append(s.conns, sconn)
+			s.mu.Unlock()
+
+			// keepalive@openssh.com and the other global requests are answered with false
+			go ssh.DiscardRequests(reqs)
+
+			for newCh := range chans {
+				if newCh.ChannelType() != "session" {
+					_ = newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+					continue
+				}
+
+				ch, reqs, err := newCh.Accept()
+				if err != nil {
+					continue
+				}
+				go s.session(ch, reqs)
+			}
+		}()
+	}
+}
+
+// signals are the signals a session can send, by their SSH names.
+var signals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGTERM: syscall.SIGTERM,
+}
+
+func (s *SSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var cmd *exec.Cmd
+	done := make(chan struct{})
+
+	for req := range reqs {
+		switch {
+		case req.Type == "exec" && cmd == nil:
+			var payload struct {
+				Command string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			s.mu.Lock()
+			s.execs = append(s.execs, payload.Command)
+			s.mu.Unlock()
+
+			cmd = exec.Command("/bin/sh", "-c", payload.Command)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+			// the stdin of the session may never end, e.g. when the client is gone
+			cmd.WaitDelay = time.Second
+			if err := cmd.Start(); err != nil {
+				_ = req.Reply(false, nil)
+				return
+			}
+			_ = req.Reply(true, nil)
+
+			go func() {
+				defer close(done)
+				_ = cmd.Wait()
+
+				status := uint32(cmd.ProcessState.ExitCode())
+				if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+					_, _ = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: signalName(ws.Signal())}))
+				} else {
+					_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				}
+				_ = ch.Close()
+			}()
+		case req.Type == "signal" && cmd != nil:
+			var payload struct {
+				Signal string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				if sig, ok := signals[ssh.Signal(payload.Signal)]; ok {
+					_ = cmd.Process.Signal(sig)
+				}
+			}
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+
+	// the client closed the session before the command exited
+	if cmd != nil {
+		_ = cmd.Process.Kill()
+		<-done
+	}
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return string(name)
+		}
+	}
+
+	return "KILL"
+}
@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The methods of CopyStats.
+const (
+	// CopyClone shares the blocks of the source, see cloneFile.
+	CopyClone = "clone"
+	// CopySparse copies the data and keeps the holes of the source.
+	CopySparse = "sparse"
+	// CopyFull copies every byte, when the filesystem can not report the holes.
+	CopyFull = "full"
+)
+
+// CopyStats describes a Copy.
+type CopyStats struct {
+	Method string
+	Size   int64
+	// Written is the number of bytes written, the rest of Size is shared with the source or left as holes.
+	Written  int64
+	Duration time.Duration
+}
+
+// Saved is the space saved compared to a full copy.
+func (s *CopyStats) Saved() int64 {
+	return s.Size - s.Written
+}
+
+// Throughput is the size copied per second.
+func (s *CopyStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+
+	return float64(s.Size) / s.Duration.Seconds()
+}
+
+func (s *CopyStats) String() string {
+	const mib = 1024 * 1024
+	return fmt.Sprintf("%s copy of %.1f MiB in %s, %.1f MiB/s, %.1f MiB saved",
+		s.Method, float64(s.Size)/mib, s.Duration.Round(time.Millisecond), s.Throughput()/mib, float64(s.Saved())/mib)
+}
+
+// Progress is called while a file is copied with the bytes of the source that are done, holes included.
+type Progress func(done, total int64)
+
+// copyBufferSize is the buffer of sparseCopy, large enough for the images of the virtual machine.
+const copyBufferSize = 1024 * 1024
+
+// sparseCopy copies src to the new file dst. Only the data regions of src, found with SEEK_DATA and SEEK_HOLE,
+// are written, so the holes of src stay holes in dst. It stops with the cause of ctx when ctx is done.
+func sparseCopy(ctx context.Context, src, dst string, progress Progress) (method string, written int64, err error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer s.Close()
+
+	info, err := s.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer d.Close()
+
+	size := info.Size()
+	c := &rangeCopier{ctx: ctx, src: s, dst: d, size: size, progress: progress, buf: make([]byte, copyBufferSize)}
+
+	// ENXIO means there is no data at all, any other error that the holes are unknown
+	if _, err := s.Seek(0, seekData); err != nil && !errors.Is(err, syscall.ENXIO) {
+		written, err = c.copy(0, size)
+		return CopyFull, written, err
+	}
+
+	for off := int64(0); off < size; {
+		data, err := s.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if err != nil {
+			return "", written, err
+		}
+
+		hole, err := s.Seek(data, seekHole)
+		if err != nil {
+			return "", written, err
+		}
+
+		n, err := c.copy(data, hole)
+		written += n
+		if err != nil {
+			return "", written, err
+		}
+
+		off = hole
+	}
+
+	// the size of a trailing hole
+	if err := d.Truncate(size); err != nil {
+		return "", written, err
+	}
+
+	return CopySparse, written, nil
+}
+
+// rangeCopier copies ranges of src to the same offsets in dst.
+type rangeCopier struct {
+	ctx      context.Context
+	src, dst *os.File
+	size     int64
+	progress Progress
+	buf      []byte
+}
+
+// copy copies the bytes from to to and reports the progress after every buffer.
+func (c *rangeCopier) copy(from, to int64) (written int64, err error) {
+	for off := from; off < to; {
+		if err := c.ctx.Err(); err != nil {
+			return written, context.Cause(c.ctx)
+		}
+
+		n, err := c.src.ReadAt(c.buf[:min(int64(len(c.buf)), to-off)], off)
+		if n > 0 {
+			if _, err := c.dst.WriteAt(c.buf[:n], off); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			off += int64(n)
+
+			if c.progress != nil {
+				c.progress(off, c.size)
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
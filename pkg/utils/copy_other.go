@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux && !darwin
+
+package utils
+
+import "errors"
+
+// seekData and seekHole are the whence of SEEK_DATA and SEEK_HOLE on Linux. Elsewhere Seek rejects them,
+// so sparseCopy copies the whole file.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+func cloneFile(src, dst string) error {
+	return errors.ErrUnsupported
+}
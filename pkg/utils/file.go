@@ -4,45 +4,202 @@
 package utils
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 )
 
-func Copy(src, dst string) error {
+// tempSuffix ends the names of the temporary files of Copy and WriteFileAtomic, see RemoveTempFiles.
+const tempSuffix = ".ovm-tmp"
+
+// Copy copies src to dst through a temporary file next to dst, which is synced and then renamed to dst.
+// If ovm is killed while copying, dst is still the old file (or missing) and never a partial copy.
+//
+// The copy is a copy-on-write clone when the filesystem supports it, otherwise the holes of src are kept,
+// see CopyStats.Method. progress may be nil. When ctx is done, the copy stops with the cause of ctx.
+func Copy(ctx context.Context, src, dst string, progress Progress) (stats *CopyStats, err error) {
+	start := time.Now()
+
 	p, err := filepath.Abs(src)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// a clone of a symlink would be the link itself, copy the file it points to
+	if p, err = filepath.EvalSymlinks(p); err != nil {
+		return nil, err
 	}
 
 	sourceFileStat, err := os.Stat(p)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !sourceFileStat.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a regular file", p)
+		return nil, fmt.Errorf("%s is not a regular file", p)
 	}
 
-	source, err := os.Open(p)
+	tmp, err := tempPath(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	stats = &CopyStats{Method: CopyClone, Size: sourceFileStat.Size()}
+	if cloneErr := cloneFile(p, tmp); cloneErr == nil {
+		if cloneErr = commitClone(tmp, dst); cloneErr == nil {
+			if progress != nil {
+				progress(stats.Size, stats.Size)
+			}
+
+			stats.Duration = time.Since(start)
+			return stats, nil
+		}
+
+		// the clone could not be committed, copy the file instead
+		_ = os.Remove(tmp)
+	}
+
+	if stats.Method, stats.Written, err = sparseCopy(ctx, p, tmp, progress); err != nil {
+		return nil, err
+	}
+
+	if progress != nil {
+		progress(stats.Size, stats.Size)
+	}
+
+	destination, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = commitTemp(destination, dst, 0644); err != nil {
+		_ = destination.Close()
+		return nil, err
+	}
+
+	stats.Duration = time.Since(start)
+
+	return stats, nil
+}
+
+// commitClone commits the clone tmp as dst, like commitTemp. The clone has the mode of the source,
+// so it is opened read-only, which is enough to chmod and sync it.
+func commitClone(tmp, dst string) error {
+	info, err := os.Lstat(tmp)
 	if err != nil {
 		return err
 	}
-	defer source.Close()
 
-	destination, err := os.Create(dst)
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("clone %s is not a regular file", tmp)
+	}
+
+	f, err := os.Open(tmp)
 	if err != nil {
 		return err
 	}
-	defer destination.Close()
 
-	if _, err = io.Copy(destination, source); err != nil {
+	if err := commitTemp(f, dst, 0644); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return nil
+}
+
+// WriteFileAtomic is os.WriteFile through a temporary file, like Copy.
+func WriteFileAtomic(p string, data []byte, perm os.FileMode) (err error) {
+	f, err := createTemp(p)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	return commitTemp(f, p, perm)
+}
+
+// RemoveTempFiles removes the temporary files that Copy and WriteFileAtomic left in dir when ovm was killed.
+func RemoveTempFiles(dir string) error {
+	matches, err := filepath.Glob(filepath.Join(dir, ".*"+tempSuffix))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, p := range matches {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// tempPath returns the path of a new hidden temporary file in the directory of p.
+func tempPath(p string) (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+"."+hex.EncodeToString(b)+tempSuffix), nil
+}
+
+// createTemp creates a hidden temporary file in the directory of p.
+func createTemp(p string) (*os.File, error) {
+	tmp, err := tempPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// commitTemp syncs and closes f and renames it to p. The directory is synced as well, so the rename
+// survives a crash.
+func commitTemp(f *os.File, p string, perm os.FileMode) error {
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(p))
+	if err != nil {
 		return err
 	}
+	defer dir.Close()
 
-	return destination.Sync()
+	return dir.Sync()
 }
 
 func CreateSparseFile(p string, size int64) error {
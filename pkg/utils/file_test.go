@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopySymlinkSource(t *testing.T) {
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "rootfs")
+	if err := os.WriteFile(src, []byte("rootfs"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(src, link); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "rootfs")
+	if _, err := Copy(context.Background(), link, dst, nil); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+
+	info, err := os.Lstat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0644 {
+		t.Errorf("dst mode = %v, want a regular file with 0644", info.Mode())
+	}
+
+	if info, err := os.Stat(src); err != nil || info.Mode().Perm() != 0444 {
+		t.Errorf("src mode = %v, %v, want 0444", info.Mode(), err)
+	}
+
+	if b, err := os.ReadFile(dst); err != nil || string(b) != "rootfs" {
+		t.Errorf("dst = %q, %v, want rootfs", b, err)
+	}
+
+	// writing the copy must not change the source
+	if err := os.WriteFile(dst, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(src); err != nil || string(b) != "rootfs" {
+		t.Errorf("src = %q, %v, want rootfs", b, err)
+	}
+}
+
+func TestCommitClone(t *testing.T) {
+	dir := t.TempDir()
+
+	// a clone keeps the read-only mode of its source
+	tmp := filepath.Join(dir, ".rootfs.tmp")
+	if err := os.WriteFile(tmp, []byte("rootfs"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "rootfs")
+	if err := commitClone(tmp, dst); err != nil {
+		t.Fatalf("commitClone read-only clone: %v", err)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("dst mode = %v, %v, want 0644", info.Mode(), err)
+	}
+
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("src"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, ".link.tmp")
+	if err := os.Symlink(src, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := commitClone(link, filepath.Join(dir, "linked")); err == nil {
+		t.Error("commitClone of a symlink succeeded, want an error")
+	}
+	if info, err := os.Stat(src); err != nil || info.Mode().Perm() != 0444 {
+		t.Errorf("symlink target mode = %v, %v, want 0444", info.Mode(), err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "linked")); !os.IsNotExist(err) {
+		t.Errorf("linked exists, err %v", err)
+	}
+}
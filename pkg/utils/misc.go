@@ -15,5 +15,10 @@ func LocalTZ() (string, error) {
 		return "", fmt.Errorf("readlink /etc/localtime failed: %v", err)
 	}
 
-	return strings.TrimPrefix(tzPath, "/var/db/timezone/zoneinfo"), nil
+	// e.g. /var/db/timezone/zoneinfo/Asia/Shanghai on macOS, /usr/share/zoneinfo/Asia/Shanghai on Linux
+	if i := strings.Index(tzPath, "zoneinfo/"); i != -1 {
+		return tzPath[i+len("zoneinfo"):], nil
+	}
+
+	return tzPath, nil
 }
@@ -5,31 +5,49 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 )
 
-func AcceptTimeout(ctx context.Context, nl net.Listener, timeout <-chan time.Time) (conn net.Conn, err error) {
-	acc := make(chan error, 1)
-	defer close(acc)
+// ErrAcceptTimeout is returned by AcceptTimeout when timeout fires first.
+var ErrAcceptTimeout = errors.New("wait net accept timeout")
 
+// AcceptTimeout accepts one connection of nl. nl is closed when ctx is done or timeout fires first,
+// a connection accepted at that moment is closed too.
+func AcceptTimeout(ctx context.Context, nl net.Listener, timeout <-chan time.Time) (net.Conn, error) {
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+
+	acc := make(chan accepted, 1)
 	go func() {
-		accept, err := nl.Accept()
-		conn = accept
-		acc <- err
+		conn, err := nl.Accept()
+		acc <- accepted{conn: conn, err: err}
 	}()
 
+	giveUp := func() {
+		_ = nl.Close()
+
+		go func() {
+			if a := <-acc; a.conn != nil {
+				_ = a.conn.Close()
+			}
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
-		_ = nl.Close()
+		giveUp()
 
-		return conn, fmt.Errorf("cancel wait net accept %s because ctx done", nl.Addr().String())
+		return nil, fmt.Errorf("cancel wait net accept %s because ctx done", nl.Addr().String())
 	case <-timeout:
-		_ = nl.Close()
+		giveUp()
 
-		return conn, fmt.Errorf("wait net accept timeout %s", nl.Addr().String())
-	case err := <-acc:
-		return conn, err
+		return nil, fmt.Errorf("%w %s", ErrAcceptTimeout, nl.Addr().String())
+	case a := <-acc:
+		return a.conn, a.err
 	}
 }
@@ -4,10 +4,19 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func GenerateSSHKey(p, name string) error {
@@ -35,3 +44,110 @@ func GenerateSSHKey(p, name string) error {
 
 	return fmt.Errorf("failed to generate keys: %s: %w", string(errMsg), waitErr)
 }
+
+// ErrHostKeyMismatch is returned by connections whose host key is not the key given to HostKeyCallback.
+var ErrHostKeyMismatch = errors.New("ssh host key mismatch")
+
+// HostKeyCallback accepts only key as the host key. It is ssh.FixedHostKey with an error that can be told apart.
+func HostKeyCallback(key ssh.PublicKey) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, got ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), got.Marshal()) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrHostKeyMismatch, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(got))
+		}
+		return nil
+	}
+}
+
+// UpdateKnownHosts makes key the only key of addr in the known_hosts file p. Other entries are kept as they are,
+// hashed entries of addr cannot be recognized and are kept too.
+func UpdateKnownHosts(p, addr string, key ssh.PublicKey) error {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	host := knownhosts.Normalize(addr)
+	entry := knownhosts.Line([]string{host}, key)
+
+	var lines []string
+	found, removed := false, false
+	if content := strings.TrimRight(string(b), "\n"); content != "" {
+		for _, line := range strings.Split(content, "\n") {
+			if line == entry {
+				found = true
+			} else if rest, ok := knownHostsLineWithout(line, host); ok {
+				removed = true
+				if rest == "" {
+					continue
+				}
+				line = rest
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if found && !removed {
+		return nil
+	}
+
+	if !found {
+		lines = append(lines, entry)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".known_hosts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(p); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// knownHostsLineWithout removes host from the plain host patterns of a known_hosts line. ok reports whether host
+// was there, line is empty if no pattern is left.
+func knownHostsLineWithout(line, host string) (rest string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+		return line, false
+	}
+
+	var hosts []string
+	for _, h := range strings.Split(fields[0], ",") {
+		if h == host {
+			ok = true
+		} else {
+			hosts = append(hosts, h)
+		}
+	}
+
+	if !ok || len(hosts) == 0 {
+		return "", ok
+	}
+
+	return strings.Join(hosts, ",") + strings.TrimPrefix(line, fields[0]), true
+}
@@ -0,0 +1,201 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func readLines(t *testing.T, p string) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+}
+
+func TestUpdateKnownHostsReplace(t *testing.T) {
+	const addr = "127.0.0.1:2222"
+	host := knownhosts.Normalize(addr)
+	oldKey, newKey, otherKey := newPublicKey(t), newPublicKey(t), newPublicKey(t)
+
+	other := knownhosts.Line([]string{"example.com"}, otherKey)
+	hashed := knownhosts.Line([]string{knownhosts.HashHostname(host)}, oldKey)
+
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	content := strings.Join([]string{
+		"# a comment about " + host,
+		other,
+		knownhosts.Line([]string{host}, oldKey),
+		knownhosts.Line([]string{"shared.example.com", host}, oldKey),
+		hashed,
+	}, "\n") + "\n"
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpdateKnownHosts(p, addr, newKey); err != nil {
+		t.Fatalf("UpdateKnownHosts: %v", err)
+	}
+
+	want := []string{
+		"# a comment about " + host,
+		other,
+		knownhosts.Line([]string{"shared.example.com"}, oldKey),
+		hashed,
+		knownhosts.Line([]string{host}, newKey),
+	}
+	if got := readLines(t, p); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("known_hosts =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if info, err := os.Stat(p); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("stat = %v, %v, want the mode 0644 kept", info, err)
+	}
+
+	// the only entry of the key is not written again
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(p, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateKnownHosts(p, addr, newKey); err != nil {
+		t.Fatalf("UpdateKnownHosts: %v", err)
+	}
+	if info, err := os.Stat(p); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("known_hosts was written again without a change")
+	}
+}
+
+func TestUpdateKnownHostsMissing(t *testing.T) {
+	p := filepath.Join(t.TempDir(), ".ssh", "known_hosts")
+	key := newPublicKey(t)
+
+	if err := UpdateKnownHosts(p, "127.0.0.1:22", key); err != nil {
+		t.Fatalf("UpdateKnownHosts: %v", err)
+	}
+
+	if got := readLines(t, p); len(got) != 1 || got[0] != knownhosts.Line([]string{"127.0.0.1"}, key) {
+		t.Errorf("known_hosts = %q, want the entry of 127.0.0.1", got)
+	}
+	if info, err := os.Stat(p); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("stat = %v, %v, want the mode 0600", info, err)
+	}
+}
+
+func TestUpdateKnownHostsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "known_hosts")
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		t.Fatal(err)
+	}
+	other := knownhosts.Line([]string{"example.com"}, newPublicKey(t))
+	if err := os.WriteFile(target, []byte(other+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "known_hosts")
+	if err := os.Symlink(filepath.Join("dotfiles", "known_hosts"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newPublicKey(t)
+	if err := UpdateKnownHosts(link, "127.0.0.1:2222", key); err != nil {
+		t.Fatalf("UpdateKnownHosts: %v", err)
+	}
+
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat = %v, %v, want known_hosts still a symlink", info, err)
+	}
+
+	want := []string{other, knownhosts.Line([]string{"[127.0.0.1]:2222"}, key)}
+	if got := readLines(t, target); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("target of the symlink = %q, want %q", got, want)
+	}
+
+	// the temporary file was created next to the target, so that the rename does not cross file systems
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files next to the target = %v, want only known_hosts", entries)
+	}
+}
+
+func TestUpdateKnownHostsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "known_hosts")
+	old := knownhosts.Line([]string{"[127.0.0.1]:2222"}, newPublicKey(t))
+	if err := os.WriteFile(p, []byte(old+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader of the old file sees it whole, the new content is renamed in place of it
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	before, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newPublicKey(t)
+	if err := UpdateKnownHosts(p, "127.0.0.1:2222", key); err != nil {
+		t.Fatalf("UpdateKnownHosts: %v", err)
+	}
+
+	after, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("known_hosts was rewritten in place")
+	}
+
+	b := make([]byte, len(old)+1)
+	if _, err := f.ReadAt(b, 0); err != nil || string(b) != old+"\n" {
+		t.Errorf("old file = %q, %v, want it unchanged", b, err)
+	}
+	if got := readLines(t, p); len(got) != 1 || got[0] != knownhosts.Line([]string{"[127.0.0.1]:2222"}, key) {
+		t.Errorf("known_hosts = %q, want the new entry only", got)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files = %v, want no temporary file left", entries)
+	}
+}
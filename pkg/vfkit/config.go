@@ -9,7 +9,7 @@ import (
 	"github.com/oomol-lab/ovm/pkg/logger"
 )
 
-func vmConfig(opt *cli.Context, log *logger.Context) (*config.VirtualMachine, error) {
+func vmConfig(opt *cli.Context, mounts *_mounts, log *logger.Context) (*config.VirtualMachine, error) {
 	bootloaderCMD := []string{"linux", "kernel=" + opt.KernelPath, "initrd=" + opt.InitrdPath, "cmdline=" + kernelCMD(opt)}
 	log.Infof("bootloader params: %+v", bootloaderCMD)
 
@@ -24,35 +24,28 @@ func vmConfig(opt *cli.Context, log *logger.Context) (*config.VirtualMachine, er
 
 	// Order cannot be disrupted
 	{
-		log.Infof("block devices: vda: '%s', vdb: '%s', vdc: '%s'", opt.RootfsPath, opt.DiskTmpPath, opt.DiskDataPath)
+		devs := blockDevices(opt)
+		log.Infof("block devices: vda: '%s', vdb: '%s', vdc: '%s'", devs[0].Path, devs[1].Path, devs[2].Path)
 
-		rootfs, _ := config.VirtioBlkNew(opt.RootfsPath)
-		_ = vm.AddDevice(rootfs) // vda
-
-		tmp, _ := config.VirtioBlkNew(opt.DiskTmpPath)
-		_ = vm.AddDevice(tmp) // vdb
+		if len(devs) > 3 {
+			log.Infof("old data disk: %s: '%s'", devs[3].Name, devs[3].Path)
+		}
 
-		data, _ := config.VirtioBlkNew(opt.DiskDataPath)
-		_ = vm.AddDevice(data) // vdc
+		for _, dev := range devs {
+			blk, _ := config.VirtioBlkNew(dev.Path)
+			blk.ReadOnly = dev.ReadOnly
+			_ = vm.AddDevice(blk)
+		}
 	}
 
 	{
-		log.Infof("vsock device: network: '%d-%s', initrd: '%d-%s', ready: '%d-%s'", 1024, opt.SocketNetworkPath, 1025, opt.SocketInitrdVSockPath, 1026, opt.SocketReadyPath)
-
-		network, _ := config.VirtioVsockNew(1024, opt.SocketNetworkPath, false)
-		_ = vm.AddDevice(network) // vm network device
-
-		initrd, _ := config.VirtioVsockNew(1025, opt.SocketInitrdVSockPath, false)
-		_ = vm.AddDevice(initrd) // initrd vsock device (https://github.com/oomol-lab/vsock-guest-exec)
-
-		ready, _ := config.VirtioVsockNew(1026, opt.SocketReadyPath, false)
-		_ = vm.AddDevice(ready) // vm is ready (https://github.com/oomol-lab/ovm-core/blob/7c85e7603da0873099c1a288be1f70e44e24c1f5/buildroot_external/board/ovm/ready/rootfs-overlay/etc/systemd/system/ready.service)
+		ports := vsockPorts(opt)
+		log.Infof("vsock device: network: '%d-%s', initrd: '%d-%s', ready: '%d-%s'", ports[0].Port, ports[0].SocketPath, ports[1].Port, ports[1].SocketPath, ports[2].Port, ports[2].SocketPath)
 
-		timeSync, _ := config.VirtioVsockNew(1027, opt.TimeSyncSocketPath, false)
-		_ = vm.AddDevice(timeSync) // sync vm time
-
-		sshAuth, _ := config.VirtioVsockNew(1028, opt.SSHAuthSocketPath, false)
-		_ = vm.AddDevice(sshAuth)
+		for _, port := range ports {
+			vsock, _ := config.VirtioVsockNew(port.Port, port.SocketPath, false)
+			_ = vm.AddDevice(vsock)
+		}
 	}
 
 	if opt.IsCliMode {
@@ -80,3 +73,46 @@ func vmConfig(opt *cli.Context, log *logger.Context) (*config.VirtualMachine, er
 
 	return vm, nil
 }
+
+// BlockDevice is a virtio block device, in the order they are attached (vda, vdb, ...).
+type BlockDevice struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+func blockDevices(opt *cli.Context) []BlockDevice {
+	devs := []BlockDevice{
+		{Name: "vda", Path: opt.RootfsPath},
+		{Name: "vdb", Path: opt.DiskTmpPath},
+		{Name: "vdc", Path: opt.DiskDataPath},
+	}
+
+	// the old data disk for -data-migrate, see cli.OldDataDevice
+	if opt.DataMigration != nil {
+		devs = append(devs, BlockDevice{Name: "vdd", Path: opt.DataMigration.OldDataPath, ReadOnly: true})
+	}
+
+	return devs
+}
+
+// VsockPort is a vsock port of the guest, connections started by the guest are forwarded to SocketPath.
+type VsockPort struct {
+	Name       string `json:"name"`
+	Port       uint   `json:"port"`
+	SocketPath string `json:"socketPath"`
+}
+
+func vsockPorts(opt *cli.Context) []VsockPort {
+	return []VsockPort{
+		// vm network device
+		{Name: "network", Port: 1024, SocketPath: opt.SocketNetworkPath},
+		// initrd vsock device (https://github.com/oomol-lab/vsock-guest-exec)
+		{Name: "initrd", Port: 1025, SocketPath: opt.SocketInitrdVSockPath},
+		// vm is ready (https://github.com/oomol-lab/ovm-core/blob/7c85e7603da0873099c1a288be1f70e44e24c1f5/buildroot_external/board/ovm/ready/rootfs-overlay/etc/systemd/system/ready.service)
+		{Name: "ready", Port: 1026, SocketPath: opt.SocketReadyPath},
+		// sync vm time
+		{Name: "timeSync", Port: 1027, SocketPath: opt.TimeSyncSocketPath},
+		{Name: "sshAuth", Port: 1028, SocketPath: opt.SSHAuthSocketPath},
+	}
+}
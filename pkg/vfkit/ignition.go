@@ -4,19 +4,26 @@
 package vfkit
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
 	"github.com/oomol-lab/ovm/pkg/ipc/event"
 	"github.com/oomol-lab/ovm/pkg/logger"
 	"github.com/oomol-lab/ovm/pkg/utils"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 )
 
-func cmd(opt *cli.Context) (string, error) {
+// cmd is the ignition script run by the initrd. Unless secrets is true, the private host key is left out of it.
+func cmd(opt *cli.Context, mounts *_mounts, secrets bool) (string, error) {
 	localTZ, err := utils.LocalTZ()
 	if err != nil {
 		return "", err
@@ -30,27 +37,55 @@ func cmd(opt *cli.Context) (string, error) {
 
 	mount := fmt.Sprintf("echo -e %s >> /mnt/overlay/etc/fstab", fstab)
 	authorizedKeys := fmt.Sprintf("mkdir -p /mnt/overlay/root/.ssh; echo %s >> /mnt/overlay/root/.ssh/authorized_keys", opt.SSHPublicKey)
+	hostKey, err := hostKeyCmd(opt, secrets)
+	if err != nil {
+		return "", err
+	}
 	ready := fmt.Sprintf("echo -e \"date -s @%d;\\\\necho Ready | socat -v -d -d - VSOCK-CONNECT:2:1026\" > /mnt/overlay/opt/ready.command", time.Now().Unix())
 
-	return fmt.Sprintf("%s; %s; %s; %s", mount, authorizedKeys, ready, tz), nil
+	return fmt.Sprintf("%s; %s; %s; %s; %s", mount, authorizedKeys, hostKey, ready, tz), nil
+}
+
+// hostKeyCmd installs the host key generated by ovm as the ed25519 host key of sshd in the guest.
+// The private key is passed base64 encoded, it spans multiple lines.
+func hostKeyCmd(opt *cli.Context, secrets bool) (string, error) {
+	private, public := "<private host key>", "<public host key>"
+
+	if secrets {
+		b, err := os.ReadFile(opt.SSHHostKeyPath)
+		if err != nil {
+			return "", fmt.Errorf("read ssh host key error: %w", err)
+		}
+		private = base64.StdEncoding.EncodeToString(b)
+	}
+
+	if opt.SSHHostKey != nil {
+		public = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(opt.SSHHostKey)))
+	}
+
+	const p = "/mnt/overlay/etc/ssh/ssh_host_ed25519_key"
+	return fmt.Sprintf("mkdir -p /mnt/overlay/etc/ssh; echo %s | base64 -d > %s; chmod 600 %s; echo %s > %s.pub", private, p, p, public, p), nil
 }
 
-func ignition(ctx context.Context, g *errgroup.Group, opt *cli.Context, log *logger.Context) error {
+func ignition(ctx context.Context, g *errgroup.Group, opt *cli.Context, mounts *_mounts, ev *event.Context, log *logger.Context) error {
 	listen, err := net.Listen("unix", opt.SocketInitrdVSockPath)
 	if err != nil {
-		return fmt.Errorf("listen ignition socket failed: %v", err)
+		return errcode.New(errcode.IgnitionFailed, "listen ignition socket failed: %w", err)
 	}
 
-	cmdStr, err := cmd(opt)
+	cmdStr, err := cmd(opt, mounts, true)
 	if err != nil {
-		return fmt.Errorf("generate ignition command failed: %v", err)
+		return errcode.New(errcode.IgnitionFailed, "generate ignition command failed: %w", err)
 	}
 
 	g.Go(func() error {
-		conn, err := utils.AcceptTimeout(ctx, listen, time.After(15*time.Second))
+		conn, err := utils.AcceptTimeout(ctx, listen, time.After(opt.Timeouts.Ignition))
 		if err != nil {
 			log.Errorf("ignition accept timeout: %v", err)
-			return err
+			if errors.Is(err, utils.ErrAcceptTimeout) {
+				return errcode.Wrap(errcode.IgnitionTimeout, err)
+			}
+			return errcode.Wrap(errcode.IgnitionFailed, err)
 		}
 
 		if _, werr := conn.Write([]byte(cmdStr)); werr != nil {
@@ -58,7 +93,7 @@ func ignition(ctx context.Context, g *errgroup.Group, opt *cli.Context, log *log
 			err = werr
 		} else {
 			log.Info("write ignition command success")
-			event.NotifyApp(event.IgnitionDone)
+			ev.NotifyApp(event.IgnitionDone)
 		}
 
 		if cerr := conn.Close(); cerr != nil {
@@ -66,7 +101,7 @@ func ignition(ctx context.Context, g *errgroup.Group, opt *cli.Context, log *log
 			err = cerr
 		}
 
-		return err
+		return errcode.Wrap(errcode.IgnitionFailed, err)
 	})
 
 	return nil
@@ -5,6 +5,7 @@ package vfkit
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/crc-org/vfkit/pkg/config"
@@ -19,25 +20,40 @@ type _mounts struct {
 	list []fs
 }
 
-var mounts = &_mounts{
-	list: []fs{
-		{
-			tag:      "vfkit-share-user",
-			shareDir: "/Users",
+// newMounts returns the default shares, extended by the given tag to directory map.
+func newMounts(extendShareDir map[string]string) *_mounts {
+	m := &_mounts{
+		list: []fs{
+			{
+				tag:      "vfkit-share-user",
+				shareDir: "/Users",
+			},
+			{
+				tag:      "vfkit-share-var-folders",
+				shareDir: "/var/folders",
+			},
+			{
+				tag:      "vfkit-share-private",
+				shareDir: "/private",
+			},
 		},
-		{
-			tag:      "vfkit-share-var-folders",
-			shareDir: "/var/folders",
-		},
-		{
-			tag:      "vfkit-share-private",
-			shareDir: "/private",
-		},
-	},
+	}
+
+	tags := make([]string, 0, len(extendShareDir))
+	for tag := range extendShareDir {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		m.extend(tag, extendShareDir[tag])
+	}
+
+	return m
 }
 
 func (m *_mounts) extend(tag, shareDir string) {
-	for _, fs := range mounts.list {
+	for _, fs := range m.list {
 		if fs.tag == tag || fs.shareDir == shareDir {
 			return
 		}
@@ -0,0 +1,46 @@
+// SPDX-FileCopyrightText: 2024 OOMOL, Inc. <https://www.oomol.com>
+// SPDX-License-Identifier: MPL-2.0
+
+package vfkit
+
+import (
+	"github.com/oomol-lab/ovm/pkg/cli"
+)
+
+// Mount is a virtio-fs share between the host and the guest.
+type Mount struct {
+	Tag      string `json:"tag"`
+	ShareDir string `json:"shareDir"`
+}
+
+// Plan is the virtual machine that Run would create.
+type Plan struct {
+	KernelCmdline  string        `json:"kernelCmdline"`
+	BlockDevices   []BlockDevice `json:"blockDevices"`
+	VsockPorts     []VsockPort   `json:"vsockPorts"`
+	Mounts         []Mount       `json:"mounts"`
+	IgnitionScript string        `json:"ignitionScript"`
+}
+
+// NewPlan resolves the virtual machine for opt, which must have been set up (see cli.Context.Plan).
+func NewPlan(opt *cli.Context) (*Plan, error) {
+	mounts := newMounts(opt.ExtendShareDir)
+
+	script, err := cmd(opt, mounts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{
+		KernelCmdline:  kernelCMD(opt),
+		BlockDevices:   blockDevices(opt),
+		VsockPorts:     vsockPorts(opt),
+		IgnitionScript: script,
+	}
+
+	for _, fs := range mounts.list {
+		p.Mounts = append(p.Mounts, Mount{Tag: fs.tag, ShareDir: fs.shareDir})
+	}
+
+	return p, nil
+}
@@ -11,10 +11,10 @@ import (
 	"runtime"
 	"time"
 
-	"github.com/Code-Hex/vz/v3"
-	"github.com/crc-org/vfkit/pkg/vf"
 	"github.com/oomol-lab/ovm/pkg/channel"
 	"github.com/oomol-lab/ovm/pkg/cli"
+	"github.com/oomol-lab/ovm/pkg/errcode"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
 	"github.com/oomol-lab/ovm/pkg/ipc/event"
 	"github.com/oomol-lab/ovm/pkg/ipc/restful"
 	"github.com/oomol-lab/ovm/pkg/logger"
@@ -22,44 +22,50 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
+func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context, backend hypervisor.Backend, ch *channel.Context, ev *event.Context) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	for tag, dir := range opt.ExtendShareDir {
-		mounts.extend(tag, dir)
-	}
+	mounts := newMounts(opt.ExtendShareDir)
 
-	log, err := logger.New(opt.LogPath, opt.Name+"-vfkit")
+	log, err := opt.Loggers.New(opt.LogPath, opt.Name+"-vfkit")
 	if err != nil {
 		return fmt.Errorf("create vfkit logger error: %v", err)
 	}
 
-	vmC, err := vmConfig(opt, log)
+	vmC, err := vmConfig(opt, mounts, log)
 	if err != nil {
 		log.Errorf("creating virtual machine config failed: %v", err)
-		return err
+		return errcode.Wrap(errcode.VMCreateFailed, err)
 	}
 
-	vzVMConfig, err := vf.ToVzVirtualMachineConfig(vmC)
+	vm, err := backend.NewVirtualMachine(vmC)
 	if err != nil {
-		log.Errorf("converting virtual machine config to vz failed: %v", err)
-		return err
-	}
-
-	vm, err := vz.NewVirtualMachine(vzVMConfig)
-	if err != nil {
-		log.Errorf("creating vz virtual machine failed: %v", err)
-		return err
+		log.Errorf("creating virtual machine failed: %v", err)
+		return errcode.Wrap(errcode.VMCreateFailed, err)
 	}
 
+	var api *restful.Restful
 	{
 		nl, err := net.Listen("unix", opt.RestfulSocketPath)
 		if err != nil {
 			log.Errorf("create server failed: %v", err)
 			return err
 		}
-		restful.New(vm, vmC, log, opt).Start(ctx, g, nl)
+		api = restful.New(vm, vmC, log, opt, ev)
+		api.Start(ctx, g, nl)
+	}
+
+	if opt.DataMigration != nil {
+		g.Go(func() error {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ch.ReceiveDataMigrate():
+				api.Migrate(ctx)
+				return nil
+			}
+		})
 	}
 
 	select {
@@ -69,31 +75,34 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 	case <-time.After(10 * time.Second):
 		msg := "timeout waiting for gvproxy to start"
 		log.Error(msg)
-		return errors.New(msg)
-	case <-channel.ReceiveGVProxyReady():
+		return errcode.New(errcode.GVProxyTimeout, msg)
+	case <-ch.ReceiveGVProxyReady():
 		log.Info("gvproxy is ready, start VM")
 		break
 	}
 
-	if err := powermonitor.Setup(ctx, g, opt, vm, log); err != nil {
+	if err := powermonitor.Setup(ctx, g, opt, vm, ch, ev, log); err != nil {
 		log.Errorf("setup powermonitor failed: %v", err)
 		return err
 	}
 
-	vmState := make(chan vz.VirtualMachineState, 1)
+	vmState := make(chan hypervisor.State, 1)
 
+	from := vm.State()
 	g.Go(func() error {
 		for {
 			state := <-vm.StateChangedNotify()
 			log.Infof("VM state changed: %s", state)
+			ev.NotifyState(from.String(), state.String())
+			from = state
 			vmState <- state
 
 			switch state {
-			case vz.VirtualMachineStateStopped, vz.VirtualMachineStateError:
+			case hypervisor.StateStopped, hypervisor.StateError:
 				log.Infof("stop listen VM state, because VM interruption, current state is: %s", state)
 				return nil
-			case vz.VirtualMachineStateResuming:
-				channel.NotifySyncTime()
+			case hypervisor.StateResuming:
+				ch.NotifySyncTime()
 			default:
 				// do nothing
 			}
@@ -101,17 +110,22 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 	})
 
 	if err := vm.Start(); err != nil {
-		return err
+		return errcode.Wrap(errcode.VMStartFailed, err)
 	}
 
-	event.NotifyApp(event.IgnitionProgress)
+	ev.NotifyApp(event.IgnitionProgress)
 
-	if err := ignition(ctx, g, opt, log); err != nil {
+	if err := ignition(ctx, g, opt, mounts, ev, log); err != nil {
 		log.Errorf("ignition failed: %v", err)
 		return err
 	}
 
-	if err := waitForVMState(vmState, vz.VirtualMachineStateRunning, time.After(5*time.Second)); err != nil {
+	if err := waitForVMState(vmState, hypervisor.StateRunning, time.After(5*time.Second)); err != nil {
+		if errors.Is(err, errVMStateTimeout) {
+			err = errcode.Wrap(errcode.VMStartTimeout, err)
+		} else {
+			err = errcode.Wrap(errcode.VMStartFailed, err)
+		}
 		log.Errorf("waiting for VM to start failed: %v", err)
 		return err
 	}
@@ -135,21 +149,27 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 	})
 
 	g.Go(func() error {
-		if err := waitForVMState(vmState, vz.VirtualMachineStateStopped, nil); err != nil {
+		if err := waitForVMState(vmState, hypervisor.StateStopped, nil); err != nil {
 			log.Errorf("waiting for VM to stop failed: %v", err)
 			return err
 		}
 
+		if api.StopRequested() {
+			msg := "VM is stopped by an API request"
+			log.Warn(msg)
+			return errcode.New(errcode.APIStop, msg)
+		}
+
 		msg := "VM is stopped in waitForVMState"
 		log.Warn(msg)
-		return errors.New(msg)
+		return errcode.New(errcode.VMStopped, msg)
 	})
 
 	g.Go(func() error {
 		<-ctx.Done()
 		log.Infof("stop VM, because context done")
 
-		if err := stopVM(vm, log); err != nil {
+		if err := stopVM(vm, opt.Timeouts.RequestStop, log); err != nil {
 			log.Errorf("error stopping VM: %v", err)
 		} else {
 			log.Infof("VM is stopped in stopVM")
@@ -161,24 +181,27 @@ func Run(ctx context.Context, g *errgroup.Group, opt *cli.Context) error {
 	return nil
 }
 
-func waitForVMState(chState <-chan vz.VirtualMachineState, state vz.VirtualMachineState, timeout <-chan time.Time) error {
+var errVMStateTimeout = errors.New("timeout waiting for VM")
+
+func waitForVMState(chState <-chan hypervisor.State, state hypervisor.State, timeout <-chan time.Time) error {
 	for {
 		select {
 		case newState := <-chState:
 			if newState == state {
 				return nil
 			}
-			if newState == vz.VirtualMachineStateError {
+			if newState == hypervisor.StateError {
 				return fmt.Errorf("VM state is error, expected state: %s", state)
 			}
 		case <-timeout:
-			return fmt.Errorf("timeout waiting for VM %s", state)
+			return fmt.Errorf("%w %s", errVMStateTimeout, state)
 		}
 	}
 }
 
-func stopVM(vm *vz.VirtualMachine, log *logger.Context) error {
-	err := requestStopVM(vm, log)
+// stopVM asks the guest to power off, the virtual machine is stopped by force when it is not stopped within timeout.
+func stopVM(vm hypervisor.VirtualMachine, timeout time.Duration, log *logger.Context) error {
+	err := requestStopVM(vm, timeout, log)
 	if err == nil {
 		return nil
 	}
@@ -186,7 +209,7 @@ func stopVM(vm *vz.VirtualMachine, log *logger.Context) error {
 	log.Errorf("requesting VM to stop failed: %v", err)
 
 	state := vm.State()
-	if state == vz.VirtualMachineStateStopped || state == vz.VirtualMachineStateError {
+	if state == hypervisor.StateStopped || state == hypervisor.StateError {
 		log.Infof("VM stopped, state is: %s", state)
 		return nil
 	}
@@ -202,10 +225,10 @@ func stopVM(vm *vz.VirtualMachine, log *logger.Context) error {
 	return nil
 }
 
-func requestStopVM(vm *vz.VirtualMachine, log *logger.Context) error {
+func requestStopVM(vm hypervisor.VirtualMachine, timeout time.Duration, log *logger.Context) error {
 	stateAlreadyStopping := false
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	for {
@@ -214,17 +237,17 @@ func requestStopVM(vm *vz.VirtualMachine, log *logger.Context) error {
 		}
 
 		switch vm.State() {
-		case vz.VirtualMachineStateStopped:
+		case hypervisor.StateStopped:
 			log.Infof("VM is already stopped")
 			return nil
 
-		case vz.VirtualMachineStateStopping:
+		case hypervisor.StateStopping:
 			if !stateAlreadyStopping {
 				log.Infof("VM state is stopping, waiting for it to stop")
 				stateAlreadyStopping = true
 			}
 
-		case vz.VirtualMachineStateError:
+		case hypervisor.StateError:
 			log.Errorf("VM is in error state in stopVM")
 			return nil
 
@@ -10,13 +10,13 @@ import (
 	"net/url"
 	"strconv"
 
-	"github.com/Code-Hex/vz/v3"
 	"github.com/crc-org/vfkit/pkg/config"
+	"github.com/oomol-lab/ovm/pkg/hypervisor"
 	"github.com/oomol-lab/ovm/pkg/logger"
 	"inet.af/tcpproxy"
 )
 
-func connectVsocks(vm *vz.VirtualMachine, devs []*config.VirtioVsock, log *logger.Context) (release func(), err error) {
+func connectVsocks(vm hypervisor.VirtualMachine, devs []*config.VirtioVsock, log *logger.Context) (release func(), err error) {
 	releases := make([]func(), 0, len(devs))
 	for _, vsock := range devs {
 		port := vsock.Port
@@ -38,7 +38,7 @@ func connectVsocks(vm *vz.VirtualMachine, devs []*config.VirtioVsock, log *logge
 
 // listenVsock proxies connections from a vsock port to a host unix socket.
 // This allows the guest to initiate connections to the host over vsock
-func listenVsock(vm *vz.VirtualMachine, port uint, vsockPath string) (release func(), err error) {
+func listenVsock(vm hypervisor.VirtualMachine, port uint, vsockPath string) (release func(), err error) {
 	var proxy tcpproxy.Proxy
 	// listen for connections on the vsock port
 	proxy.ListenFunc = func(_, laddr string) (net.Listener, error) {
@@ -52,11 +52,7 @@ func listenVsock(vm *vz.VirtualMachine, port uint, vsockPath string) (release fu
 			if err != nil {
 				return nil, err
 			}
-			socketDevices := vm.SocketDevices()
-			if len(socketDevices) != 1 {
-				return nil, fmt.Errorf("VM has too many/not enough virtio-vsock devices (%d)", len(socketDevices))
-			}
-			return socketDevices[0].Listen(uint32(port))
+			return vm.ListenVsock(uint32(port))
 		default:
 			return nil, fmt.Errorf("unexpected scheme '%s'", parsed.Scheme)
 		}